@@ -0,0 +1,205 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "sort"
+
+    "github.com/gin-gonic/gin"
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Call auction: the orders collected during a call phase are uncrossed at one price for everybody.
+
+    The auction price is the limit price at which the most quantity executes. Ties go to the price that leaves the
+    smallest imbalance, then to the price closest to the last traded price, then to the lowest price. Buys execute
+    from the highest limit down and sells from the lowest limit up, oldest first within a price, and each fill is
+    settled like any other trade at the auction price. The hidden reserve of an iceberg order takes part in full: a
+    slice used up in the uncross is refilled on the spot.
+*/
+type AuctionIndicative struct {
+    StockID       string           `json:"stock_id"`
+    Session       string           `json:"session"`
+    Price         *decimal.Decimal `json:"price"` // nil while the book does not cross
+    Volume        decimal.Decimal  `json:"volume"`
+    Imbalance     decimal.Decimal  `json:"imbalance"`
+    ImbalanceSide string           `json:"imbalance_side"` // BUY, SELL or empty when balanced
+}
+
+// Define the structure of the response body for the indicative auction
+type AuctionIndicativeResponse struct {
+    Success bool              `json:"success"`
+    Data    AuctionIndicative `json:"data"`
+}
+
+// computeAuction finds the price that uncrosses the book with the most executed quantity
+func computeAuction(book *OrderBook, referencePrice decimal.Decimal) AuctionIndicative {
+    result := AuctionIndicative{StockID: book.StockID, Session: book.Session}
+
+    candidates := make(map[string]decimal.Decimal)
+    for _, order := range append(append([]*Order{}, book.BuyOrders.Order...), book.SellOrders.Order...) {
+        candidates[order.Price.String()] = *order.Price
+    }
+
+    var bestImbalance, bestDistance decimal.Decimal
+    for _, price := range candidates {
+        var buyVolume, sellVolume decimal.Decimal
+        for _, order := range book.BuyOrders.Order {
+            if order.Price.GreaterThanOrEqual(price) {
+                buyVolume = buyVolume.Add(remainingQuantity(*order))
+            }
+        }
+        for _, order := range book.SellOrders.Order {
+            if order.Price.LessThanOrEqual(price) {
+                sellVolume = sellVolume.Add(remainingQuantity(*order))
+            }
+        }
+
+        volume := decimal.Min(buyVolume, sellVolume)
+        if !volume.IsPositive() {
+            continue
+        }
+        imbalance := buyVolume.Sub(sellVolume).Abs()
+        distance := price.Sub(referencePrice).Abs()
+
+        better := result.Price == nil || volume.GreaterThan(result.Volume)
+        if !better && volume.Equal(result.Volume) {
+            switch {
+            case !imbalance.Equal(bestImbalance):
+                better = imbalance.LessThan(bestImbalance)
+            case referencePrice.IsPositive() && !distance.Equal(bestDistance):
+                better = distance.LessThan(bestDistance)
+            default:
+                better = price.LessThan(*result.Price)
+            }
+        }
+        if !better {
+            continue
+        }
+
+        auctionPrice := price
+        result.Price = &auctionPrice
+        result.Volume = volume
+        result.Imbalance = imbalance
+        bestImbalance, bestDistance = imbalance, distance
+
+        result.ImbalanceSide = ""
+        if buyVolume.GreaterThan(sellVolume) {
+            result.ImbalanceSide = "BUY"
+        } else if sellVolume.GreaterThan(buyVolume) {
+            result.ImbalanceSide = "SELL"
+        }
+    }
+
+    return result
+}
+
+// executeAuctionFill settles one fill of the uncross, a test can swap it to uncross a book without a database
+var executeAuctionFill = executeTradeQuantity
+
+// uncrossAuction executes the auction of the book's collected orders. It must run on the book's goroutine.
+func uncrossAuction(book *OrderBook) {
+    result := computeAuction(book, book.LastTradePrice)
+    if result.Price == nil {
+        return
+    }
+    price := *result.Price
+
+    buyOrders := auctionOrders(book.BuyOrders, func(order *Order) bool { return order.Price.GreaterThanOrEqual(price) })
+    sellOrders := auctionOrders(book.SellOrders, func(order *Order) bool { return order.Price.LessThanOrEqual(price) })
+    sort.SliceStable(buyOrders, func(i, j int) bool { return buyOrders[i].Price.GreaterThan(*buyOrders[j].Price) })
+    sort.SliceStable(sellOrders, func(i, j int) bool { return sellOrders[i].Price.LessThan(*sellOrders[j].Price) })
+
+    remaining := result.Volume
+    for i, j := 0, 0; remaining.IsPositive() && i < len(buyOrders) && j < len(sellOrders); {
+        buyOrder, sellOrder := buyOrders[i], sellOrders[j]
+        if !buyOrder.Quantity.IsPositive() {
+            i++
+            continue
+        }
+        if !sellOrder.Quantity.IsPositive() {
+            j++
+            continue
+        }
+
+        // orders of the same user never trade with each other
+        if preventSelfTrade(buyOrder, sellOrder) {
+            continue
+        }
+
+        tradeQuantity := decimal.Min(remaining, decimal.Min(buyOrder.Quantity, sellOrder.Quantity))
+        if err := executeAuctionFill(buyOrder, sellOrder, tradeQuantity, buyOrder.Price, &price); err != nil {
+            fmt.Println("Error settling auction trade: ", err)
+            break
+        }
+        remaining = remaining.Sub(tradeQuantity)
+        refillIcebergNow(book, buyOrder)
+        refillIcebergNow(book, sellOrder)
+    }
+
+    removeFilledOrders(&book.BuyOrders)
+    removeFilledOrders(&book.SellOrders)
+    fmt.Printf("Order book %s uncrossed %s at %s\n", book.StockID, result.Volume.Sub(remaining), price)
+}
+
+// auctionOrders returns the orders of one side that take part in the auction, oldest first
+func auctionOrders(bookOrders PriorityQueue, takesPart func(order *Order) bool) []*Order {
+    orders := make([]*Order, 0)
+    for _, order := range bookOrders.Order {
+        if takesPart(order) {
+            orders = append(orders, order)
+        }
+    }
+
+    sort.SliceStable(orders, func(i, j int) bool {
+        return orders[i].TimeStamp < orders[j].TimeStamp
+    })
+    return orders
+}
+
+func HandleGetAuctionIndicative(c *gin.Context) {
+    userName, exists := c.Get("user_name")
+    if !exists || userName == nil {
+        handleError(c, http.StatusUnauthorized, "User not authenticated", nil)
+        return
+    }
+
+    stockID := c.Query("stock_id")
+    if stockID == "" {
+        handleError(c, http.StatusBadRequest, "stock_id is required", nil)
+        return
+    }
+
+    var indicative AuctionIndicative
+    var ok bool
+    if book, found := findOrderBook(stockID); found {
+        indicative, ok = book.indicativeAuction()
+    } else {
+        // a stock without a book has no orders, so its auction would execute nothing
+        indicative = AuctionIndicative{StockID: stockID, Session: sessionPhaseAt(clock.Now())}
+        ok = isCallPhase(indicative.Session)
+    }
+    if !ok {
+        handleError(c, http.StatusBadRequest, "No auction is running for this stock", nil)
+        return
+    }
+
+    response := AuctionIndicativeResponse{
+        Success: true,
+        Data:    indicative,
+    }
+    c.IndentedJSON(http.StatusOK, response)
+}
+
+// indicativeAuction returns what the auction would execute right now, ok is false outside a call phase
+func (book *OrderBook) indicativeAuction() (indicative AuctionIndicative, ok bool) {
+    book.execute(func(book *OrderBook) {
+        if !isCallPhase(book.Session) {
+            return
+        }
+
+        indicative, ok = computeAuction(book, book.LastTradePrice), true
+    })
+    return indicative, ok
+}
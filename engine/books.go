@@ -0,0 +1,248 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "sync"
+)
+
+/*
+    Every OrderBook is owned by its own goroutine (run), started when the book is created. Nothing else touches the
+    book: handlers and the expiry loop send it commands (place, cancel, modify, expire, snapshot) over its command
+    channel and wait for the result. Commands for one stock run one at a time in arrival order, while the books of
+    different stocks run in parallel, so no lock is shared between stocks.
+
+    orderIndex maps a StockTxID to its stock ID so a cancel or modify goes straight to the right book.
+*/
+type bookCommand func(book *OrderBook)
+
+const bookCommandBuffer = 64
+
+// run executes the book's commands until the channel is closed
+func (book *OrderBook) run() {
+    for command := range book.commands {
+        book.runCommand(command)
+    }
+}
+
+// runCommand keeps the book's goroutine alive if a command panics, and streams the changes a command made to the book
+func (book *OrderBook) runCommand(command bookCommand) {
+    defer func() {
+        if r := recover(); r != nil {
+            fmt.Printf("Order book %s command failed: %v\n", book.StockID, r)
+        }
+    }()
+    command(book)
+    refillIcebergs(book)
+    book.publishBookChanges()
+}
+
+// execute runs command on the book's goroutine and waits until it is done
+func (book *OrderBook) execute(command bookCommand) {
+    done := make(chan struct{})
+    book.commands <- func(book *OrderBook) {
+        defer close(done)
+        command(book)
+    }
+    <-done
+}
+
+// placeOrder places a new order: stop orders wait in the trigger book, MARKET and LIMIT orders are reserved and matched
+func (book *OrderBook) placeOrder(order Order) (orderErr *OrderError) {
+    book.execute(func(book *OrderBook) {
+        indexOrder(order.StockTxID, order.StockID)
+
+        if order.OrderType == "STOP" || order.OrderType == "STOP_LIMIT" {
+            // stop orders wait in the trigger book, nothing is reserved until they trigger
+            if order.OrderType == "STOP_LIMIT" {
+                orderErr = checkPriceBands(book, order.Price)
+            }
+            if orderErr == nil {
+                if err := addTriggerOrder(book, order); err != nil {
+                    orderErr = &OrderError{http.StatusInternalServerError, "Failed to place stop order: ", err}
+                }
+            }
+        } else {
+            orderErr = placeOrderInBook(book, order)
+        }
+
+        if orderErr == nil {
+            // trades may have moved the last price past the stop price of waiting stop orders
+            releaseTriggeredOrders(book)
+        }
+
+        // orders that filled, were cancelled or never made it into the book cannot be cancelled later
+        if !book.holdsOrder(order.StockTxID) {
+            unindexOrder(order.StockTxID)
+        }
+    })
+    return orderErr
+}
+
+// cancelOrder removes a user's resting or waiting order and refunds what it still holds
+func (book *OrderBook) cancelOrder(StockTxID string, userName string) (found bool) {
+    book.execute(func(book *OrderBook) {
+        foundBuy := TraverseOrderBook(StockTxID, userName, book, "buy")
+        foundSell := TraverseOrderBook(StockTxID, userName, book, "sell")
+        foundTrigger := cancelTriggerOrder(book, StockTxID, userName)
+
+        found = foundBuy.Success || foundSell.Success || foundTrigger
+        if found {
+            unindexOrder(StockTxID)
+        }
+    })
+    return found
+}
+
+// modifyOrder amends a user's resting LIMIT order, found is false when the order is not resting in this book
+func (book *OrderBook) modifyOrder(request ModifyStockOrderRequest, userName string) (order Order, orderErr *OrderError, found bool) {
+    book.execute(func(book *OrderBook) {
+        for _, bookOrders := range []*PriorityQueue{&book.BuyOrders, &book.SellOrders} {
+            index := findRestingOrder(bookOrders, request.StockTxID, userName)
+            if index == -1 {
+                continue
+            }
+
+            found = true
+            order, orderErr = modifyRestingOrder(book, bookOrders, index, request)
+            return
+        }
+    })
+    return order, orderErr, found
+}
+
+// expireOrders removes the book's expired orders and drops index entries of orders that have left the book
+func (book *OrderBook) expireOrders() {
+    book.execute(func(book *OrderBook) {
+        // the closing auction runs before the DAY orders it could still fill expire
+        advanceSession(book, clock.Now())
+
+        // Iterate over buy orders
+        for i := 0; i < book.BuyOrders.Len(); {
+            order := book.BuyOrders.Order[i]
+            if isOrderExpired(order) {
+                // Execute the function to remove the expired order and perform post-processing
+                executeRemoveOrder(*order, &book.BuyOrders, i, "EXPIRED")
+            } else {
+                i++
+            }
+        }
+
+        // Iterate over sell orders
+        for i := 0; i < book.SellOrders.Len(); {
+            order := book.SellOrders.Order[i]
+            if isOrderExpired(order) {
+                // Execute the function to remove the expired order and perform post-processing
+                executeRemoveOrder(*order, &book.SellOrders, i, "EXPIRED")
+            } else {
+                i++
+            }
+        }
+
+        // stop orders that are still waiting for their stop price expire the same way
+        expireTriggerOrders(book)
+
+        pruneOrderIndex(book)
+    })
+}
+
+// OrderBookSnapshot is a copy of a book's orders that is safe to read outside the book's goroutine
+type OrderBookSnapshot struct {
+    BuyOrders     []Order
+    SellOrders    []Order
+    TriggerOrders []Order
+}
+
+func (book *OrderBook) snapshot() (snapshot OrderBookSnapshot) {
+    book.execute(func(book *OrderBook) {
+        snapshot.BuyOrders = copyOrders(book.BuyOrders.Order)
+        snapshot.SellOrders = copyOrders(book.SellOrders.Order)
+        snapshot.TriggerOrders = copyOrders(book.TriggerOrders)
+    })
+    return snapshot
+}
+
+func copyOrders(orders []*Order) []Order {
+    copied := make([]Order, 0, len(orders))
+    for _, order := range orders {
+        copied = append(copied, *order)
+    }
+    return copied
+}
+
+// holdsOrder reports whether the order is resting or waiting in the book
+func (book *OrderBook) holdsOrder(StockTxID string) bool {
+    for _, orders := range [][]*Order{book.BuyOrders.Order, book.SellOrders.Order, book.TriggerOrders} {
+        for _, order := range orders {
+            if order.StockTxID == StockTxID {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Define the structure of the order index
+type OrderIndex struct {
+    StockIDs map[string]string // Map of StockTxID to stock ID
+    mu       sync.RWMutex
+}
+
+var orderIndex = OrderIndex{
+    StockIDs: make(map[string]string),
+}
+
+func indexOrder(StockTxID string, stockID string) {
+    orderIndex.mu.Lock()
+    defer orderIndex.mu.Unlock()
+    orderIndex.StockIDs[StockTxID] = stockID
+}
+
+func unindexOrder(StockTxID string) {
+    orderIndex.mu.Lock()
+    defer orderIndex.mu.Unlock()
+    delete(orderIndex.StockIDs, StockTxID)
+}
+
+// pruneOrderIndex drops the entries of a book's orders that were filled by later orders.
+// Must run on the book's goroutine.
+func pruneOrderIndex(book *OrderBook) {
+    orderIndex.mu.Lock()
+    defer orderIndex.mu.Unlock()
+    for StockTxID, stockID := range orderIndex.StockIDs {
+        if stockID == book.StockID && !book.holdsOrder(StockTxID) {
+            delete(orderIndex.StockIDs, StockTxID)
+        }
+    }
+}
+
+// lookupOrderBook returns the book an order was placed in
+func lookupOrderBook(StockTxID string) (*OrderBook, bool) {
+    orderIndex.mu.RLock()
+    stockID, ok := orderIndex.StockIDs[StockTxID]
+    orderIndex.mu.RUnlock()
+    if !ok {
+        return nil, false
+    }
+
+    return findOrderBook(stockID)
+}
+
+// findOrderBook returns the book of a stock without creating one
+func findOrderBook(stockID string) (*OrderBook, bool) {
+    orderBookMap.mu.Lock()
+    defer orderBookMap.mu.Unlock()
+    book, ok := orderBookMap.OrderBooks[stockID]
+    return book, ok
+}
+
+// allOrderBooks returns the current books, so callers can work on them without holding the map lock
+func allOrderBooks() []*OrderBook {
+    orderBookMap.mu.Lock()
+    defer orderBookMap.mu.Unlock()
+    books := make([]*OrderBook, 0, len(orderBookMap.OrderBooks))
+    for _, book := range orderBookMap.OrderBooks {
+        books = append(books, book)
+    }
+    return books
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "sync"
+    "testing"
+)
+
+// runningBook starts the goroutine of a book for the duration of a test
+func runningBook(t *testing.T, book *OrderBook) *OrderBook {
+    t.Helper()
+    book.commands = make(chan bookCommand, bookCommandBuffer)
+    go book.run()
+    t.Cleanup(func() { close(book.commands) })
+    return book
+}
+
+func TestBookCommandsRunOneAtATime(t *testing.T) {
+    book := runningBook(t, &OrderBook{StockID: "stock", BuyOrders: bookSide(true), SellOrders: bookSide(false)})
+
+    // the counter is not locked, only the book's goroutine touches it
+    counter := 0
+    var wg sync.WaitGroup
+    for i := 0; i < 100; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            book.execute(func(book *OrderBook) { counter++ })
+        }()
+    }
+    wg.Wait()
+
+    if counter != 100 {
+        t.Errorf("ran %d of 100 commands", counter)
+    }
+}
+
+func TestBookSurvivesAPanickingCommand(t *testing.T) {
+    book := runningBook(t, &OrderBook{StockID: "stock", BuyOrders: bookSide(true), SellOrders: bookSide(false)})
+
+    book.execute(func(book *OrderBook) { panic("command failed") })
+
+    ran := false
+    book.execute(func(book *OrderBook) { ran = true })
+    if !ran {
+        t.Errorf("the book stopped running commands after a panic")
+    }
+}
+
+func TestSnapshotCopiesTheOrders(t *testing.T) {
+    book := runningBook(t, &OrderBook{StockID: "stock", BuyOrders: bookSide(true, limitOrder(t, "a", true, "10", "5", "1")), SellOrders: bookSide(false)})
+
+    snapshot := book.snapshot()
+    snapshot.BuyOrders[0].Quantity = dec(t, "1")
+    if len(snapshot.BuyOrders) != 1 || !book.BuyOrders.Order[0].Quantity.Equal(dec(t, "5")) {
+        t.Errorf("changing the snapshot changed the book")
+    }
+}
+
+func TestOrderIndexFindsTheBook(t *testing.T) {
+    book := &OrderBook{StockID: "indexed", BuyOrders: bookSide(true, limitOrder(t, "resting", true, "10", "5", "1")), SellOrders: bookSide(false)}
+    registerBook(t, book)
+
+    indexOrder("resting", "indexed")
+    indexOrder("filled", "indexed")
+    t.Cleanup(func() {
+        unindexOrder("resting")
+        unindexOrder("filled")
+    })
+
+    if found, ok := lookupOrderBook("resting"); !ok || found != book {
+        t.Errorf("the resting order's book was not found")
+    }
+
+    pruneOrderIndex(book)
+    if _, ok := lookupOrderBook("filled"); ok {
+        t.Errorf("a filled order is still indexed")
+    }
+    if _, ok := lookupOrderBook("resting"); !ok {
+        t.Errorf("pruning dropped a resting order")
+    }
+}
+
+func TestOrdersAreOnlyCancelledByTheirOwner(t *testing.T) {
+    book := runningBook(t, &OrderBook{StockID: "owned", BuyOrders: bookSide(true, limitOrder(t, "resting", true, "10", "5", "1")), SellOrders: bookSide(false)})
+    registerBook(t, book)
+    indexOrder("resting", "owned")
+    t.Cleanup(func() { unindexOrder("resting") })
+
+    if book.cancelOrder("resting", "user-other") {
+        t.Errorf("another user cancelled the order")
+    }
+    if snapshot := book.snapshot(); len(snapshot.BuyOrders) != 1 {
+        t.Errorf("the order left the book")
+    }
+    if _, ok := lookupOrderBook("resting"); !ok {
+        t.Errorf("the order was dropped from the order index")
+    }
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+/*
+    Bulk orders.
+
+    /placeStockOrders places up to 100 orders in request order and reports a result per order. Without
+    all_or_nothing every order stands on its own. With all_or_nothing nothing is placed unless every order passes
+    validation, and when a placement fails the orders placed before it are cancelled again. Fills those orders
+    already got cannot be undone, only what is still resting or waiting is cancelled. An order whose client_order_id
+    was used before reports the original order and is never cancelled by a rollback.
+
+    /cancelAllOrders cancels every resting LIMIT order and waiting stop order of the caller, optionally only for one
+    stock and/or one side. Resting orders go through executeRemoveOrder, so what they still hold is refunded.
+*/
+
+// Define the structure of the request body for placing several stock orders
+type PlaceStockOrdersRequest struct {
+    Orders       []PlaceStockOrderRequest `json:"orders" binding:"required,min=1,max=100,dive"`
+    AllOrNothing bool                     `json:"all_or_nothing"`
+}
+
+// BulkOrderResult is the outcome of one order of a bulk placement
+type BulkOrderResult struct {
+    Index         int    `json:"index"`
+    Success       bool   `json:"success"`
+    StockTxID     string `json:"stock_tx_id,omitempty"`
+    ClientOrderID string `json:"client_order_id,omitempty"`
+    Duplicate     bool   `json:"duplicate,omitempty"` // the client order id was used before, StockTxID is the original order
+    Error         string `json:"error,omitempty"`
+}
+
+// Define the structure of the request body for cancelling all of a user's orders
+type CancelAllOrdersRequest struct {
+    StockID string `json:"stock_id"` // every stock when empty
+    IsBuy   *bool  `json:"is_buy"`   // both sides when nil
+}
+
+// Define the structure of the response body for cancelling all of a user's orders
+type CancelAllOrdersResponse struct {
+    Success bool `json:"success"`
+    Data    struct {
+        Cancelled []string `json:"cancelled"`
+    } `json:"data"`
+}
+
+func HandlePlaceStockOrders(c *gin.Context) {
+    user_name, exists := c.Get("user_name")
+    if !exists || user_name == nil {
+        handleError(c, http.StatusUnauthorized, "User not authenticated", nil)
+        return
+    }
+
+    userName, ok := user_name.(string)
+    if !ok {
+        handleError(c, http.StatusBadRequest, "Invalid user name type", nil)
+        return
+    }
+
+    var request PlaceStockOrdersRequest
+    if err := c.ShouldBindJSON(&request); err != nil {
+        handleError(c, http.StatusBadRequest, err.Error(), err)
+        return
+    }
+
+    results, success := placeStockOrders(request, userName)
+
+    response := PlaceStockOrderResponse{
+        Success: success,
+        Data:    results,
+    }
+    c.IndentedJSON(http.StatusOK, response)
+}
+
+// placeStockOrders places the orders of a bulk request, success is true when every order was placed
+func placeStockOrders(request PlaceStockOrdersRequest, userName string) ([]BulkOrderResult, bool) {
+    results := make([]BulkOrderResult, len(request.Orders))
+    orders := make([]Order, len(request.Orders))
+    books := make([]*OrderBook, len(request.Orders))
+    valid := true
+
+    for i := range request.Orders {
+        results[i].Index = i
+        results[i].ClientOrderID = request.Orders[i].ClientOrderID
+        order, book, orderErr := prepareStockOrder(&request.Orders[i], userName)
+        if orderErr != nil {
+            results[i].Error = orderErr.Message
+            valid = false
+            continue
+        }
+        orders[i], books[i] = order, book
+    }
+
+    if request.AllOrNothing && !valid {
+        for i := range results {
+            if results[i].Error == "" {
+                results[i].Error = "Not placed, another order of the batch is invalid"
+            }
+        }
+        return results, false
+    }
+
+    success := valid
+    for i := range orders {
+        if books[i] == nil {
+            continue
+        }
+
+        placed, orderErr := placeClientOrder(books[i], orders[i])
+        if orderErr != nil {
+            results[i].Error = orderErr.Message
+            success = false
+            if request.AllOrNothing {
+                rollbackBulkOrders(results[:i], results[i+1:], userName)
+                return results, false
+            }
+            continue
+        }
+        results[i].Success = true
+        results[i].StockTxID = placed.StockTxID
+        results[i].Duplicate = placed.Duplicate
+    }
+
+    return results, success
+}
+
+// rollbackBulkOrders cancels what is left of the placed orders of a failed all or nothing batch
+func rollbackBulkOrders(placed []BulkOrderResult, skipped []BulkOrderResult, userName string) {
+    for i := range placed {
+        // a retried order was placed by an earlier request, it is not part of this batch
+        if placed[i].Duplicate {
+            continue
+        }
+        if book, ok := lookupOrderBook(placed[i].StockTxID); ok {
+            book.cancelOrder(placed[i].StockTxID, userName)
+        }
+        placed[i].Success = false
+        placed[i].Error = "Cancelled, another order of the batch failed"
+    }
+    for i := range skipped {
+        skipped[i].Error = "Not placed, another order of the batch failed"
+    }
+}
+
+func HandleCancelAllOrders(c *gin.Context) {
+    userName, exists := c.Get("user_name")
+    if !exists || userName == nil {
+        handleError(c, http.StatusUnauthorized, "User not authenticated", nil)
+        return
+    }
+
+    // the filters are optional, so an empty body cancels everything
+    var request CancelAllOrdersRequest
+    if c.Request.ContentLength != 0 {
+        if err := c.ShouldBindJSON(&request); err != nil {
+            handleError(c, http.StatusBadRequest, "Invalid request body", err)
+            return
+        }
+    }
+
+    books := allOrderBooks()
+    if request.StockID != "" {
+        books = nil
+        if book, ok := findOrderBook(request.StockID); ok {
+            books = append(books, book)
+        }
+    }
+
+    response := CancelAllOrdersResponse{Success: true}
+    response.Data.Cancelled = make([]string, 0)
+    for _, book := range books {
+        response.Data.Cancelled = append(response.Data.Cancelled, book.cancelUserOrders(userName.(string), request.IsBuy)...)
+    }
+
+    fmt.Printf("Cancelled %d orders of %s\n", len(response.Data.Cancelled), userName)
+    c.IndentedJSON(http.StatusOK, response)
+}
+
+// cancelUserOrders cancels the user's resting and waiting orders of the book, on one side when isBuy is set
+func (book *OrderBook) cancelUserOrders(userName string, isBuy *bool) (cancelled []string) {
+    book.execute(func(book *OrderBook) {
+        for _, bookOrders := range []*PriorityQueue{&book.BuyOrders, &book.SellOrders} {
+            // removing an order reorders the heap, so the orders are collected before any is removed
+            StockTxIDs := make([]string, 0)
+            for _, order := range bookOrders.Order {
+                if order.UserName == userName && order.OrderType == "LIMIT" && (isBuy == nil || *isBuy == order.IsBuy) {
+                    StockTxIDs = append(StockTxIDs, order.StockTxID)
+                }
+            }
+
+            for _, StockTxID := range StockTxIDs {
+                if index := findRestingOrder(bookOrders, StockTxID, userName); index != -1 {
+                    executeRemoveOrder(*bookOrders.Order[index], bookOrders, index, "CANCELLED")
+                    cancelled = append(cancelled, StockTxID)
+                }
+            }
+        }
+
+        StockTxIDs := make([]string, 0)
+        for _, order := range book.TriggerOrders {
+            if order.UserName == userName && (isBuy == nil || *isBuy == order.IsBuy) {
+                StockTxIDs = append(StockTxIDs, order.StockTxID)
+            }
+        }
+        for _, StockTxID := range StockTxIDs {
+            if cancelTriggerOrder(book, StockTxID, userName) {
+                cancelled = append(cancelled, StockTxID)
+            }
+        }
+
+        for _, StockTxID := range cancelled {
+            unindexOrder(StockTxID)
+        }
+    })
+    return cancelled
+}
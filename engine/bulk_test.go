@@ -0,0 +1,53 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestAllOrNothingBatchWithAnInvalidOrderPlacesNothing(t *testing.T) {
+    book := runningBook(t, &OrderBook{StockID: "bulk", Session: "CONTINUOUS", TickSize: dec(t, "0.01"), LotSize: dec(t, "1"), BuyOrders: bookSide(true), SellOrders: bookSide(false)})
+    registerBook(t, book)
+
+    isBuy := true
+    price := dec(t, "10")
+    request := PlaceStockOrdersRequest{
+        AllOrNothing: true,
+        Orders: []PlaceStockOrderRequest{
+            {StockID: "bulk", IsBuy: &isBuy, OrderType: "LIMIT", Quantity: dec(t, "1"), Price: &price, ClientOrderID: "first"},
+            {StockID: "bulk", IsBuy: &isBuy, OrderType: "LIMIT", Quantity: dec(t, "1.5"), Price: &price},
+            {StockID: "bulk", IsBuy: &isBuy, OrderType: "MARKET", Quantity: dec(t, "1"), Price: &price},
+        },
+    }
+
+    results, success := placeStockOrders(request, "user")
+    if success {
+        t.Fatalf("a batch with invalid orders succeeded")
+    }
+    for i, result := range results {
+        if result.Index != i || result.Success || result.StockTxID != "" || result.Error == "" {
+            t.Errorf("order %d: %+v, want an error and nothing placed", i, result)
+        }
+    }
+    if results[0].ClientOrderID != "first" || results[0].Error != "Not placed, another order of the batch is invalid" {
+        t.Errorf("the valid order reports %+v", results[0])
+    }
+    if snapshot := book.snapshot(); len(snapshot.BuyOrders) != 0 {
+        t.Errorf("%d orders reached the book", len(snapshot.BuyOrders))
+    }
+}
+
+func TestRollbackBulkOrdersKeepsRetriedOrders(t *testing.T) {
+    placed := []BulkOrderResult{
+        {Index: 0, Success: true, StockTxID: "retried", Duplicate: true},
+        {Index: 1, Success: true, StockTxID: "unknown"},
+    }
+    skipped := []BulkOrderResult{{Index: 3}}
+
+    rollbackBulkOrders(placed, skipped, "user")
+    if !placed[0].Success || placed[0].Error != "" {
+        t.Errorf("the order of an earlier request was rolled back: %+v", placed[0])
+    }
+    if placed[1].Success || placed[1].Error == "" || skipped[0].Error == "" {
+        t.Errorf("the batch's orders were not reported as rolled back: %+v %+v", placed[1], skipped[0])
+    }
+}
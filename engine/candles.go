@@ -0,0 +1,90 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Candles: every trade is folded into the OHLCV bar of its stock for each interval in stock_candles (stock_db).
+
+    The fold is a CANDLE settlement effect, so it is applied exactly once per fill together with the market price.
+    Bars are keyed by the UTC start of their bucket. open and close follow the time of the trade rather than the
+    order the effects are applied in, so a fill applied late by the reconciler still lands correctly.
+*/
+var candleIntervals = []struct {
+    Name     string
+    Duration time.Duration
+}{
+    {"1m", time.Minute},
+    {"5m", 5 * time.Minute},
+    {"1h", time.Hour},
+    {"1d", 24 * time.Hour},
+}
+
+// foldTradeIntoCandles adds a trade to the bar of every interval it falls in
+func foldTradeIntoCandles(tx *sql.Tx, stockID string, price decimal.Decimal, quantity decimal.Decimal, tradeTime time.Time) error {
+    tradeTime = tradeTime.UTC()
+    for _, interval := range candleIntervals {
+        bucketStart := tradeTime.Truncate(interval.Duration)
+        _, err := tx.Stmt(stmtUpsertStockCandle).Exec(stockID, interval.Name, bucketStart, price, quantity, tradeTime)
+        if err != nil {
+            return fmt.Errorf("Failed to update %s candle: %w", interval.Name, err)
+        }
+    }
+    return nil
+}
+
+/*
+    backfillStockCandles rebuilds stock_candles from the COMPLETED sell rows of stock_transactions.
+
+    Every fill completes exactly one sell row: a partial fill writes a COMPLETED child row, and the last fill completes
+    the parent itself. The quantity of a completed parent is what is left after its completed children, and its price is
+    taken from the wallet transaction it was paid with. A completed parent only knows when it was placed, so its last
+    fill is counted at that time.
+*/
+func backfillStockCandles() error {
+    rows, err := stmtGetCompletedTrades.Query()
+    if err != nil {
+        return fmt.Errorf("Failed to query completed trades: %w", err)
+    }
+    defer rows.Close()
+
+    tx, err := stock_db.Begin()
+    if err != nil {
+        return fmt.Errorf("Failed to begin candle backfill: %w", err)
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("DELETE FROM stock_candles"); err != nil {
+        return fmt.Errorf("Failed to clear stock candles: %w", err)
+    }
+
+    trades := 0
+    for rows.Next() {
+        var stockID string
+        var price, quantity decimal.Decimal
+        var tradeTime time.Time
+        if err := rows.Scan(&stockID, &price, &quantity, &tradeTime); err != nil {
+            return fmt.Errorf("Failed to scan completed trade: %w", err)
+        }
+
+        if err := foldTradeIntoCandles(tx, stockID, price.Round(2), quantity, tradeTime); err != nil {
+            return err
+        }
+        trades++
+    }
+    if err := rows.Err(); err != nil {
+        return fmt.Errorf("Failed to read completed trades: %w", err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("Failed to commit candle backfill: %w", err)
+    }
+
+    fmt.Printf("Backfilled stock candles from %d trades\n", trades)
+    return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "sync"
+)
+
+/*
+    Client order IDs: an order may carry a client_order_id that is unique per user. Placing an order with an id the
+    user already used returns the original order instead of placing a new one, so a client that timed out on
+    /placeStockOrder can retry safely. Cancel and modify accept the client_order_id in place of the stock_tx_id.
+
+    The id is written to client_orders, whose UNIQUE (user_name, client_order_id) constraint keeps it taken after the
+    order has left the book: a retry of an order that was cancelled, or an IOC order that left without a fill, finds it
+    and gets the original back with the status its row was closed with. Only an order that is rejected on placement gives its id up again, since
+    it never existed. While an order is being placed its id is also claimed in memory, so a retry racing the original
+    is told to wait rather than handed an order that is not recorded yet.
+*/
+
+// PlacedOrder is the order a placement created, or the original order of a retry (Duplicate)
+type PlacedOrder struct {
+    StockTxID     string `json:"stock_tx_id"`
+    ClientOrderID string `json:"client_order_id,omitempty"`
+    Status        string `json:"status,omitempty"` // status of the original order of a retry
+    Duplicate     bool   `json:"duplicate"`
+}
+
+// Define the structure of the client order ids being placed
+type ClientOrderClaims struct {
+    StockTxIDs map[string]string // Map of user name and client order id to StockTxID
+    mu         sync.Mutex
+}
+
+var clientOrderClaims = ClientOrderClaims{
+    StockTxIDs: make(map[string]string),
+}
+
+func clientOrderKey(userName string, clientOrderID string) string {
+    return userName + "/" + clientOrderID
+}
+
+// placeClientOrder places an order once per client order id, a retry gets the original order back
+func placeClientOrder(book *OrderBook, order Order) (placed PlacedOrder, orderErr *OrderError) {
+    placed = PlacedOrder{StockTxID: order.StockTxID, ClientOrderID: order.ClientOrderID}
+
+    if order.ClientOrderID != "" {
+        original, claimErr := claimClientOrderID(order)
+        if claimErr != nil {
+            return placed, claimErr
+        }
+        if original != nil {
+            return *original, nil
+        }
+        defer func() { releaseClientOrderID(order, orderErr == nil) }()
+    }
+
+    // the book's goroutine runs the whole placement, so the book cannot change between the sweep projection and the matching
+    orderErr = book.placeOrder(order)
+    return placed, orderErr
+}
+
+// claimClientOrderID records the order's client order id, or returns the original order that already used it
+func claimClientOrderID(order Order) (*PlacedOrder, *OrderError) {
+    key := clientOrderKey(order.UserName, order.ClientOrderID)
+
+    clientOrderClaims.mu.Lock()
+    defer clientOrderClaims.mu.Unlock()
+
+    if _, claimed := clientOrderClaims.StockTxIDs[key]; claimed {
+        return nil, &OrderError{http.StatusConflict, "An order with this client_order_id is still being placed", nil}
+    }
+
+    result, err := stmtClaimClientOrder.Exec(order.UserName, order.ClientOrderID, order.StockTxID)
+    if err != nil {
+        return nil, &OrderError{http.StatusInternalServerError, "Failed to record client order id", err}
+    }
+    if claimed, err := result.RowsAffected(); err == nil && claimed == 1 {
+        clientOrderClaims.StockTxIDs[key] = order.StockTxID
+        return nil, nil
+    }
+
+    // the insert only writes nothing when the id was used before
+    original := PlacedOrder{ClientOrderID: order.ClientOrderID, Duplicate: true}
+    if err := stmtGetClientOrder.QueryRow(order.UserName, order.ClientOrderID).Scan(&original.StockTxID, &original.Status); err != nil {
+        return nil, &OrderError{http.StatusInternalServerError, "Failed to look up client order id", err}
+    }
+    return &original, nil
+}
+
+// releaseClientOrderID drops the in-memory claim once the placement is done. The id of an order that was rejected is
+// deleted again, so the client can fix the order and send it with the same id.
+func releaseClientOrderID(order Order, placed bool) {
+    clientOrderClaims.mu.Lock()
+    defer clientOrderClaims.mu.Unlock()
+    delete(clientOrderClaims.StockTxIDs, clientOrderKey(order.UserName, order.ClientOrderID))
+
+    if !placed {
+        if _, err := stmtReleaseClientOrder.Exec(order.UserName, order.ClientOrderID, order.StockTxID); err != nil {
+            fmt.Println("Error releasing client order id: ", err)
+        }
+    }
+}
+
+// resolveStockTxID returns stockTxID, or the StockTxID of the user's order with clientOrderID when it is empty
+func resolveStockTxID(userName string, stockTxID string, clientOrderID string) (string, error) {
+    if stockTxID != "" {
+        return stockTxID, nil
+    }
+    if clientOrderID == "" {
+        return "", fmt.Errorf("stock_tx_id or client_order_id is required")
+    }
+
+    var status string
+    if err := stmtGetClientOrder.QueryRow(userName, clientOrderID).Scan(&stockTxID, &status); err != nil {
+        return "", fmt.Errorf("Order [ClientOrderID: %s] not found", clientOrderID)
+    }
+    return stockTxID, nil
+}
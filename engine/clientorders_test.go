@@ -0,0 +1,45 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestClientOrderIDBeingPlacedIsNotPlacedAgain(t *testing.T) {
+    order := Order{StockTxID: "retry", UserName: "user", ClientOrderID: "order-1"}
+    key := clientOrderKey(order.UserName, order.ClientOrderID)
+
+    clientOrderClaims.mu.Lock()
+    clientOrderClaims.StockTxIDs[key] = "original"
+    clientOrderClaims.mu.Unlock()
+    t.Cleanup(func() {
+        clientOrderClaims.mu.Lock()
+        delete(clientOrderClaims.StockTxIDs, key)
+        clientOrderClaims.mu.Unlock()
+    })
+
+    // the claim is checked before the database, the retry must not reach the book
+    placed, orderErr := placeClientOrder(nil, order)
+    if orderErr == nil || orderErr.StatusCode != http.StatusConflict {
+        t.Fatalf("got %v, want a conflict while the original is being placed", orderErr)
+    }
+    if placed.Duplicate {
+        t.Errorf("a conflict was reported as a duplicate")
+    }
+}
+
+func TestClientOrderKeysAreScopedPerUser(t *testing.T) {
+    if clientOrderKey("alice", "1") == clientOrderKey("bob", "1") {
+        t.Errorf("two users share a client order key")
+    }
+}
+
+func TestResolveStockTxIDPrefersTheStockTxID(t *testing.T) {
+    stockTxID, err := resolveStockTxID("user", "tx-1", "order-1")
+    if err != nil || stockTxID != "tx-1" {
+        t.Errorf("got %q, %v, want tx-1", stockTxID, err)
+    }
+    if _, err := resolveStockTxID("user", "", ""); err == nil {
+        t.Errorf("an order without stock_tx_id and client_order_id was resolved")
+    }
+}
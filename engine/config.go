@@ -0,0 +1,104 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+func init() {
+    // prices, amounts and quantities are written as JSON numbers, the way the API has always returned them
+    decimal.MarshalJSONWithoutQuotes = true
+}
+
+// Minimum quantity a resting order must be allocated in a pro-rata split, smaller shares are rounded down to zero
+var proRataMinAllocation = getEnvDecimal("PRO_RATA_MIN_ALLOCATION", decimal.NewFromInt(1))
+
+// How far (in percent) from the top of book a Market order may sweep before it is stopped, 0 disables the band
+var marketPriceBandPercent = getEnvDecimal("MARKET_PRICE_BAND_PERCENT", decimal.NewFromInt(10))
+
+// Self-trade prevention mode of orders that do not choose one: CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT_AND_CANCEL
+var selfTradePreventionMode = getEnvString("STP_MODE", "CANCEL_NEWEST")
+
+// Session close (HH:MM in SESSION_TIMEZONE) at which DAY orders expire
+var sessionClose = getEnvString("SESSION_CLOSE", "16:00")
+var sessionTimeZone = getEnvString("SESSION_TIMEZONE", "America/New_York")
+
+// What happens to a post only order that would cross the book: REJECT it, or REPRICE it one tick behind the best price
+var postOnlyMode = getEnvString("POST_ONLY_MODE", "REJECT")
+
+// Opening and closing call auctions, when disabled the books trade continuously around the clock
+var sessionAuctions = getEnvString("SESSION_AUCTIONS", "false") == "true"
+var sessionPreOpen = getEnvString("SESSION_PRE_OPEN", "09:00")
+var sessionOpen = getEnvString("SESSION_OPEN", "09:30")
+var sessionClosingCall = getEnvString("SESSION_CLOSING_CALL", "15:50")
+
+// Rebuild the stock candles from the completed trades in tx_db when the engine starts
+var candleBackfill = getEnvString("CANDLE_BACKFILL", "false") == "true"
+
+// Price bands (percent) of stocks that do not set their own, 0 disables a band
+var staticPriceBandPercent = getEnvDecimal("STATIC_PRICE_BAND_PERCENT", decimal.NewFromInt(20))
+var dynamicPriceBandPercent = getEnvDecimal("DYNAMIC_PRICE_BAND_PERCENT", decimal.NewFromInt(10))
+
+// Circuit breaker: a trade moving the price more than HALT_MOVE_PERCENT within HALT_WINDOW halts the stock for HALT_DURATION
+var haltMovePercent = getEnvDecimal("HALT_MOVE_PERCENT", decimal.NewFromInt(15))
+var haltWindow = getEnvDuration("HALT_WINDOW", 5*time.Minute)
+var haltDuration = getEnvDuration("HALT_DURATION", 5*time.Minute)
+
+// What happens to new orders of a halted stock: QUEUE collects LIMIT orders for the reopening auction, REJECT rejects them
+var haltOrderPolicy = getEnvString("HALT_ORDER_POLICY", "QUEUE")
+
+// Trading fees (see fees.go) of stocks that do not set their own: maker and taker rates in percent and the minimum fee of an order
+var makerFeePercent = getEnvDecimal("FEE_MAKER_PERCENT", decimal.Zero)
+var takerFeePercent = getEnvDecimal("FEE_TAKER_PERCENT", decimal.Zero)
+var minimumFee = getEnvDecimal("FEE_MINIMUM", decimal.Zero)
+
+// Volume tiers as volume:discount percent pairs, e.g. "100000:10,1000000:25", empty disables them
+var feeVolumeTiers = parseFeeTiers(getEnvString("FEE_VOLUME_TIERS", ""))
+
+// Price levels of each side that the market data stream covers
+var marketDataDepth = int(getEnvDecimal("MARKET_DATA_DEPTH", decimal.NewFromInt(50)).IntPart())
+
+// Comma separated user names allowed to halt and resume stocks
+var adminUsers = getEnvString("ADMIN_USERS", "")
+
+// getEnvString reads a text engine setting from the environment, falling back to the default when unset
+func getEnvString(key string, fallback string) string {
+    value, ok := os.LookupEnv(key)
+    if !ok || value == "" {
+        return fallback
+    }
+    return value
+}
+
+// getEnvDecimal reads a numeric engine setting from the environment, falling back to the default when unset or invalid
+func getEnvDecimal(key string, fallback decimal.Decimal) decimal.Decimal {
+    value, ok := os.LookupEnv(key)
+    if !ok || value == "" {
+        return fallback
+    }
+
+    parsed, err := decimal.NewFromString(value)
+    if err != nil {
+        fmt.Printf("Invalid value %q for %s, using default %v\n", value, key, fallback)
+        return fallback
+    }
+    return parsed
+}
+
+// getEnvDuration reads a duration engine setting (e.g. 5m) from the environment, falling back to the default when unset or invalid
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    value, ok := os.LookupEnv(key)
+    if !ok || value == "" {
+        return fallback
+    }
+
+    parsed, err := time.ParseDuration(value)
+    if err != nil {
+        fmt.Printf("Invalid value %q for %s, using default %v\n", value, key, fallback)
+        return fallback
+    }
+    return parsed
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "container/heap"
+    "net/http"
+    "strconv"
+
+    "github.com/gin-gonic/gin"
+    "github.com/shopspring/decimal"
+)
+
+const (
+    defaultBookDepth = 10
+    maxBookDepth     = 100
+)
+
+// PriceLevel aggregates the resting orders of one side of the book at one price
+type PriceLevel struct {
+    Price      decimal.Decimal `json:"price"`
+    Quantity   decimal.Decimal `json:"quantity"`
+    OrderCount int             `json:"order_count"`
+}
+
+// OrderBookDepth is the level-2 view of a book, best prices first
+type OrderBookDepth struct {
+    StockID string       `json:"stock_id"`
+    Bids    []PriceLevel `json:"bids"`
+    Asks    []PriceLevel `json:"asks"`
+}
+
+// Define the structure of the response body for the order book depth
+type OrderBookDepthResponse struct {
+    Success bool           `json:"success"`
+    Data    OrderBookDepth `json:"data"`
+}
+
+func HandleGetOrderBook(c *gin.Context) {
+    userName, exists := c.Get("user_name")
+    if !exists || userName == nil {
+        handleError(c, http.StatusUnauthorized, "User not authenticated", nil)
+        return
+    }
+
+    stockID := c.Query("stock_id")
+    if stockID == "" {
+        handleError(c, http.StatusBadRequest, "stock_id is required", nil)
+        return
+    }
+
+    depth := defaultBookDepth
+    if value := c.Query("depth"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed <= 0 {
+            handleError(c, http.StatusBadRequest, "depth must be a positive integer", err)
+            return
+        }
+        depth = min(parsed, maxBookDepth)
+    }
+
+    // A stock without a book has no resting orders yet
+    bookDepth := OrderBookDepth{StockID: stockID, Bids: []PriceLevel{}, Asks: []PriceLevel{}}
+    if book, ok := findOrderBook(stockID); ok {
+        bookDepth = book.depth(depth)
+    }
+
+    response := OrderBookDepthResponse{
+        Success: true,
+        Data:    bookDepth,
+    }
+    c.IndentedJSON(http.StatusOK, response)
+}
+
+// depth aggregates both sides of the book into at most levels price levels each
+func (book *OrderBook) depth(levels int) (bookDepth OrderBookDepth) {
+    book.execute(func(book *OrderBook) {
+        bookDepth = OrderBookDepth{
+            StockID: book.StockID,
+            Bids:    aggregatePriceLevels(book.BuyOrders, levels),
+            Asks:    aggregatePriceLevels(book.SellOrders, levels),
+        }
+    })
+    return bookDepth
+}
+
+// aggregatePriceLevels walks the heap best order first without sorting or changing it, so the cost depends on the
+// orders in the levels returned and not on the size of the book
+func aggregatePriceLevels(bookOrders PriorityQueue, levels int) []PriceLevel {
+    priceLevels := make([]PriceLevel, 0, min(levels, bookOrders.Len()))
+    if levels <= 0 || bookOrders.Len() == 0 {
+        return priceLevels
+    }
+
+    // the next best order is always one of the children of the orders already taken
+    frontier := &heapFrontier{queue: bookOrders, indices: []int{0}}
+    for frontier.Len() > 0 {
+        index := heap.Pop(frontier).(int)
+        order := bookOrders.Order[index]
+
+        last := len(priceLevels) - 1
+        if last >= 0 && priceLevels[last].Price.Equal(*order.Price) {
+            priceLevels[last].Quantity = priceLevels[last].Quantity.Add(order.Quantity)
+            priceLevels[last].OrderCount++
+        } else if len(priceLevels) == levels {
+            break
+        } else {
+            priceLevels = append(priceLevels, PriceLevel{Price: *order.Price, Quantity: order.Quantity, OrderCount: 1})
+        }
+
+        for _, child := range []int{2*index + 1, 2*index + 2} {
+            if child < bookOrders.Len() {
+                heap.Push(frontier, child)
+            }
+        }
+    }
+    return priceLevels
+}
+
+// heapFrontier is a heap of positions in a book's queue, ordered like the orders at those positions
+type heapFrontier struct {
+    queue   PriorityQueue
+    indices []int
+}
+
+func (f heapFrontier) Len() int           { return len(f.indices) }
+func (f heapFrontier) Less(i, j int) bool { return f.queue.Less(f.indices[i], f.indices[j]) }
+func (f heapFrontier) Swap(i, j int)      { f.indices[i], f.indices[j] = f.indices[j], f.indices[i] }
+
+func (f *heapFrontier) Push(x interface{}) {
+    f.indices = append(f.indices, x.(int))
+}
+
+func (f *heapFrontier) Pop() interface{} {
+    last := f.indices[len(f.indices)-1]
+    f.indices = f.indices[:len(f.indices)-1]
+    return last
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/gin-gonic/gin"
+)
+
+func TestAggregatePriceLevels(t *testing.T) {
+    bids := bookSide(true,
+        limitOrder(t, "1", true, "9", "5", "1"),
+        limitOrder(t, "2", true, "10", "2", "2"),
+        limitOrder(t, "3", true, "8", "1", "3"),
+        limitOrder(t, "4", true, "10", "3", "4"),
+        limitOrder(t, "5", true, "9", "1", "5"),
+    )
+
+    tests := []struct {
+        levels int
+        want   []string
+    }{
+        {0, []string{}},
+        {1, []string{"10:5:2"}},
+        {2, []string{"10:5:2", "9:6:2"}},
+        {10, []string{"10:5:2", "9:6:2", "8:1:1"}},
+    }
+    for _, test := range tests {
+        got := aggregatePriceLevels(bids, test.levels)
+        if len(got) != len(test.want) {
+            t.Fatalf("levels %d: got %v, want %v", test.levels, got, test.want)
+        }
+        for i, level := range got {
+            if key := fmt.Sprintf("%v:%v:%d", level.Price, level.Quantity, level.OrderCount); key != test.want[i] {
+                t.Errorf("levels %d: level %d is %s, want %s", test.levels, i, key, test.want[i])
+            }
+        }
+    }
+
+    // the walk must leave the heap as it was
+    if bids.Len() != 5 || bids.Order[0].Price.String() != "10" {
+        t.Errorf("aggregating changed the book")
+    }
+}
+
+func TestAggregatePriceLevelsMatchesPopOrder(t *testing.T) {
+    var orders []*Order
+    for i := 0; i < 200; i++ {
+        price := fmt.Sprintf("%d", 100+(i*37)%23)
+        orders = append(orders, limitOrder(t, fmt.Sprint(i), false, price, "1", fmt.Sprintf("%03d", i)))
+    }
+    asks := bookSide(false, orders...)
+
+    levels := aggregatePriceLevels(asks, 5)
+    if len(levels) != 5 {
+        t.Fatalf("got %d levels, want 5", len(levels))
+    }
+    for i, level := range levels {
+        if want := fmt.Sprint(100 + i); level.Price.String() != want {
+            t.Errorf("level %d has price %v, want %s", i, level.Price, want)
+        }
+    }
+}
+
+func TestDiffPriceLevels(t *testing.T) {
+    previous := []PriceLevel{
+        {Price: dec(t, "10"), Quantity: dec(t, "5"), OrderCount: 2},
+        {Price: dec(t, "9"), Quantity: dec(t, "1"), OrderCount: 1},
+        {Price: dec(t, "8"), Quantity: dec(t, "4"), OrderCount: 1},
+    }
+    current := []PriceLevel{
+        {Price: dec(t, "10"), Quantity: dec(t, "5"), OrderCount: 2},
+        {Price: dec(t, "9"), Quantity: dec(t, "3"), OrderCount: 2},
+        {Price: dec(t, "7"), Quantity: dec(t, "1"), OrderCount: 1},
+    }
+
+    changed := map[string]string{}
+    for _, level := range diffPriceLevels(previous, current) {
+        changed[level.Price.String()] = level.Quantity.String()
+    }
+    want := map[string]string{"9": "3", "7": "1", "8": "0"}
+    if len(changed) != len(want) {
+        t.Fatalf("got %v, want %v", changed, want)
+    }
+    for price, quantity := range want {
+        if changed[price] != quantity {
+            t.Errorf("level %s: got %q, want %q", price, changed[price], quantity)
+        }
+    }
+}
+
+// getOrderBook calls HandleGetOrderBook as an authenticated user
+func getOrderBook(t *testing.T, query string) (int, OrderBookDepthResponse) {
+    t.Helper()
+    gin.SetMode(gin.TestMode)
+    recorder := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(recorder)
+    c.Request = httptest.NewRequest(http.MethodGet, "/getOrderBook?"+query, nil)
+    c.Set("user_name", "user")
+
+    HandleGetOrderBook(c)
+
+    var response OrderBookDepthResponse
+    json.Unmarshal(recorder.Body.Bytes(), &response)
+    return recorder.Code, response
+}
+
+func TestHandleGetOrderBook(t *testing.T) {
+    book := runningBook(t, &OrderBook{
+        StockID:    "depth",
+        BuyOrders:  bookSide(true, limitOrder(t, "1", true, "9", "5", "1"), limitOrder(t, "2", true, "8", "1", "2")),
+        SellOrders: bookSide(false, limitOrder(t, "3", false, "10", "2", "3")),
+    })
+    registerBook(t, book)
+
+    code, response := getOrderBook(t, "stock_id=depth&depth=1")
+    if code != http.StatusOK || len(response.Data.Bids) != 1 || len(response.Data.Asks) != 1 || !response.Data.Bids[0].Price.Equal(dec(t, "9")) {
+        t.Errorf("got %d %+v, want the best bid and ask", code, response.Data)
+    }
+
+    if code, response := getOrderBook(t, "stock_id=unknown"); code != http.StatusOK || response.Data.Bids == nil || len(response.Data.Bids) != 0 {
+        t.Errorf("a stock without a book got %d %+v, want empty levels", code, response.Data)
+    }
+
+    for _, query := range []string{"", "stock_id=depth&depth=0", "stock_id=depth&depth=x"} {
+        if code, _ := getOrderBook(t, query); code != http.StatusBadRequest {
+            t.Errorf("%q got %d, want 400", query, code)
+        }
+    }
+}
+
+func TestHandleStreamMarketDataNeedsNoUser(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    recorder := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(recorder)
+    c.Request = httptest.NewRequest(http.MethodGet, "/streamMarketData", nil)
+
+    HandleStreamMarketData(c)
+
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("got %d, want 400 for the missing stock_id rather than 401", recorder.Code)
+    }
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Trading fees: every fill charges the buyer and the seller a fee on its notional (price * quantity). The side of the
+    resting order pays the maker rate, the side of the newer order (the trade's aggressor) the taker rate. A stock can
+    set its own rates and minimum, otherwise FEE_MAKER_PERCENT, FEE_TAKER_PERCENT and FEE_MINIMUM apply. Volume tiers
+    (FEE_VOLUME_TIERS) discount the rates by the notional the user traded in the 30 days before the order's first
+    fill, the discount is looked up once and kept for the rest of the order.
+
+    An order accrues the fees of its fills unrounded and pays them rounded up to the cent, so splitting an order into
+    fills never costs more than one fill would. The minimum applies once per order: the first fill pays at least the
+    minimum, later fills only pay what their rate adds on top of it.
+
+    A buy order holds the most its fees can cost (maxFee of its reservation) together with the reservation, and pays
+    its fees out of that hold. What is left of the fee hold is released when the order completes, is cancelled or
+    expires. A sell order pays its fees out of the proceeds of each fill and never more than them, the part of the
+    minimum the proceeds cannot cover is waived.
+
+    The fee is charged in the fill's settlement: a FEE effect takes it out of the wallet and its hold and posts it
+    against the FEES system account, a FEE wallet transaction records it and the order's stock transaction adds it to
+    its fee.
+*/
+
+// FeeSchedule holds the rates in percent of the notional and the minimum fee of an order
+type FeeSchedule struct {
+    MakerPercent decimal.Decimal
+    TakerPercent decimal.Decimal
+    Minimum      decimal.Decimal
+}
+
+// FeeTier discounts the rates by DiscountPercent once a user traded MinVolume in the last 30 days
+type FeeTier struct {
+    MinVolume       decimal.Decimal
+    DiscountPercent decimal.Decimal
+}
+
+const feeVolumeWindow = 30 * 24 * time.Hour
+
+var hundred = decimal.NewFromInt(100)
+
+// loadFeeSchedule reads the stock's own fee schedule, anything it does not set comes from the engine's defaults
+func loadFeeSchedule(book *OrderBook) {
+    err := stmtGetFeeSchedule.QueryRow(book.StockID, makerFeePercent, takerFeePercent, minimumFee).
+        Scan(&book.Fees.MakerPercent, &book.Fees.TakerPercent, &book.Fees.Minimum)
+    if err != nil {
+        book.Fees = FeeSchedule{MakerPercent: makerFeePercent, TakerPercent: takerFeePercent, Minimum: minimumFee}
+    }
+}
+
+// feeScheduleOf returns the fee schedule of a stock, the book's schedule never changes once it is loaded
+func feeScheduleOf(stockID string) FeeSchedule {
+    if book, ok := findOrderBook(stockID); ok {
+        return book.Fees
+    }
+    return FeeSchedule{MakerPercent: makerFeePercent, TakerPercent: takerFeePercent, Minimum: minimumFee}
+}
+
+// rate is the maker or taker rate in percent, less a volume discount in percent
+func (schedule FeeSchedule) rate(isMaker bool, discount decimal.Decimal) decimal.Decimal {
+    percent := schedule.TakerPercent
+    if isMaker {
+        percent = schedule.MakerPercent
+    }
+    return percent.Mul(hundred.Sub(discount)).Div(hundred)
+}
+
+// fillFee accrues the fee of a fill of notional on the order and returns what the order owes for it
+func (schedule FeeSchedule) fillFee(order *Order, notional decimal.Decimal, isMaker bool, discount decimal.Decimal) decimal.Decimal {
+    order.FeeAccrued = order.FeeAccrued.Add(notional.Mul(schedule.rate(isMaker, discount)).Div(hundred))
+    due := decimal.Max(order.FeeAccrued.RoundCeil(2), schedule.Minimum)
+    return decimal.Max(due.Sub(order.FeeCharged), decimal.Zero)
+}
+
+// maxFee is the most the fills of an order of notional can cost in total, what a buy order holds for its fees
+func (schedule FeeSchedule) maxFee(notional decimal.Decimal) decimal.Decimal {
+    percent := decimal.Max(schedule.MakerPercent, schedule.TakerPercent)
+    return decimal.Max(notional.Mul(percent).Div(hundred).RoundCeil(2), schedule.Minimum)
+}
+
+// feeHold is the fee a buy order must hold so it can pay its fees for a remaining notional on top of what it paid
+func (schedule FeeSchedule) feeHold(order Order, notional decimal.Decimal) decimal.Decimal {
+    percent := decimal.Max(schedule.MakerPercent, schedule.TakerPercent)
+    due := decimal.Max(order.FeeAccrued.Add(notional.Mul(percent).Div(hundred)).RoundCeil(2), schedule.Minimum)
+    return decimal.Max(due.Sub(order.FeeCharged), decimal.Zero)
+}
+
+// volumeDiscountPercent returns the discount of the highest tier the volume reaches
+func volumeDiscountPercent(volume decimal.Decimal) decimal.Decimal {
+    discount := decimal.Zero
+    for _, tier := range feeVolumeTiers {
+        if volume.GreaterThanOrEqual(tier.MinVolume) {
+            discount = tier.DiscountPercent
+        }
+    }
+    return discount
+}
+
+// parseFeeTiers reads tiers written as volume:discount pairs, e.g. "100000:10,1000000:25", sorted by volume
+func parseFeeTiers(value string) []FeeTier {
+    tiers := make([]FeeTier, 0)
+    for _, pair := range strings.Split(value, ",") {
+        if strings.TrimSpace(pair) == "" {
+            continue
+        }
+
+        parts := strings.Split(pair, ":")
+        if len(parts) != 2 {
+            fmt.Printf("Invalid fee tier %q, expected volume:discount\n", pair)
+            continue
+        }
+        volume, errVolume := decimal.NewFromString(strings.TrimSpace(parts[0]))
+        discount, errDiscount := decimal.NewFromString(strings.TrimSpace(parts[1]))
+        if errVolume != nil || errDiscount != nil || volume.IsNegative() || discount.IsNegative() || discount.GreaterThan(hundred) {
+            fmt.Printf("Invalid fee tier %q, expected volume:discount\n", pair)
+            continue
+        }
+        tiers = append(tiers, FeeTier{MinVolume: volume, DiscountPercent: discount})
+    }
+
+    sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinVolume.LessThan(tiers[j].MinVolume) })
+    return tiers
+}
+
+// chargeFees charges the buyer and the seller of a trade their fee as part of its settlement
+func (s *Settlement) chargeFees(trade *Trade, buyOrder *Order, sellOrder *Order) error {
+    schedule := feeScheduleOf(trade.StockID)
+    notional := trade.Price.Mul(trade.Quantity)
+
+    for _, order := range []*Order{buyOrder, sellOrder} {
+        isMaker := order.IsBuy == (trade.Aggressor == "SELL")
+
+        // the volume of the order's first fill sets its discount for good
+        if order.FeeDiscount == nil {
+            discount, err := s.volumeDiscount(order, trade)
+            if err != nil {
+                return err
+            }
+            order.FeeDiscount = &discount
+        }
+
+        fee := schedule.fillFee(order, notional, isMaker, *order.FeeDiscount)
+        released := decimal.Zero
+        if order.IsBuy {
+            // a buy pays out of its fee hold, whatever is left of the hold is released once nothing is left to fill
+            fee = decimal.Min(fee, order.FeeHeld)
+            order.FeeHeld = order.FeeHeld.Sub(fee)
+            if order.Quantity.IsZero() && order.HiddenQuantity.IsZero() {
+                released, order.FeeHeld = order.FeeHeld, decimal.Zero
+            }
+        } else {
+            // a sell pays out of the fill's proceeds
+            fee = decimal.Min(fee, notional)
+        }
+        order.FeeCharged = order.FeeCharged.Add(fee)
+
+        if !fee.IsPositive() && !released.IsPositive() {
+            continue
+        }
+
+        heldChange := decimal.Zero
+        if order.IsBuy {
+            heldChange = fee.Add(released).Neg()
+        }
+        s.effects = append(s.effects, SettlementEffect{Kind: "FEE", UserName: order.UserName, StockID: trade.StockID, Amount: fee.Neg(), Held: heldChange})
+
+        if fee.IsPositive() {
+            if _, err := s.tx.Stmt(stmtSetFeeTransaction).Exec(generateWalletID(), order.UserName, fee, s.Time, order.StockTxID); err != nil {
+                return fmt.Errorf("Failed to record fee: %w", err)
+            }
+        }
+        if err := recordOrderFee(s.tx, *order, fee, heldChange); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// volumeDiscount is the discount of the tier the user's volume of the last 30 days reaches, only tiers need the volume
+func (s *Settlement) volumeDiscount(order *Order, trade *Trade) (decimal.Decimal, error) {
+    if len(feeVolumeTiers) == 0 {
+        return decimal.Zero, nil
+    }
+
+    volume := decimal.Zero
+    err := s.tx.Stmt(stmtGetTradingVolume).QueryRow(order.UserName, s.Time.Add(-feeVolumeWindow), trade.TradeID).Scan(&volume)
+    if err != nil {
+        return decimal.Zero, fmt.Errorf("Failed to get trading volume: %w", err)
+    }
+    return volumeDiscountPercent(volume), nil
+}
+
+// recordOrderFee adds a fee to the order's stock transaction and changes the fee it holds by held
+func recordOrderFee(tx *sql.Tx, order Order, fee decimal.Decimal, held decimal.Decimal) error {
+    if _, err := txStmt(tx, stmtAddStockTransactionFee).Exec(fee, held, order.UserName, order.StockTxID); err != nil {
+        return fmt.Errorf("Failed to record fee: %w", err)
+    }
+    return nil
+}
+
+// releaseFeeHold releases what a buy order still holds for its fees, when it leaves the book before it completes
+func releaseFeeHold(order *Order) {
+    if !order.FeeHeld.IsPositive() {
+        return
+    }
+
+    if err := updateMoneyHold(order.UserName, order.FeeHeld, false); err != nil {
+        fmt.Println("Error releasing fee hold: ", err)
+        return
+    }
+    if err := recordOrderFee(nil, *order, decimal.Zero, order.FeeHeld.Neg()); err != nil {
+        fmt.Println(err)
+    }
+    order.FeeHeld = decimal.Zero
+}
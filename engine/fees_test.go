@@ -0,0 +1,105 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+// feeSchedule charges makers 0.1%, takers 0.2% and a minimum of 1.00
+func feeSchedule(t *testing.T) FeeSchedule {
+    return FeeSchedule{MakerPercent: dec(t, "0.1"), TakerPercent: dec(t, "0.2"), Minimum: dec(t, "1")}
+}
+
+// chargeFills charges the fills of notionals to an order the way chargeFees does and returns the fee of each fill
+func chargeFills(t *testing.T, schedule FeeSchedule, order *Order, isMaker bool, discount string, notionals ...string) []decimal.Decimal {
+    fees := make([]decimal.Decimal, 0, len(notionals))
+    for _, notional := range notionals {
+        fee := schedule.fillFee(order, dec(t, notional), isMaker, dec(t, discount))
+        order.FeeCharged = order.FeeCharged.Add(fee)
+        fees = append(fees, fee)
+    }
+    return fees
+}
+
+func TestFillFeeAppliesTheMinimumOncePerOrder(t *testing.T) {
+    tests := []struct {
+        name      string
+        isMaker   bool
+        discount  string
+        notionals []string
+        fees      []string
+    }{
+        {"small fills", false, "0", []string{"10", "10", "10"}, []string{"1", "0", "0"}},
+        {"fills past the minimum", false, "0", []string{"400", "200", "200"}, []string{"1", "0.2", "0.4"}},
+        {"maker rate", true, "0", []string{"1000", "1000"}, []string{"1", "1"}},
+        {"discounted taker rate", false, "25", []string{"1000", "1000"}, []string{"1.5", "1.5"}},
+        {"sub-cent fees accrue", false, "0", []string{"1000", "1", "1", "1", "3"}, []string{"2", "0.01", "0", "0", "0.01"}},
+    }
+    for _, test := range tests {
+        order := &Order{}
+        fees := chargeFills(t, feeSchedule(t), order, test.isMaker, test.discount, test.notionals...)
+        for i, fee := range fees {
+            if !fee.Equal(dec(t, test.fees[i])) {
+                t.Errorf("%s: fill %d pays %v, want %s", test.name, i, fee, test.fees[i])
+            }
+        }
+    }
+}
+
+func TestSplitFillsNeverCostMoreThanTheFeeHold(t *testing.T) {
+    schedule := feeSchedule(t)
+    hold := schedule.maxFee(dec(t, "1000.01"))
+
+    order := &Order{}
+    fees := chargeFills(t, schedule, order, false, "0", "0.01", "333.33", "333.33", "333.34")
+    if order.FeeCharged.GreaterThan(hold) {
+        t.Errorf("fills %v cost %v in total, more than the hold of %v", fees, order.FeeCharged, hold)
+    }
+
+    whole := chargeFills(t, schedule, &Order{}, false, "0", "1000.01")
+    if !order.FeeCharged.Equal(whole[0]) {
+        t.Errorf("split fills cost %v, one fill %v", order.FeeCharged, whole[0])
+    }
+}
+
+func TestFeeHold(t *testing.T) {
+    schedule := feeSchedule(t)
+
+    if hold := schedule.maxFee(dec(t, "100")); !hold.Equal(dec(t, "1")) {
+        t.Errorf("a small order holds %v, want the minimum", hold)
+    }
+    if hold := schedule.maxFee(dec(t, "1000.01")); !hold.Equal(dec(t, "2.01")) {
+        t.Errorf("an order of 1000.01 holds %v, want 2.01 at the taker rate", hold)
+    }
+
+    // an order that paid 1.00 for 400 still holds what the taker rate adds for the remaining 600
+    order := &Order{}
+    chargeFills(t, schedule, order, false, "0", "400")
+    if hold := schedule.feeHold(*order, dec(t, "600")); !hold.Equal(dec(t, "1")) {
+        t.Errorf("the remaining 600 hold %v, want 1", hold)
+    }
+    if hold := schedule.feeHold(*order, dec(t, "100")); !hold.IsZero() {
+        t.Errorf("the remaining 100 hold %v, the minimum is already paid", hold)
+    }
+}
+
+func TestParseFeeTiers(t *testing.T) {
+    tiers := parseFeeTiers("1000000:25, 100000:10,bad,5:200,:1,")
+    if len(tiers) != 2 {
+        t.Fatalf("parsed %d tiers, want 2: %v", len(tiers), tiers)
+    }
+    if !tiers[0].MinVolume.Equal(dec(t, "100000")) || !tiers[1].DiscountPercent.Equal(dec(t, "25")) {
+        t.Errorf("tiers are not sorted by volume: %v", tiers)
+    }
+
+    saved := feeVolumeTiers
+    defer func() { feeVolumeTiers = saved }()
+    feeVolumeTiers = tiers
+
+    for volume, discount := range map[string]string{"0": "0", "100000": "10", "999999.99": "10", "5000000": "25"} {
+        if got := volumeDiscountPercent(dec(t, volume)); !got.Equal(dec(t, discount)) {
+            t.Errorf("a volume of %s gets %v%%, want %s%%", volume, got, discount)
+        }
+    }
+}
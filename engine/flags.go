@@ -0,0 +1,98 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Order flags:
+    post_only:   a LIMIT order that only adds liquidity. If it would cross the book on arrival it is rejected, or with
+                 POST_ONLY_MODE=REPRICE moved one tick behind the best opposite price so it rests instead.
+    reduce_only: a sell that never sells more than the user has left. Its quantity is capped at the user's holdings,
+                 which already exclude shares held by resting sells, minus the shares of their waiting stop sells.
+*/
+func validateOrderFlags(request *PlaceStockOrderRequest) error {
+    if request.PostOnly {
+        if request.OrderType != "LIMIT" {
+            return fmt.Errorf("Post only is only supported for limit orders")
+        }
+        if request.TimeInForce == "IOC" || request.TimeInForce == "FOK" {
+            return fmt.Errorf("Post only is not supported for IOC and FOK orders")
+        }
+    }
+
+    if request.ReduceOnly && request.IsBuy != nil && *request.IsBuy {
+        return fmt.Errorf("Reduce only is only supported for sell orders")
+    }
+    return nil
+}
+
+// applyPostOnly rejects or reprices a post only order that would cross the book. It must run on the book's goroutine.
+func applyPostOnly(book *OrderBook, order *Order) *OrderError {
+    // nothing matches on arrival outside continuous trading
+    if !order.PostOnly || book.Session != "CONTINUOUS" || book.Halted {
+        return nil
+    }
+
+    price, crosses := postOnlyPrice(book, *order)
+    if !crosses {
+        return nil
+    }
+
+    if postOnlyMode != "REPRICE" {
+        return &OrderError{http.StatusBadRequest, "Post only order would cross the book", nil}
+    }
+    if !price.IsPositive() {
+        return &OrderError{http.StatusBadRequest, "Post only order cannot be repriced behind the best price", nil}
+    }
+    order.Price = &price
+    return nil
+}
+
+// postOnlyPrice returns the price one tick behind the best opposite price, and whether the order's price crosses it
+func postOnlyPrice(book *OrderBook, order Order) (decimal.Decimal, bool) {
+    if order.IsBuy {
+        if book.SellOrders.Len() == 0 || book.SellOrders.Order[0].Price.GreaterThan(*order.Price) {
+            return decimal.Zero, false
+        }
+        return book.SellOrders.Order[0].Price.Sub(book.TickSize), true
+    }
+
+    if book.BuyOrders.Len() == 0 || book.BuyOrders.Order[0].Price.LessThan(*order.Price) {
+        return decimal.Zero, false
+    }
+    return book.BuyOrders.Order[0].Price.Add(book.TickSize), true
+}
+
+// applyReduceOnly caps a reduce only sell at the shares the user can still sell. It must run on the book's goroutine.
+func applyReduceOnly(book *OrderBook, order *Order) *OrderError {
+    if !order.ReduceOnly {
+        return nil
+    }
+
+    var holdings decimal.Decimal
+    if err := stmtVerifyStockBeforeTransaction.QueryRow(order.UserName, order.StockID).Scan(&holdings); err != nil {
+        return &OrderError{http.StatusBadRequest, "Failed to verify stocks", fmt.Errorf("failed to get user stock portfolio: %w", err)}
+    }
+
+    // waiting stop sells have not taken their shares yet
+    available := holdings
+    for _, stopOrder := range book.TriggerOrders {
+        if !stopOrder.IsBuy && stopOrder.UserName == order.UserName && stopOrder.StockTxID != order.StockTxID {
+            available = available.Sub(stopOrder.Quantity)
+        }
+    }
+
+    // whole lots only
+    available = available.Div(book.LotSize).Floor().Mul(book.LotSize)
+    if !available.IsPositive() {
+        return &OrderError{http.StatusBadRequest, "Reduce only order has no holdings left to sell", nil}
+    }
+    if order.Quantity.GreaterThan(available) {
+        order.Quantity = available
+    }
+    return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestValidateOrderFlags(t *testing.T) {
+    buy, sell := true, false
+    tests := []struct {
+        name    string
+        request PlaceStockOrderRequest
+        valid   bool
+    }{
+        {"post only limit", PlaceStockOrderRequest{OrderType: "LIMIT", TimeInForce: "GTC", PostOnly: true}, true},
+        {"post only market", PlaceStockOrderRequest{OrderType: "MARKET", PostOnly: true}, false},
+        {"post only IOC", PlaceStockOrderRequest{OrderType: "LIMIT", TimeInForce: "IOC", PostOnly: true}, false},
+        {"reduce only sell", PlaceStockOrderRequest{OrderType: "MARKET", IsBuy: &sell, ReduceOnly: true}, true},
+        {"reduce only buy", PlaceStockOrderRequest{OrderType: "MARKET", IsBuy: &buy, ReduceOnly: true}, false},
+    }
+    for _, test := range tests {
+        if err := validateOrderFlags(&test.request); (err == nil) != test.valid {
+            t.Errorf("%s: valid is %v, want %v", test.name, err == nil, test.valid)
+        }
+    }
+}
+
+func TestApplyPostOnly(t *testing.T) {
+    saved := postOnlyMode
+    defer func() { postOnlyMode = saved }()
+
+    book := &OrderBook{
+        StockID:    "stock",
+        Session:    "CONTINUOUS",
+        TickSize:   dec(t, "0.01"),
+        BuyOrders:  bookSide(true, limitOrder(t, "bid", true, "9.50", "1", "1")),
+        SellOrders: bookSide(false, limitOrder(t, "ask", false, "10", "1", "2")),
+    }
+    postOnlyBuy := func(price string) *Order {
+        order := limitOrder(t, "buy", true, price, "1", "3")
+        order.PostOnly = true
+        return order
+    }
+
+    postOnlyMode = "REJECT"
+    if orderErr := applyPostOnly(book, postOnlyBuy("9.99")); orderErr != nil {
+        t.Errorf("a post only buy below the ask was rejected: %v", orderErr)
+    }
+    if orderErr := applyPostOnly(book, postOnlyBuy("10")); orderErr == nil {
+        t.Errorf("a post only buy at the ask was accepted")
+    }
+
+    postOnlyMode = "REPRICE"
+    order := postOnlyBuy("10.50")
+    if orderErr := applyPostOnly(book, order); orderErr != nil || !order.Price.Equal(dec(t, "9.99")) {
+        t.Errorf("a crossing post only buy was priced at %v (%v), want one tick behind the ask", order.Price, orderErr)
+    }
+
+    sell := limitOrder(t, "sell", false, "9", "1", "3")
+    sell.PostOnly = true
+    if orderErr := applyPostOnly(book, sell); orderErr != nil || !sell.Price.Equal(dec(t, "9.51")) {
+        t.Errorf("a crossing post only sell was priced at %v (%v), want one tick behind the bid", sell.Price, orderErr)
+    }
+
+    // nothing matches while the book only collects orders
+    postOnlyMode = "REJECT"
+    book.Session = "PRE_OPEN"
+    if orderErr := applyPostOnly(book, postOnlyBuy("10.50")); orderErr != nil {
+        t.Errorf("a post only buy was rejected during the call phase: %v", orderErr)
+    }
+}
@@ -7,6 +7,7 @@ require (
 	github.com/gin-gonic/gin v1.9.1
 	github.com/google/uuid v1.6.0
 	github.com/lib/pq v1.10.9
+	github.com/shopspring/decimal v1.4.0
 	go.mongodb.org/mongo-driver v1.14.0
 )
 
@@ -0,0 +1,281 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Price bands and trading halts.
+
+    Static band:  LIMIT and STOP_LIMIT prices must lie within static_band_percent of the reference price, the price
+                  the stock last opened (or resumed) at, or the first trade of the book.
+    Dynamic band: they must also lie within dynamic_band_percent of the last traded price.
+    Both are set per stock, falling back to STATIC_PRICE_BAND_PERCENT and DYNAMIC_PRICE_BAND_PERCENT, 0 disables a band.
+    The bands are checked in the book command that places or amends the order, at its final price: a repriced post
+    only order at its new price, a STOP_LIMIT order when it is placed and again when it triggers.
+
+    Circuit breaker: a trade that would move the price more than HALT_MOVE_PERCENT away from any trade of the last
+    HALT_WINDOW is not executed, and the stock is halted for HALT_DURATION. Admins (ADMIN_USERS) can halt a stock
+    until further notice and resume it with /haltStock and /resumeStock.
+
+    While a stock is halted nothing matches. With HALT_ORDER_POLICY=QUEUE new LIMIT orders are collected (MARKET,
+    IOC and FOK are rejected) and uncrossed in an auction when trading resumes, with REJECT every new order is
+    rejected. Cancels are always accepted. The halt is stored in stocks.is_halted so it survives a restart.
+*/
+
+// tradePrice is a trade of the circuit breaker window
+type tradePrice struct {
+    Time  time.Time
+    Price decimal.Decimal
+}
+
+// HaltEvent is a halt or resume of a stock, Until is nil for a halt that lasts until an admin resumes the stock
+type HaltEvent struct {
+    StockID string     `json:"stock_id"`
+    Halted  bool       `json:"is_halted"`
+    Reason  string     `json:"reason"`
+    Until   *time.Time `json:"halted_until"`
+}
+
+// Define the structure of the request body for halting and resuming a stock
+type HaltStockRequest struct {
+    StockID string `json:"stock_id"`
+}
+
+// loadTradingControls reads the price bands, reference price and halt of a new book from stock_db
+func loadTradingControls(book *OrderBook) {
+    var lastPrice decimal.Decimal
+    var haltedUntil *time.Time
+    err := stmtGetTradingControls.QueryRow(book.StockID, staticPriceBandPercent, dynamicPriceBandPercent).
+        Scan(&book.StaticBandPercent, &book.DynamicBandPercent, &lastPrice, &book.Halted, &haltedUntil)
+    if err != nil {
+        book.StaticBandPercent, book.DynamicBandPercent = staticPriceBandPercent, dynamicPriceBandPercent
+        return
+    }
+
+    book.LastPrice, book.ReferencePrice = lastPrice, lastPrice
+    if haltedUntil != nil {
+        until := haltedUntil.UTC()
+        book.HaltedUntil = &until
+    }
+}
+
+// checkPriceBands rejects a limit price outside the book's static or dynamic price band. It must run on the book's
+// goroutine, in the same command that places or amends the order at that price.
+func checkPriceBands(book *OrderBook, price *decimal.Decimal) *OrderError {
+    if price == nil {
+        return nil
+    }
+
+    if err := checkPriceBand(*price, book.ReferencePrice, book.StaticBandPercent, "static"); err != nil {
+        return &OrderError{http.StatusBadRequest, err.Error(), err}
+    }
+    if err := checkPriceBand(*price, book.LastPrice, book.DynamicBandPercent, "dynamic"); err != nil {
+        return &OrderError{http.StatusBadRequest, err.Error(), err}
+    }
+    return nil
+}
+
+func checkPriceBand(price decimal.Decimal, bandPrice decimal.Decimal, percent decimal.Decimal, band string) error {
+    if !bandPrice.IsPositive() || !percent.IsPositive() {
+        return nil
+    }
+
+    width := bandPrice.Mul(percent).Div(decimal.NewFromInt(100))
+    low, high := bandPrice.Sub(width), bandPrice.Add(width)
+    if price.LessThan(low) || price.GreaterThan(high) {
+        return fmt.Errorf("Price is outside the %s price band of %s to %s", band, low.StringFixed(2), high.StringFixed(2))
+    }
+    return nil
+}
+
+// checkCircuitBreaker halts the stock instead of executing a trade that moves the price too far, too fast.
+// Trades run on their book's goroutine, so the book is safe to use here.
+func checkCircuitBreaker(trade *Trade) error {
+    book, ok := findOrderBook(trade.StockID)
+    if !ok || !haltMovePercent.IsPositive() {
+        return nil
+    }
+
+    now := clock.Now()
+    recent := book.recentPrices[:0]
+    for _, recentTrade := range book.recentPrices {
+        if now.Sub(recentTrade.Time) <= haltWindow {
+            recent = append(recent, recentTrade)
+        }
+    }
+    book.recentPrices = recent
+
+    if move := circuitBreakerMove(book, trade.Price, now); move.GreaterThan(haltMovePercent) {
+        until := now.Add(haltDuration).UTC()
+        haltBook(book, "CIRCUIT_BREAKER", &until)
+        return fmt.Errorf("Trading in %s halted, a trade at %s would move the price %s%%", trade.StockID, trade.Price.StringFixed(2), move.StringFixed(2))
+    }
+    return nil
+}
+
+// tripsCircuitBreaker reports whether a trade at price would halt the book, without halting it
+func tripsCircuitBreaker(book *OrderBook, price decimal.Decimal) bool {
+    return haltMovePercent.IsPositive() && circuitBreakerMove(book, price, clock.Now()).GreaterThan(haltMovePercent)
+}
+
+// circuitBreakerMove returns the largest move in percent a trade at price makes against the book's trades in the halt window
+func circuitBreakerMove(book *OrderBook, price decimal.Decimal, now time.Time) decimal.Decimal {
+    move := decimal.Zero
+    for _, recentTrade := range book.recentPrices {
+        if now.Sub(recentTrade.Time) > haltWindow {
+            continue
+        }
+        move = decimal.Max(move, price.Sub(recentTrade.Price).Abs().Mul(decimal.NewFromInt(100)).Div(recentTrade.Price))
+    }
+    return move
+}
+
+// recordTradePrice adds a settled trade to its book's last price and circuit breaker window
+func recordTradePrice(trade *Trade) {
+    book, ok := findOrderBook(trade.StockID)
+    if !ok {
+        return
+    }
+
+    book.LastPrice = trade.Price
+    book.LastTradePrice = trade.Price
+    if !book.ReferencePrice.IsPositive() {
+        book.ReferencePrice = trade.Price
+    }
+    book.recentPrices = append(book.recentPrices, tradePrice{Time: clock.Now(), Price: trade.Price})
+}
+
+// haltBook stops matching in the book, until nil halts it until an admin resumes it. It must run on the book's goroutine.
+func haltBook(book *OrderBook, reason string, until *time.Time) {
+    book.Halted = true
+    book.HaltedUntil = until
+
+    if _, err := stmtSetStockHalt.Exec(true, until, book.StockID); err != nil {
+        fmt.Println("Error storing stock halt: ", err)
+    }
+    fmt.Printf("Order book %s halted (%s)\n", book.StockID, reason)
+    marketDataHub.publish(book.StockID, "halt", HaltEvent{StockID: book.StockID, Halted: true, Reason: reason, Until: until})
+}
+
+// resumeBook lifts a halt, uncrossing the orders collected during it when the session is trading continuously.
+// It must run on the book's goroutine.
+func resumeBook(book *OrderBook, reason string) {
+    book.Halted = false
+    book.HaltedUntil = nil
+    book.recentPrices = nil
+
+    if _, err := stmtSetStockHalt.Exec(false, nil, book.StockID); err != nil {
+        fmt.Println("Error storing stock halt: ", err)
+    }
+    fmt.Printf("Order book %s resumed (%s)\n", book.StockID, reason)
+    marketDataHub.publish(book.StockID, "halt", HaltEvent{StockID: book.StockID, Halted: false, Reason: reason})
+
+    if book.Session == "CONTINUOUS" {
+        uncrossAuction(book)
+        book.ReferencePrice = book.LastPrice
+    }
+    releaseTriggeredOrders(book)
+    pruneOrderIndex(book)
+}
+
+// resumeExpiredHalt resumes a book whose timed halt is over. It must run on the book's goroutine.
+func resumeExpiredHalt(book *OrderBook, now time.Time) {
+    if book.Halted && book.HaltedUntil != nil && !now.Before(*book.HaltedUntil) {
+        resumeBook(book, "HALT_EXPIRED")
+    }
+}
+
+// checkHaltAccepts rejects orders a halted book does not take under HALT_ORDER_POLICY
+func checkHaltAccepts(book *OrderBook, order Order) *OrderError {
+    if !book.Halted {
+        return nil
+    }
+
+    if haltOrderPolicy == "REJECT" {
+        return &OrderError{http.StatusBadRequest, "Trading in this stock is halted", nil}
+    }
+    if order.OrderType == "MARKET" || order.TimeInForce == "IOC" || order.TimeInForce == "FOK" {
+        return &OrderError{http.StatusBadRequest, "Only limit orders are accepted while trading is halted", nil}
+    }
+    return nil
+}
+
+func isAdmin(userName string) bool {
+    for _, admin := range strings.Split(adminUsers, ",") {
+        if strings.TrimSpace(admin) == userName {
+            return true
+        }
+    }
+    return false
+}
+
+func HandleHaltStock(c *gin.Context) {
+    handleHaltRequest(c, true)
+}
+
+func HandleResumeStock(c *gin.Context) {
+    handleHaltRequest(c, false)
+}
+
+// handleHaltRequest halts a stock until further notice or resumes it, for admins only
+func handleHaltRequest(c *gin.Context, halt bool) {
+    userName, exists := c.Get("user_name")
+    if !exists || userName == nil {
+        handleError(c, http.StatusUnauthorized, "User not authenticated", nil)
+        return
+    }
+
+    if !isAdmin(userName.(string)) {
+        handleError(c, http.StatusForbidden, "Only admins can halt and resume stocks", nil)
+        return
+    }
+
+    var request HaltStockRequest
+    if err := c.ShouldBindJSON(&request); err != nil || request.StockID == "" {
+        handleError(c, http.StatusBadRequest, "Invalid request body", err)
+        return
+    }
+
+    book, ok, err := knownOrderBook(request.StockID)
+    if err != nil {
+        handleError(c, http.StatusInternalServerError, "Failed to initialize the order book", err)
+        return
+    }
+    if !ok {
+        handleError(c, http.StatusNotFound, "Stock not found", nil)
+        return
+    }
+
+    changed := false
+    book.execute(func(book *OrderBook) {
+        if halt && !book.Halted {
+            haltBook(book, "MANUAL", nil)
+            changed = true
+        } else if !halt && book.Halted {
+            resumeBook(book, "MANUAL")
+            changed = true
+        }
+    })
+
+    if !changed {
+        state := "not halted"
+        if halt {
+            state = "already halted"
+        }
+        handleError(c, http.StatusBadRequest, "Stock is "+state, nil)
+        return
+    }
+
+    response := CancelStockTransactionResponse{
+        Success: true,
+        Data:    nil,
+    }
+    c.IndentedJSON(http.StatusOK, response)
+}
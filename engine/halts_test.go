@@ -0,0 +1,100 @@
+package main
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+func TestCheckPriceBand(t *testing.T) {
+    tests := []struct {
+        price     string
+        bandPrice string
+        percent   string
+        inside    bool
+    }{
+        {"100", "100", "10", true},
+        {"110", "100", "10", true},
+        {"90", "100", "10", true},
+        {"110.01", "100", "10", false},
+        {"89.99", "100", "10", false},
+        {"500", "100", "0", true},
+        {"500", "0", "10", true},
+    }
+    for _, test := range tests {
+        err := checkPriceBand(dec(t, test.price), dec(t, test.bandPrice), dec(t, test.percent), "static")
+        if (err == nil) != test.inside {
+            t.Errorf("%s around %s +-%s%%: inside is %v, want %v", test.price, test.bandPrice, test.percent, err == nil, test.inside)
+        }
+    }
+}
+
+// bandedBook is a continuous book with a static band of 100 +-10% and a dynamic band of 105 +-5%
+func bandedBook(t *testing.T) *OrderBook {
+    return &OrderBook{
+        StockID:            "stock",
+        Session:            "CONTINUOUS",
+        TickSize:           dec(t, "0.01"),
+        StaticBandPercent:  dec(t, "10"),
+        DynamicBandPercent: dec(t, "5"),
+        ReferencePrice:     dec(t, "100"),
+        LastPrice:          dec(t, "105"),
+        BuyOrders:          bookSide(true),
+        SellOrders:         bookSide(false),
+    }
+}
+
+func TestCheckPriceBands(t *testing.T) {
+    book := bandedBook(t)
+
+    tests := []struct {
+        price  string
+        inside bool
+    }{
+        {"100", true},
+        {"110", true},
+        {"99.74", false}, // inside the static band, below the dynamic one
+        {"110.25", false}, // inside the dynamic band, above the static one
+    }
+    for _, test := range tests {
+        price := dec(t, test.price)
+        if orderErr := checkPriceBands(book, &price); (orderErr == nil) != test.inside {
+            t.Errorf("%s: inside is %v, want %v", test.price, orderErr == nil, test.inside)
+        }
+    }
+    if orderErr := checkPriceBands(book, nil); orderErr != nil {
+        t.Errorf("an order without a price was rejected: %v", orderErr)
+    }
+}
+
+func TestRepricedPostOnlyOrderIsCheckedAtItsNewPrice(t *testing.T) {
+    previous := postOnlyMode
+    postOnlyMode = "REPRICE"
+    t.Cleanup(func() { postOnlyMode = previous })
+
+    // the sell asks 105, inside both bands, and is repriced one tick above the best bid to 110.01, above the static band
+    book := bandedBook(t)
+    book.BuyOrders = bookSide(true, limitOrder(t, "bid", true, "110", "1", "1"))
+
+    sell := *limitOrder(t, "sell", false, "105", "1", "2")
+    sell.PostOnly = true
+    orderErr := placeOrderInBook(book, sell)
+    if orderErr == nil || !strings.Contains(orderErr.Message, "static price band") {
+        t.Fatalf("got %v, want the repriced order rejected by the static band", orderErr)
+    }
+}
+
+func TestAmendedPriceIsCheckedAgainstTheBands(t *testing.T) {
+    book := bandedBook(t)
+    book.BuyOrders = bookSide(true, limitOrder(t, "bid", true, "104", "1", "1"))
+
+    price := decimal.RequireFromString("99")
+    _, orderErr := modifyRestingOrder(book, &book.BuyOrders, 0, ModifyStockOrderRequest{StockTxID: "bid", Price: &price})
+    if orderErr == nil || !strings.Contains(orderErr.Message, "dynamic price band") {
+        t.Fatalf("got %v, want the amendment rejected by the dynamic band", orderErr)
+    }
+    if !book.BuyOrders.Order[0].Price.Equal(decimal.RequireFromString("104")) {
+        t.Errorf("the rejected amendment changed the order's price to %v", book.BuyOrders.Order[0].Price)
+    }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Iceberg orders: a LIMIT order with a display_quantity only shows that slice in the book, the rest waits in a
+    hidden reserve (HiddenQuantity). Funds or stocks for the full quantity are still reserved when the order is placed.
+
+    When a slice fills, the next slice is taken from the reserve once the book's current command is done and enters the
+    book as a new arrival, so it gets fresh time priority and may match straight away. Until the reserve is used up a
+    filled slice is a partial fill of the order. Cancels, expiries and self-trade cancels release the reserve as well.
+*/
+func validateIceberg(request *PlaceStockOrderRequest) error {
+    if request.DisplayQuantity == nil {
+        return nil
+    }
+
+    if request.OrderType != "LIMIT" {
+        return fmt.Errorf("Display quantity is only supported for limit orders")
+    }
+    if request.TimeInForce == "IOC" || request.TimeInForce == "FOK" {
+        return fmt.Errorf("Display quantity is not supported for IOC and FOK orders")
+    }
+    if !request.DisplayQuantity.IsPositive() || !request.DisplayQuantity.LessThan(request.Quantity) {
+        return fmt.Errorf("Display quantity must be positive and less than the quantity")
+    }
+    return nil
+}
+
+// remainingQuantity is what is left of an order, including the hidden reserve of an iceberg
+func remainingQuantity(order Order) decimal.Decimal {
+    return order.Quantity.Add(order.HiddenQuantity)
+}
+
+// showIcebergSlice moves everything but the first slice of an iceberg order into its hidden reserve
+func showIcebergSlice(order *Order) {
+    if order.DisplayQuantity == nil || !order.DisplayQuantity.LessThan(order.Quantity) {
+        return
+    }
+    order.HiddenQuantity = order.Quantity.Sub(*order.DisplayQuantity)
+    order.Quantity = *order.DisplayQuantity
+}
+
+// queueIcebergRefills remembers the orders of a fill whose slice is used up while their reserve is not.
+// Trades run on their book's goroutine, so the book is safe to use here.
+func queueIcebergRefills(orders ...*Order) {
+    for _, order := range orders {
+        if !order.Quantity.IsZero() || !order.HiddenQuantity.IsPositive() {
+            continue
+        }
+        if book, ok := findOrderBook(order.StockID); ok {
+            book.icebergRefills = append(book.icebergRefills, *order)
+        }
+    }
+}
+
+// refillIcebergNow gives an iceberg order whose slice is used up its next slice in place, instead of the refill queued
+// for it. The call auction uses it, so the hidden reserve executes in the same uncross.
+func refillIcebergNow(book *OrderBook, order *Order) {
+    if !order.Quantity.IsZero() || !order.HiddenQuantity.IsPositive() {
+        return
+    }
+
+    for i, queued := range book.icebergRefills {
+        if queued.StockTxID == order.StockTxID {
+            book.icebergRefills = append(book.icebergRefills[:i], book.icebergRefills[i+1:]...)
+            break
+        }
+    }
+
+    slice := decimal.Min(*order.DisplayQuantity, order.HiddenQuantity)
+    order.Quantity = slice
+    order.HiddenQuantity = order.HiddenQuantity.Sub(slice)
+}
+
+// refillIcebergs puts the next slice of every queued iceberg order into the book. It must run on the book's goroutine.
+func refillIcebergs(book *OrderBook) {
+    for len(book.icebergRefills) > 0 {
+        order := book.icebergRefills[0]
+        book.icebergRefills = book.icebergRefills[1:]
+
+        slice := decimal.Min(*order.DisplayQuantity, order.HiddenQuantity)
+        order.Quantity = slice
+        order.HiddenQuantity = order.HiddenQuantity.Sub(slice)
+        order.TimeStamp = time.Now().Format(time.RFC3339Nano)
+
+        indexOrder(order.StockTxID, order.StockID)
+        processOrder(book, order)
+    }
+}
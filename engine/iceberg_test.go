@@ -0,0 +1,76 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+func TestValidateIceberg(t *testing.T) {
+    tests := []struct {
+        orderType   string
+        timeInForce string
+        display     string
+        valid       bool
+    }{
+        {"LIMIT", "GTC", "10", true},
+        {"LIMIT", "DAY", "100", false},
+        {"LIMIT", "DAY", "0", false},
+        {"LIMIT", "IOC", "10", false},
+        {"MARKET", "", "10", false},
+    }
+    for _, test := range tests {
+        display := dec(t, test.display)
+        request := PlaceStockOrderRequest{OrderType: test.orderType, TimeInForce: test.timeInForce, Quantity: dec(t, "100"), DisplayQuantity: &display}
+        if err := validateIceberg(&request); (err == nil) != test.valid {
+            t.Errorf("%s %s showing %s: valid is %v, want %v", test.orderType, test.timeInForce, test.display, err == nil, test.valid)
+        }
+    }
+}
+
+func TestIcebergShowsOneSliceAtATime(t *testing.T) {
+    order := icebergOrder(t, "ice", true, "10", "25", "10", "1")
+    if !order.Quantity.Equal(dec(t, "10")) || !order.HiddenQuantity.Equal(dec(t, "15")) || !remainingQuantity(*order).Equal(dec(t, "25")) {
+        t.Fatalf("the iceberg shows %v and hides %v", order.Quantity, order.HiddenQuantity)
+    }
+
+    book := &OrderBook{StockID: "stock", Session: "CONTINUOUS", BuyOrders: bookSide(true), SellOrders: bookSide(false)}
+    for _, want := range []struct{ shown, hidden string }{{"10", "5"}, {"5", "0"}} {
+        order.Quantity = decimal.Zero
+        refillIcebergNow(book, order)
+        if !order.Quantity.Equal(dec(t, want.shown)) || !order.HiddenQuantity.Equal(dec(t, want.hidden)) {
+            t.Errorf("the refill shows %v and hides %v, want %s and %s", order.Quantity, order.HiddenQuantity, want.shown, want.hidden)
+        }
+    }
+
+    // nothing is left to refill
+    order.Quantity = decimal.Zero
+    refillIcebergNow(book, order)
+    if !order.Quantity.IsZero() {
+        t.Errorf("an order without a reserve was refilled")
+    }
+}
+
+func TestRefilledSliceLosesTimePriority(t *testing.T) {
+    iceberg := icebergOrder(t, "ice", true, "10", "20", "10", "1")
+    book := &OrderBook{StockID: "stock", Session: "CONTINUOUS", BuyOrders: bookSide(true, limitOrder(t, "later", true, "10", "5", "2")), SellOrders: bookSide(false)}
+    registerBook(t, book)
+    t.Cleanup(func() { unindexOrder("ice") })
+
+    // the slice was filled
+    iceberg.Quantity = decimal.Zero
+    queueIcebergRefills(iceberg)
+    if len(book.icebergRefills) != 1 {
+        t.Fatalf("the used up slice was not queued for a refill")
+    }
+
+    refillIcebergs(book)
+    if book.BuyOrders.Len() != 2 || book.BuyOrders.Order[0].StockTxID != "later" {
+        t.Errorf("the refilled slice kept its time priority")
+    }
+    for _, order := range book.BuyOrders.Order {
+        if order.StockTxID == "ice" && (!order.Quantity.Equal(dec(t, "10")) || !order.HiddenQuantity.IsZero()) {
+            t.Errorf("the refill shows %v and hides %v, want 10 and 0", order.Quantity, order.HiddenQuantity)
+        }
+    }
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+    "github.com/shopspring/decimal"
+)
+
+/*
+    General ledger: every change of a wallet or portfolio is also posted as a journal entry in ledger_entries, in the
+    database and transaction that change the balance. The ledger is append only, a trigger rejects updates and deletes.
+
+    Every user has an AVAILABLE and a HELD account per asset: CASH in user_db, the stock id in stock_db. Together they
+    make up users.wallet or user_stocks.quantity, and HELD is wallet_held or quantity_held. The other side of every
+    entry is a system account (sub account MAIN): EXTERNAL for money and stocks coming in from or going out to the
+    outside, CLEARING for fills, which nets out once both sides of a trade are applied, and FEES for trading fees.
+
+    The lines of an entry always sum to zero. The audit (`engine audit`, or /auditLedger for admins) checks that every
+    entry balances and that every user's balances equal the sum of their entries.
+*/
+const (
+    ledgerCash     = "CASH"
+    ledgerExternal = "EXTERNAL"
+    ledgerClearing = "CLEARING"
+    ledgerFees     = "FEES"
+)
+
+// LedgerLine is one line of a journal entry
+type LedgerLine struct {
+    Account    string
+    SubAccount string // AVAILABLE or HELD for users, MAIN for system accounts
+    Amount     decimal.Decimal
+}
+
+// LedgerMismatch is a problem found by the audit
+type LedgerMismatch struct {
+    Database string `json:"database"`
+    Account  string `json:"account"`
+    Asset    string `json:"asset"`
+    Problem  string `json:"problem"`
+}
+
+// Define the structure of the response body for the ledger audit
+type LedgerAuditResponse struct {
+    Success bool             `json:"success"`
+    Data    []LedgerMismatch `json:"data"`
+}
+
+// ledgerLines books a change of a user's balance (amount) and of its held part (held) against counterAccount
+func ledgerLines(userName string, amount decimal.Decimal, held decimal.Decimal, counterAccount string) []LedgerLine {
+    lines := make([]LedgerLine, 0, 3)
+    for _, line := range []LedgerLine{
+        {userName, "AVAILABLE", amount.Sub(held)},
+        {userName, "HELD", held},
+        {counterAccount, "MAIN", amount.Neg()},
+    } {
+        if !line.Amount.IsZero() {
+            lines = append(lines, line)
+        }
+    }
+    return lines
+}
+
+// postLedgerEntry writes the lines of one journal entry with stmt (stmtInsertUserLedgerEntry or stmtInsertStockLedgerEntry)
+func postLedgerEntry(tx *sql.Tx, stmt *sql.Stmt, journalID string, kind string, asset string, lines []LedgerLine) error {
+    for _, line := range lines {
+        if _, err := tx.Stmt(stmt).Exec(journalID, line.Account, line.SubAccount, asset, line.Amount, kind); err != nil {
+            return fmt.Errorf("Failed to post ledger entry: %w", err)
+        }
+    }
+    return nil
+}
+
+// auditLedger checks both ledgers, nothing is returned when they balance
+func auditLedger() ([]LedgerMismatch, error) {
+    mismatches := make([]LedgerMismatch, 0)
+
+    checks := []struct {
+        database string
+        stmt     *sql.Stmt
+        problem  string
+    }{
+        {"user_db", stmtUnbalancedUserJournals, "journal entry does not balance"},
+        {"user_db", stmtAuditUserLedger, "wallet differs from its ledger entries"},
+        {"stock_db", stmtUnbalancedStockJournals, "journal entry does not balance"},
+        {"stock_db", stmtAuditStockLedger, "portfolio differs from its ledger entries"},
+    }
+    for _, check := range checks {
+        rows, err := check.stmt.Query()
+        if err != nil {
+            return nil, fmt.Errorf("Failed to audit %s: %w", check.database, err)
+        }
+
+        for rows.Next() {
+            mismatch := LedgerMismatch{Database: check.database}
+            var detail string
+            if err := rows.Scan(&mismatch.Account, &mismatch.Asset, &detail); err != nil {
+                rows.Close()
+                return nil, fmt.Errorf("Failed to scan %s audit: %w", check.database, err)
+            }
+            mismatch.Problem = check.problem + " (" + detail + ")"
+            mismatches = append(mismatches, mismatch)
+        }
+        rows.Close()
+    }
+    return mismatches, nil
+}
+
+// runLedgerAudit prints the audit and returns the exit code of `engine audit`
+func runLedgerAudit() int {
+    mismatches, err := auditLedger()
+    if err != nil {
+        fmt.Println("Ledger audit failed: ", err)
+        return 2
+    }
+
+    for _, mismatch := range mismatches {
+        fmt.Printf("%s %s %s: %s\n", mismatch.Database, mismatch.Account, mismatch.Asset, mismatch.Problem)
+    }
+    if len(mismatches) > 0 {
+        fmt.Printf("Ledger audit found %d problems\n", len(mismatches))
+        return 1
+    }
+    fmt.Println("Ledger audit passed")
+    return 0
+}
+
+func HandleAuditLedger(c *gin.Context) {
+    userName, exists := c.Get("user_name")
+    if !exists || userName == nil {
+        handleError(c, http.StatusUnauthorized, "User not authenticated", nil)
+        return
+    }
+
+    if !isAdmin(userName.(string)) {
+        handleError(c, http.StatusForbidden, "Only admins can audit the ledger", nil)
+        return
+    }
+
+    mismatches, err := auditLedger()
+    if err != nil {
+        handleError(c, http.StatusInternalServerError, "Failed to audit the ledger", err)
+        return
+    }
+
+    response := LedgerAuditResponse{
+        Success: len(mismatches) == 0,
+        Data:    mismatches,
+    }
+    c.IndentedJSON(http.StatusOK, response)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+func TestLedgerLinesBalance(t *testing.T) {
+    tests := []struct {
+        name   string
+        amount string
+        held   string
+        lines  map[string]string
+    }{
+        {"spending a hold", "-50", "-52", map[string]string{"AVAILABLE": "2", "HELD": "-52", "MAIN": "50"}},
+        {"a credit", "50", "0", map[string]string{"AVAILABLE": "50", "MAIN": "-50"}},
+        {"a hold", "0", "10", map[string]string{"AVAILABLE": "-10", "HELD": "10"}},
+        {"nothing", "0", "0", map[string]string{}},
+    }
+    for _, test := range tests {
+        lines := ledgerLines("user", dec(t, test.amount), dec(t, test.held), ledgerClearing)
+
+        total := decimal.Zero
+        got := map[string]string{}
+        for _, line := range lines {
+            got[line.SubAccount] = line.Amount.String()
+            total = total.Add(line.Amount)
+        }
+        if !total.IsZero() {
+            t.Errorf("%s: the lines sum to %v", test.name, total)
+        }
+        if len(got) != len(test.lines) {
+            t.Errorf("%s: got lines %v, want %v", test.name, got, test.lines)
+            continue
+        }
+        for subAccount, amount := range test.lines {
+            if got[subAccount] != amount {
+                t.Errorf("%s: %s is %s, want %s", test.name, subAccount, got[subAccount], amount)
+            }
+        }
+    }
+}
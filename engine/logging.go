@@ -16,7 +16,8 @@ var logger *log.Logger
 var client *mongo.Client
 var collection *mongo.Collection
 
-func init() {
+// connectLogger connects the order log to MongoDB, main calls it so tests of the package run without a database
+func connectLogger() {
 	// Initialize logger with desired settings, you can modify as per your requirement
 	logger = log.New(os.Stdout, "Wallet Logger: ", log.Ldate|log.Ltime|log.Lshortfile)
 
@@ -43,12 +44,12 @@ func init() {
 func LogBuyOrder(order Order) {
     var priceStr string
     if order.Price != nil {
-        priceStr = fmt.Sprintf("$%.2f", *order.Price)
+        priceStr = "$" + order.Price.StringFixed(2)
     } else {
         priceStr = "null"
     }
-    logMessage := fmt.Sprintf("Buy Order: StockTxID=%s, StockID=%s, WalletTxID=%s, Quantity=%.2f, Price=%s, TimeStamp=%s, Username=%s",
-        order.StockTxID, order.StockID, order.WalletTxID, order.Quantity, priceStr, order.TimeStamp, order.UserName)
+    logMessage := fmt.Sprintf("Buy Order: StockTxID=%s, StockID=%s, WalletTxID=%s, Quantity=%s, Price=%s, TimeStamp=%s, Username=%s",
+        order.StockTxID, order.StockID, order.WalletTxID, order.Quantity.StringFixed(2), priceStr, order.TimeStamp, order.UserName)
     _, err := collection.InsertOne(context.TODO(), bson.M{"log": logMessage})
     if err != nil {
         logger.Printf("Failed to save buy order to MongoDB: %v", err)
@@ -58,8 +59,14 @@ func LogBuyOrder(order Order) {
 
 
 func LogSellOrder(order Order) {
-    logMessage := fmt.Sprintf("Sell Order: StockTxID=%s, StockID=%s, WalletTxID=%s, Quantity=%.2f, Price=$%.2f, TimeStamp=%s, Username=%s",
-        order.StockTxID, order.StockID, order.WalletTxID, order.Quantity, order.Price, order.TimeStamp, order.UserName)
+    var priceStr string
+    if order.Price != nil {
+        priceStr = "$" + order.Price.StringFixed(2)
+    } else {
+        priceStr = "null"
+    }
+    logMessage := fmt.Sprintf("Sell Order: StockTxID=%s, StockID=%s, WalletTxID=%s, Quantity=%s, Price=%s, TimeStamp=%s, Username=%s",
+        order.StockTxID, order.StockID, order.WalletTxID, order.Quantity.StringFixed(2), priceStr, order.TimeStamp, order.UserName)
     _, err := collection.InsertOne(context.TODO(), bson.M{"log": logMessage})
     if err != nil {
         logger.Printf("Failed to save buy order to MongoDB: %v", err)
@@ -5,6 +5,8 @@ import (
     "database/sql"
     "fmt"
     "net/http"
+    "os"
+    "sort"
     "sync"
     "time"
 
@@ -14,6 +16,7 @@ import (
     "github.com/gin-gonic/gin"
     "github.com/google/uuid"
     _ "github.com/lib/pq"
+    "github.com/shopspring/decimal"
 )
 
 var user_db *sql.DB
@@ -21,23 +24,50 @@ var stock_db *sql.DB
 var tx_db *sql.DB
 
 var (
-    stmtUpdateWalletTransaction *sql.Stmt
     stmtUpdateMoneyWallet       *sql.Stmt
-    stmtCheckUserStocks         *sql.Stmt
-    stmtDeleteUserStocks        *sql.Stmt
-    stmtInsertUserStocks        *sql.Stmt
+    stmtUpdateMoneyHold         *sql.Stmt
     stmtSetWalletTransaction    *sql.Stmt
-    stmtDeleteWalletTransaction *sql.Stmt
-    stmtGetWalletTransactionsAmount *sql.Stmt
+    stmtSetWalletAdjustment     *sql.Stmt
+    stmtGetOrderWalletAmount    *sql.Stmt
     stmtSetStockTransaction     *sql.Stmt
-    stmtDeleteStockTransaction  *sql.Stmt
     stmtSetStatus               *sql.Stmt
     stmtUpdateWalletTxId        *sql.Stmt
     stmtVerifyWalletBeforeTransaction *sql.Stmt
     stmtVerifyStockBeforeTransaction  *sql.Stmt
     stmtUpdateMarketStockPrice        *sql.Stmt
-    stmtUpdateUserStocks              *sql.Stmt
+    stmtUpdateStockHold               *sql.Stmt
     stmtCheckWalletTransaction      *sql.Stmt
+    stmtGetStockSettings            *sql.Stmt
+    stmtStockExists                 *sql.Stmt
+    stmtInsertSettlementOutbox      *sql.Stmt
+    stmtUpsertStockCandle           *sql.Stmt
+    stmtGetCompletedTrades          *sql.Stmt
+    stmtInsertTrade                 *sql.Stmt
+    stmtGetTradingControls          *sql.Stmt
+    stmtSetStockHalt                *sql.Stmt
+    stmtMarkSettlementApplied       *sql.Stmt
+    stmtGetPendingSettlements       *sql.Stmt
+    stmtMarkUserSettlementApplied   *sql.Stmt
+    stmtMarkStockSettlementApplied  *sql.Stmt
+    stmtAddUserStocks               *sql.Stmt
+    stmtDeleteEmptyUserStocks       *sql.Stmt
+    stmtGetOpenOrders               *sql.Stmt
+    stmtAmendStockTransaction       *sql.Stmt
+    stmtDecrementStockTransaction   *sql.Stmt
+    stmtGetClientOrder              *sql.Stmt
+    stmtClaimClientOrder            *sql.Stmt
+    stmtReleaseClientOrder          *sql.Stmt
+    stmtInsertUserLedgerEntry       *sql.Stmt
+    stmtInsertStockLedgerEntry      *sql.Stmt
+    stmtUnbalancedUserJournals      *sql.Stmt
+    stmtUnbalancedStockJournals     *sql.Stmt
+    stmtAuditUserLedger             *sql.Stmt
+    stmtAuditStockLedger            *sql.Stmt
+    stmtGetFeeSchedule              *sql.Stmt
+    stmtGetTradingVolume            *sql.Stmt
+    stmtSetFeeTransaction           *sql.Stmt
+    stmtAddStockTransactionFee      *sql.Stmt
+    stmtGetLastTradePrice           *sql.Stmt
 )
 
 const (
@@ -66,8 +96,15 @@ type PlaceStockOrderRequest struct {
     StockID   string   `json:"stock_id" binding:"required"`
     IsBuy     *bool    `json:"is_buy" binding:"required"`
     OrderType string   `json:"order_type" binding:"required"`
-    Quantity  float64      `json:"quantity" binding:"required"`
-    Price     *float64 `json:"price"`
+    Quantity  decimal.Decimal  `json:"quantity"`
+    Price     *decimal.Decimal `json:"price"`
+    TimeInForce string `json:"time_in_force"` // GTC, DAY, IOC or FOK, LIMIT orders only (default DAY)
+    StopPrice *decimal.Decimal `json:"stop_price"` // STOP and STOP_LIMIT orders only
+    SelfTradePrevention string `json:"self_trade_prevention"` // CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT_AND_CANCEL
+    DisplayQuantity *decimal.Decimal `json:"display_quantity"` // LIMIT orders only, shows this much at a time (iceberg)
+    PostOnly   bool `json:"post_only"`   // LIMIT orders only, never takes liquidity
+    ReduceOnly bool `json:"reduce_only"` // sell orders only, capped at the shares the user can still sell
+    ClientOrderID string `json:"client_order_id" binding:"max=64"` // optional, unique per user, a retry returns the original order
 }
 
 // Define the structure of the response body for placing a stock order
@@ -78,7 +115,8 @@ type PlaceStockOrderResponse struct {
 
 // Define the structure of the request body for cancelling a stock transaction
 type CancelStockTransactionRequest struct {
-    StockTxID string `json:"stock_tx_id" binding:"required"`
+    StockTxID     string `json:"stock_tx_id"`
+    ClientOrderID string `json:"client_order_id"` // used when stock_tx_id is empty
 }
 
 // Define the structure of the response body for cancelling a stock transaction
@@ -94,24 +132,71 @@ type Order struct {
     ParentTxID *string  `json:"parent_stock_tx_id"`
     IsBuy      bool     `json:"is_buy"`
     OrderType  string   `json:"order_type"`
-    Quantity   float64  `json:"quantity"`
-    Price      *float64 `json:"price"`
+    Quantity   decimal.Decimal  `json:"quantity"`
+    Price      *decimal.Decimal `json:"price"`
     TimeStamp  string   `json:"time_stamp"`
     Status     string   `json:"status"`
     UserName   string   `json:"user_name"`
+    TimeInForce string  `json:"time_in_force"`
+    StopPrice  *decimal.Decimal `json:"stop_price"`
+    SelfTradePrevention string  `json:"self_trade_prevention"`
+
+    // Iceberg orders only: the size of each visible slice and what is still hidden behind it
+    DisplayQuantity *decimal.Decimal `json:"display_quantity,omitempty"`
+    HiddenQuantity  decimal.Decimal  `json:"-"`
+
+    PostOnly   bool `json:"post_only,omitempty"`
+    ReduceOnly bool `json:"reduce_only,omitempty"`
+    ClientOrderID string `json:"client_order_id,omitempty"`
+
+    // Market orders only: the worst price the sweep may reach and the funds reserved for it
+    ProtectionPrice *decimal.Decimal `json:"protection_price,omitempty"`
+    ReservedAmount  decimal.Decimal  `json:"-"`
+
+    // Trading fees (see fees.go): accrued and charged so far, the volume discount set by the first fill, and the fee
+    // a buy order still holds
+    FeeAccrued  decimal.Decimal  `json:"-"`
+    FeeCharged  decimal.Decimal  `json:"-"`
+    FeeDiscount *decimal.Decimal `json:"-"`
+    FeeHeld     decimal.Decimal  `json:"-"`
 }
 
-// Define the order book
+// Define the order book, it is only read and changed on its own goroutine (see books.go)
 type OrderBook struct {
-    BuyOrders  PriorityQueue
-    SellOrders PriorityQueue
-    mu         sync.Mutex
+    StockID       string
+    BuyOrders     PriorityQueue
+    SellOrders    PriorityQueue
+    TriggerOrders []*Order // STOP and STOP_LIMIT orders waiting for their stop price, oldest first
+    MatchingMode  string   // FIFO (price-time) or PRO_RATA
+    TickSize      decimal.Decimal // prices must be a multiple of it
+    LotSize       decimal.Decimal // quantities must be a multiple of it
+    Session       string          // PRE_OPEN, CONTINUOUS, CLOSING_CALL or CLOSED
+    commands      chan bookCommand
+
+    Fees FeeSchedule // trading fees, see fees.go
+
+    // price bands and halts, see halts.go
+    StaticBandPercent  decimal.Decimal
+    DynamicBandPercent decimal.Decimal
+    ReferencePrice     decimal.Decimal // price the static band is centred on
+    LastPrice          decimal.Decimal // price the dynamic band is centred on
+    LastTradePrice     decimal.Decimal // price of the last trade, stop orders trigger on it
+    Halted             bool
+    HaltedUntil        *time.Time // nil while halted until an admin resumes the stock
+    recentPrices       []tradePrice
+
+    // iceberg orders whose slice filled, refilled once the current command is done
+    icebergRefills []Order
+
+    // price levels as last streamed to market data subscribers
+    publishedBids []PriceLevel
+    publishedAsks []PriceLevel
 }
 
 // PriorityQueue
 type PriorityQueue struct {
     Order    []*Order
-    LessFunc func(i, j float64) bool
+    LessFunc func(i, j decimal.Decimal) bool
 }
 
 // handleError is a helper function to send error responses
@@ -137,13 +222,13 @@ func handleError(c *gin.Context, statusCode int, message string, err error) {
 func (pq PriorityQueue) Len() int      { return len(pq.Order) }
 func (pq PriorityQueue) Swap(i, j int) { pq.Order[i], pq.Order[j] = pq.Order[j], pq.Order[i] }
 func (pq PriorityQueue) Less(i, j int) bool {
-    if *pq.Order[i].Price == *pq.Order[j].Price {
+    if pq.Order[i].Price.Equal(*pq.Order[j].Price) {
         return pq.Order[i].TimeStamp < pq.Order[j].TimeStamp
     }
     return pq.LessFunc(*pq.Order[i].Price, *pq.Order[j].Price)
 }
-func highPriorityLess(i, j float64) bool { return i > j }
-func lowPriorityLess(i, j float64) bool  { return i < j }
+func highPriorityLess(i, j decimal.Decimal) bool { return i.GreaterThan(j) }
+func lowPriorityLess(i, j decimal.Decimal) bool  { return i.LessThan(j) }
 
 func (pq *PriorityQueue) Push(x interface{}) {
     item := x.(*Order)
@@ -178,10 +263,56 @@ func validateOrderType(request *PlaceStockOrderRequest) error {
         return fmt.Errorf("Price must be null for market orders")
     } else if request.OrderType == "LIMIT" && request.Price == nil {
         return fmt.Errorf("Price must not be null for limit orders")
+    } else if request.OrderType == "STOP" && request.Price != nil {
+        return fmt.Errorf("Price must be null for stop orders")
+    } else if request.OrderType == "STOP_LIMIT" && request.Price == nil {
+        return fmt.Errorf("Price must not be null for stop limit orders")
+    } else if request.OrderType != "MARKET" && request.OrderType != "LIMIT" && request.OrderType != "STOP" && request.OrderType != "STOP_LIMIT" {
+        return fmt.Errorf("Invalid order type, must be MARKET, LIMIT, STOP or STOP_LIMIT")
+    }
+
+    isStopOrder := request.OrderType == "STOP" || request.OrderType == "STOP_LIMIT"
+    if isStopOrder && (request.StopPrice == nil || !request.StopPrice.IsPositive()) {
+        return fmt.Errorf("Stop price must be a positive number for stop orders")
+    } else if !isStopOrder && request.StopPrice != nil {
+        return fmt.Errorf("Stop price is only allowed for stop orders")
     }
     return nil
 } // validateOrderType
 
+// validateOrderIncrements rejects quantities that are not a multiple of the stock's lot size and prices that are
+// not a multiple of its tick size, instead of letting the database round them. Nil values are not checked.
+func validateOrderIncrements(book *OrderBook, quantity *decimal.Decimal, price *decimal.Decimal, stopPrice *decimal.Decimal) error {
+    if quantity != nil {
+        if !quantity.IsPositive() {
+            return fmt.Errorf("Quantity must be a positive number")
+        }
+        if !isMultipleOf(*quantity, book.LotSize) {
+            return fmt.Errorf("Quantity must be a multiple of the lot size %s", book.LotSize)
+        }
+    }
+
+    for _, p := range []*decimal.Decimal{price, stopPrice} {
+        if p == nil {
+            continue
+        }
+        if !p.IsPositive() {
+            return fmt.Errorf("Price must be a positive number")
+        }
+        if !isMultipleOf(*p, book.TickSize) {
+            return fmt.Errorf("Price must be a multiple of the tick size %s", book.TickSize)
+        }
+    }
+    return nil
+} // validateOrderIncrements
+
+func isMultipleOf(value decimal.Decimal, increment decimal.Decimal) bool {
+    if !increment.IsPositive() {
+        return true
+    }
+    return value.Mod(increment).IsZero()
+}
+
 func createInitOrder(request *PlaceStockOrderRequest, userName string) (Order, error) {
     order := Order{
         StockTxID:  generateOrderID(),
@@ -195,6 +326,13 @@ func createInitOrder(request *PlaceStockOrderRequest, userName string) (Order, e
         TimeStamp:  time.Now().Format(time.RFC3339Nano),
         Status:     "IN_PROGRESS",
         UserName:   userName,
+        TimeInForce: request.TimeInForce,
+        StopPrice:  request.StopPrice,
+        SelfTradePrevention: request.SelfTradePrevention,
+        DisplayQuantity: request.DisplayQuantity,
+        PostOnly:   request.PostOnly,
+        ReduceOnly: request.ReduceOnly,
+        ClientOrderID: request.ClientOrderID,
     }
 
     return order, nil
@@ -219,87 +357,168 @@ func HandlePlaceStockOrder(c *gin.Context) {
         return
     }
 
-    if err := validateOrderType(&request); err != nil {
-        handleError(c, http.StatusOK, err.Error(), err)
+    order, book, orderErr := prepareStockOrder(&request, userName)
+    if orderErr != nil {
+        handleError(c, orderErr.StatusCode, orderErr.Message, orderErr.Err)
         return
     }
 
-    order, e := createInitOrder(&request, userName)
-    if e != nil {
-        handleError(c, http.StatusInternalServerError, "Failed to create order", e)
+    placed, orderErr := placeClientOrder(book, order)
+    if orderErr != nil {
+        handleError(c, orderErr.StatusCode, orderErr.Message, orderErr.Err)
         return
     }
 
+    response := PlaceStockOrderResponse{
+        Success: true,
+        Data:    placed,
+    }
+
+    c.IndentedJSON(http.StatusOK, response)
+} // HandlePlaceStockOrder
+
+// prepareStockOrder validates a request and creates its order and book, nothing is reserved or placed yet
+func prepareStockOrder(request *PlaceStockOrderRequest, userName string) (Order, *OrderBook, *OrderError) {
+    validators := []func(*PlaceStockOrderRequest) error{
+        validateOrderType,
+        validateTimeInForce,
+        validateSelfTradePrevention,
+        validateIceberg,
+        validateOrderFlags,
+    }
+    for _, validate := range validators {
+        if err := validate(request); err != nil {
+            return Order{}, nil, &OrderError{http.StatusOK, err.Error(), err}
+        }
+    }
+
+    order, e := createInitOrder(request, userName)
+    if e != nil {
+        return Order{}, nil, &OrderError{http.StatusInternalServerError, "Failed to create order", e}
+    }
+
     book, bookerr := initializePriorityQueue(order)
     if bookerr != nil {
-        handleError(c, http.StatusInternalServerError, "Failed to push order to priority queue", bookerr)
-        return
+        return Order{}, nil, &OrderError{http.StatusInternalServerError, "Failed to push order to priority queue", bookerr}
     }
 
-    if err := verifyQueueBeforeMarketTransaction(book, order); err != nil {
-        handleError(c, http.StatusBadRequest, "Fail to place Market order: ", err)
-        return
+    if err := validateOrderIncrements(book, &order.Quantity, order.Price, order.StopPrice); err != nil {
+        return Order{}, nil, &OrderError{http.StatusOK, err.Error(), err}
+    }
+    if err := validateOrderIncrements(book, order.DisplayQuantity, nil, nil); err != nil {
+        return Order{}, nil, &OrderError{http.StatusOK, err.Error(), err}
+    }
+
+    return order, book, nil
+}
+
+// OrderError carries the HTTP status and message of an order that could not be placed
+type OrderError struct {
+    StatusCode int
+    Message    string
+    Err        error
+}
+
+func (e *OrderError) Error() string {
+    if e.Err != nil {
+        return e.Message + e.Err.Error()
+    }
+    return e.Message
+}
+
+// placeOrderInBook reserves funds or stocks for a MARKET or LIMIT order, records it and matches it.
+// Must run on the book's goroutine.
+func placeOrderInBook(book *OrderBook, order Order) *OrderError {
+    if orderErr := checkSessionAccepts(book, order); orderErr != nil {
+        return orderErr
+    }
+    if orderErr := checkHaltAccepts(book, order); orderErr != nil {
+        return orderErr
+    }
+    if orderErr := applyPostOnly(book, &order); orderErr != nil {
+        return orderErr
+    }
+    if orderErr := applyReduceOnly(book, &order); orderErr != nil {
+        return orderErr
+    }
+
+    // Limit prices far from the reference or last price are rejected before anything is reserved, after a post only
+    // order was repriced
+    if order.OrderType == "LIMIT" {
+        if orderErr := checkPriceBands(book, order.Price); orderErr != nil {
+            return orderErr
+        }
     }
 
-    orderPrice := getStockOrderPrice(book, order);
-    amount := (*orderPrice) * float64(order.Quantity)
+    orderPrice := getStockOrderPrice(book, order)
+    amount := orderPrice.Mul(order.Quantity)
+
+    if order.OrderType == "MARKET" {
+        cost, protectionPrice, err := projectMarketSweep(book, order)
+        if err != nil {
+            return &OrderError{http.StatusBadRequest, "Fail to place Market order: ", err}
+        }
+        order.ProtectionPrice = protectionPrice
+        if order.IsBuy {
+            // reserve the full projected cost of walking the book, the difference is refunded after execution
+            amount = cost
+            order.ReservedAmount = cost
+        }
+    }
 
-    // to be safe, lock here
-    book.mu.Lock()
-    defer book.mu.Unlock()
+    // Fill or kill orders are rejected before anything is reserved
+    if order.TimeInForce == "FOK" && fillableQuantity(book, order).LessThan(order.Quantity) {
+        return &OrderError{http.StatusBadRequest, "Fill or kill order cannot be filled completely", nil}
+    }
 
     if order.IsBuy {
-        if err := verifyWalletBeforeTransaction(userName, book, order); err != nil {
-            handleError(c, http.StatusBadRequest, "Failed to verify Wallet", err)
-            return
+        order.FeeHeld = book.Fees.maxFee(amount)
+        if err := verifyWalletBeforeTransaction(order.UserName, amount, order.FeeHeld); err != nil {
+            return &OrderError{http.StatusBadRequest, "Failed to verify Wallet", err}
         }
 
-        if err := updateMoneyWallet(userName, amount, false); err != nil {
-            handleError(c, http.StatusInternalServerError, "Failed to deduct money from user's wallet", err)
-            return
+        // the fees are held with the reservation and paid out of the hold
+        if err := updateMoneyHold(order.UserName, amount.Add(order.FeeHeld), true); err != nil {
+            return &OrderError{http.StatusInternalServerError, "Failed to hold money in user's wallet", err}
         }
 
-        if err := setWalletTransaction(userName, order.WalletTxID, order.TimeStamp, orderPrice, order.Quantity, false); err != nil {
-            handleError(c, http.StatusInternalServerError, "Buy Order setWalletTx Error: "+err.Error(), err)
-            return
+        if err := setWalletTransaction(nil, order.UserName, order.WalletTxID, order.TimeStamp, amount, false); err != nil {
+            return &OrderError{http.StatusInternalServerError, "Buy Order setWalletTx Error: "+err.Error(), err}
         }
 
-        if err := setStockTransaction(userName, order, orderPrice, order.Quantity); err != nil {
-            handleError(c, http.StatusInternalServerError, "Buy Order setStockTx Error: "+err.Error(), err)
-            return
+        if err := setStockTransaction(nil, order.UserName, order, orderPrice, order.Quantity); err != nil {
+            return &OrderError{http.StatusInternalServerError, "Buy Order setStockTx Error: "+err.Error(), err}
         }
+        publishOrderStatus(order, order.Status)
 
+        showIcebergSlice(&order)
         processOrder(book, order)
+        cancelUnfilledRemainder(book, order)
         LogBuyOrder(order)
     } else {
-        if err := verifyStockBeforeTransaction(userName, order); err != nil {
-            handleError(c, http.StatusBadRequest, "Failed to verify stocks", err)
-            return
+        if err := verifyStockBeforeTransaction(order.UserName, order); err != nil {
+            return &OrderError{http.StatusBadRequest, "Failed to verify stocks", err}
         }
 
-        if err := updateStockPortfolio(userName, order, order.Quantity, false); err != nil {
-            handleError(c, http.StatusInternalServerError, "Failed to deduct stock from user's portfolio", err)
-            return
+        if err := updateStockHold(order.UserName, order, order.Quantity, true); err != nil {
+            return &OrderError{http.StatusInternalServerError, "Failed to hold stock in user's portfolio", err}
         }
 
-        if err := setStockTransaction(userName, order, orderPrice, order.Quantity); err != nil {
-            handleError(c, http.StatusInternalServerError, "Sell Order setStockTx Error: "+err.Error(), err)
-            return
+        if err := setStockTransaction(nil, order.UserName, order, orderPrice, order.Quantity); err != nil {
+            return &OrderError{http.StatusInternalServerError, "Sell Order setStockTx Error: "+err.Error(), err}
         }
+        publishOrderStatus(order, order.Status)
 
+        showIcebergSlice(&order)
         processOrder(book, order)
+        cancelUnfilledRemainder(book, order)
         LogSellOrder(order)
     }
 
-    response := PlaceStockOrderResponse{
-        Success: true,
-        Data:    nil,
-    }
-
-    c.IndentedJSON(http.StatusOK, response)
-} // HandlePlaceStockOrder
+    return nil
+}
 
-func TraverseOrderBook(StockTxID string, book *OrderBook, bookType string) (response CancelStockTransactionResponse) {
+func TraverseOrderBook(StockTxID string, userName string, book *OrderBook, bookType string) (response CancelStockTransactionResponse) {
     response = CancelStockTransactionResponse{
         Success: false,
         Data:    nil,
@@ -316,7 +535,7 @@ func TraverseOrderBook(StockTxID string, book *OrderBook, bookType string) (resp
     indexToRemove := -1
     removeOrder := Order{}
     for i, order := range bookOrders.Order {
-        if order.StockTxID == StockTxID && order.Status != "COMPLETED" && order.OrderType == "LIMIT" {
+        if order.StockTxID == StockTxID && order.UserName == userName && order.Status != "COMPLETED" && order.OrderType == "LIMIT" {
             indexToRemove = i
             removeOrder = *order
             break
@@ -325,14 +544,17 @@ func TraverseOrderBook(StockTxID string, book *OrderBook, bookType string) (resp
 
     // If the order was found, remove it from the heap
     if indexToRemove != -1 {
-        executeRemoveOrder(removeOrder, bookOrders, indexToRemove)
+        executeRemoveOrder(removeOrder, bookOrders, indexToRemove, "CANCELLED")
         response.Success = true
     }
 
     return response
 }
 
-func executeRemoveOrder(order Order, bookOrders *PriorityQueue, indexToRemove int) {
+// executeRemoveOrder takes an order out of the book and refunds what it still holds.
+// An order that never traded is erased, a partially filled or self-trade decremented one keeps its record and is closed
+// with status (CANCELLED or EXPIRED).
+func executeRemoveOrder(order Order, bookOrders *PriorityQueue, indexToRemove int, status string) {
     heap.Remove(bookOrders, indexToRemove)
 
     if order.IsBuy {
@@ -340,55 +562,46 @@ func executeRemoveOrder(order Order, bookOrders *PriorityQueue, indexToRemove in
     } else {
         postprocessingRemoveSellOrder(order)
     }
+
+    // the row is closed with the status, not deleted, so the order stays in the user's history
+    if err := setStatus(nil, &order, status, false); err != nil {
+        fmt.Println("Error setting status: ", err)
+    }
+    publishOrderStatus(order, status)
 }
 
 // Only for Limit orders
 func postprocessingRemoveBuyOrder(order Order) {
-    amount := (*order.Price) * float64(order.Quantity)
+    amount := order.Price.Mul(remainingQuantity(order))
+    releaseFeeHold(&order)
 
     if order.Status == "IN_PROGRESS" {
-        // refund all dedeucted money back to wallet
-        if err := updateMoneyWallet(order.UserName, amount, true); err != nil {
+        // release all held money back to the available wallet
+        if err := updateMoneyHold(order.UserName, amount, false); err != nil {
             fmt.Println("Error updating wallet: ", err)
         }
 
-        // remove transaction from wallet_transactions
-        if err := deleteWalletTransaction(order.UserName, order); err != nil {
-            fmt.Println("Error deleting wallet transaction: ", err)
-        }
-
-        // remove transaction from stock_transactions
-        if err := deleteStockTransaction(order.UserName, order); err != nil {
-            fmt.Println("Error deleting stock transaction: ", err)
+        // the released reservation is credited back against the order's wallet transaction
+        if err := settleWalletTransaction(nil, order, decimal.Zero); err != nil {
+            fmt.Println("Error adjusting wallet transaction: ", err)
         }
     } else {
         fmt.Println("Remove PARTIAL_FULFILLED buy order")
-        if err := updateMoneyWallet(order.UserName, amount, true); err != nil {
+        if err := updateMoneyHold(order.UserName, amount, false); err != nil {
             fmt.Println("Error updating wallet: ", err)
         }
 
-        // remove transaction from stock_transactions
-        if err := deleteWalletTransaction(order.UserName, order); err != nil {
-            fmt.Println("Error deleting wallet transaction: ", err)
+        // the fills have their own wallet transactions, what the order still reserved is credited back
+        if err := settleWalletTransaction(nil, order, decimal.Zero); err != nil {
+            fmt.Println("Error adjusting wallet transaction: ", err)
         }
     }
 }
 
 func postprocessingRemoveSellOrder(order Order) {
-    if order.Status == "IN_PROGRESS" {
-        // refund all dedeucted stock back to portfolio
-        if err := updateStockPortfolio(order.UserName, order, order.Quantity, true); err != nil {
-            fmt.Println("Error updating stock portfolio: ", err)
-        }
-
-        // remove transaction from stock_transactions
-        if err := deleteStockTransaction(order.UserName, order); err != nil {
-            fmt.Println("Error deleting stock transaction: ", err)
-        }
-    } else {
-        if err := updateStockPortfolio(order.UserName, order, order.Quantity, true); err != nil {
-            fmt.Println("Error updating stock portfolio: ", err)
-        }
+    // release the held stock that did not trade back to the available portfolio
+    if err := updateStockHold(order.UserName, order, remainingQuantity(order), false); err != nil {
+        fmt.Println("Error updating stock portfolio: ", err)
     }
 }
 
@@ -405,26 +618,20 @@ func HandleCancelStockTransaction(c *gin.Context) {
         return
     }
 
-    StockTxID := request.StockTxID
+    StockTxID, err := resolveStockTxID(userName.(string), request.StockTxID, request.ClientOrderID)
+    if err != nil {
+        handleError(c, http.StatusOK, err.Error(), err)
+        return
+    }
 
-    orderBookMap.mu.Lock()
-    defer orderBookMap.mu.Unlock()
-    // Find which order book the order is in
-    for _, book := range orderBookMap.OrderBooks {
-        book.mu.Lock()
-        defer book.mu.Unlock()
-
-        foundBuy := TraverseOrderBook(StockTxID, book, "buy")
-        foundSell := TraverseOrderBook(StockTxID, book, "sell")
-
-        if foundBuy.Success || foundSell.Success {
-            response := CancelStockTransactionResponse{
-                Success: true,
-                Data:    nil,
-            }
-            c.IndentedJSON(http.StatusOK, response)
-            return
+    // The order index leads straight to the book the order is in
+    if book, ok := lookupOrderBook(StockTxID); ok && book.cancelOrder(StockTxID, userName.(string)) {
+        response := CancelStockTransactionResponse{
+            Success: true,
+            Data:    nil,
         }
+        c.IndentedJSON(http.StatusOK, response)
+        return
     }
 
     errorMessage := fmt.Sprintf("Order [StockTxID: %s] not found", StockTxID)
@@ -449,19 +656,25 @@ func matchLimitBuyOrder(book *OrderBook, order Order) {
     highestBuyOrder := book.BuyOrders.Order[0]
 
     // If the buy order is a limit order, match it with the lowest sell order that is less than or equal to the buy order price
-    for highestBuyOrder.Quantity > 0 && book.SellOrders.Len() > 0 {
+    for highestBuyOrder.Quantity.IsPositive() && book.SellOrders.Len() > 0 {
         lowestSellOrder := book.SellOrders.Order[0]
 
         // If the lowest sell order price is less than or equal to the buy order price, execute the trade
-        if *lowestSellOrder.Price <= *highestBuyOrder.Price {
-            buyPrice := getStockOrderPrice(book, *highestBuyOrder);
-            sellPrice := getStockOrderPrice(book, *lowestSellOrder);
-
-            // execute the trade
-            executeBuyTrade(highestBuyOrder, lowestSellOrder, buyPrice, sellPrice)
+        if lowestSellOrder.Price.LessThanOrEqual(*highestBuyOrder.Price) {
+            // orders of the same user never trade with each other
+            if !preventSelfTrade(highestBuyOrder, lowestSellOrder) {
+                buyPrice := getStockOrderPrice(book, *highestBuyOrder)
+                sellPrice := getStockOrderPrice(book, *lowestSellOrder)
+
+                // execute the trade, a failed settlement leaves both orders untouched and stops matching
+                if err := executeBuyTrade(highestBuyOrder, lowestSellOrder, buyPrice, sellPrice); err != nil {
+                    fmt.Println("Error settling trade: ", err)
+                    break
+                }
+            }
 
             // If the sell order quantity is empty, pop it from the queue
-            if lowestSellOrder.Quantity == 0 {
+            if lowestSellOrder.Quantity.IsZero() {
                 lowestSellOrder = heap.Pop(&book.SellOrders).(*Order)
             }
         } else {
@@ -472,88 +685,150 @@ func matchLimitBuyOrder(book *OrderBook, order Order) {
     highestBuyOrder = heap.Pop(&book.BuyOrders).(*Order)
 
     // If the buy order was not fully executed, put it back in the buy queue
-    if highestBuyOrder.Quantity > 0 {
+    if highestBuyOrder.Quantity.IsPositive() {
         heap.Push(&book.BuyOrders, highestBuyOrder)
     }
 }
 
 /*
-    Assumption: The Sell order price will be equal and unchanged thoughout the trading process
-                means there is enough Sell orders quantity at the exact MARKET price to complete one Market order.
-                Thus, Cannot support Marekt order with different prices. 
-                e.g Market order Quan 100 will not work for Limit $5 with Quantity 50 and Limit $10 with Quantity 50
-    Error Handling: Refund money, remove transaction from wallet_transactions, stock_transactions, exit with error
+    The Market Buy order walks the Sell queue level by level, each fill trading at the price of the Sell order it meets.
+    e.g Market order Quan 100 against Limit $5 with Quantity 50 and Limit $10 with Quantity 50 fills 50@$5 and 50@$10
+    The sweep stops at the order's protection price, so a thin book cannot run it arbitrarily far from the top of book.
+    Funds for the whole projected sweep were reserved up front, the unused part is refunded once matching ends.
 */
 func matchMarketBuyOrder(book *OrderBook, order Order) {
-    if book.SellOrders.Len() <= 0 {
-        // refund money, remove transaction from wallet_transactions, stock_transactions, exit with error
-    }
-    // Match the buy order with the lowest Sell order that is less than or equal to the buy order price
-    for order.Quantity > 0 && book.SellOrders.Len() > 0 {
+    var spent, finalFill decimal.Decimal
+
+    // Match the buy order with the lowest Sell orders until it is filled or the protection price is reached
+    for order.Quantity.IsPositive() && book.SellOrders.Len() > 0 {
         lowestSellOrder := book.SellOrders.Order[0]
+        if !withinProtectionPrice(order, *lowestSellOrder.Price) {
+            break
+        }
 
-        buyPrice := getStockOrderPrice(book, order);
-        sellPrice := getStockOrderPrice(book, *lowestSellOrder);
+        // orders of the same user never trade with each other
+        if preventSelfTrade(&order, lowestSellOrder) {
+            if lowestSellOrder.Quantity.IsZero() {
+                heap.Pop(&book.SellOrders)
+            }
+            continue
+        }
+
+        sellPrice := getStockOrderPrice(book, *lowestSellOrder)
+        tradeQuantity := decimal.Min(order.Quantity, lowestSellOrder.Quantity)
+
+        // execute the trade at the Sell order price, so no per-fill refund is due
+        if err := executeBuyTrade(&order, lowestSellOrder, sellPrice, sellPrice); err != nil {
+            fmt.Println("Error settling trade: ", err)
+            break
+        }
+
+        finalFill = sellPrice.Mul(tradeQuantity)
+        spent = spent.Add(finalFill)
 
-        // execute the trade
-        executeBuyTrade(&order, lowestSellOrder, buyPrice, sellPrice)
-        
         // If the buy order quantity is empty, pop it from the queue
-        if lowestSellOrder.Quantity == 0 {
+        if lowestSellOrder.Quantity.IsZero() {
             lowestSellOrder = heap.Pop(&book.SellOrders).(*Order)
         }
     }
+
+    refundMarketBuyReservation(order, spent, finalFill)
 }
 
-func executeBuyTrade(buyOrder *Order, sellOrder *Order, buyPrice *float64, sellPrice *float64) {
-    tradeQuantity := min(buyOrder.Quantity, sellOrder.Quantity)
-
-    if buyOrder.Quantity > sellOrder.Quantity {
-        // execute partial trade for buy order and complete trade for sell order
-        buyOrder.Quantity -= tradeQuantity
-        sellOrder.Quantity = 0
-        partialFulfillBuyOrder(buyOrder, tradeQuantity, buyPrice, sellPrice)
-        completeSellOrder(sellOrder, tradeQuantity, sellPrice)
-    } else if buyOrder.Quantity < sellOrder.Quantity {
-        // execute partial trade for sell order and complete trade for buy order
-        sellOrder.Quantity -= tradeQuantity
-        buyOrder.Quantity = 0
-        completeBuyOrder(buyOrder, tradeQuantity, buyPrice, sellPrice)
-        partialFulfillSellOrder(sellOrder, tradeQuantity, sellPrice)
-    } else {
+// refundMarketBuyReservation returns the part of a Market Buy reservation that the sweep did not spend
+func refundMarketBuyReservation(order Order, spent decimal.Decimal, finalFill decimal.Decimal) {
+    // The order's own wallet transaction only covers its final fill, earlier fills have their own transactions.
+    // It was written with the whole projected cost, so it is adjusted even when the sweep spent all of it.
+    if err := adjustWalletTransaction(nil, order, finalFill.Sub(order.ReservedAmount)); err != nil {
+        fmt.Println("Error adjusting wallet transaction: ", err)
+    }
+
+    releaseFeeHold(&order)
+
+    refundAmount := order.ReservedAmount.Sub(spent)
+    if !refundAmount.IsPositive() {
+        return
+    }
+
+    if err := updateMoneyHold(order.UserName, refundAmount, false); err != nil {
+        fmt.Println("Error releasing unused Market order reservation: ", err)
+    }
+}
+
+// withinProtectionPrice reports whether a Market order may still trade at the given price
+func withinProtectionPrice(order Order, price decimal.Decimal) bool {
+    if order.ProtectionPrice == nil {
+        return true
+    }
+    if order.IsBuy {
+        return price.LessThanOrEqual(*order.ProtectionPrice)
+    }
+    return price.GreaterThanOrEqual(*order.ProtectionPrice)
+}
+
+func executeBuyTrade(buyOrder *Order, sellOrder *Order, buyPrice *decimal.Decimal, sellPrice *decimal.Decimal) error {
+    tradeQuantity := decimal.Min(buyOrder.Quantity, sellOrder.Quantity)
+
+    trade := newTrade(buyOrder, sellOrder, tradeQuantity, *sellPrice)
+    err := settleTrade(&trade, buyOrder, sellOrder, func(settlement *Settlement) error {
+        if buyOrder.Quantity.GreaterThan(sellOrder.Quantity) {
+            // execute partial trade for buy order and complete trade for sell order
+            buyOrder.Quantity = buyOrder.Quantity.Sub(tradeQuantity)
+            sellOrder.Quantity = decimal.Zero
+            if err := partialFulfillBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice); err != nil {
+                return err
+            }
+            return completeSellOrder(settlement, sellOrder, tradeQuantity, sellPrice)
+        } else if buyOrder.Quantity.LessThan(sellOrder.Quantity) {
+            // execute partial trade for sell order and complete trade for buy order
+            sellOrder.Quantity = sellOrder.Quantity.Sub(tradeQuantity)
+            buyOrder.Quantity = decimal.Zero
+            if err := completeBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice); err != nil {
+                return err
+            }
+            return partialFulfillSellOrder(settlement, sellOrder, tradeQuantity, sellPrice)
+        }
+
         // execute complete trade for both buy and sell orders
-        buyOrder.Quantity = 0
-        sellOrder.Quantity = 0
-        completeBuyOrder(buyOrder, tradeQuantity, buyPrice, sellPrice)
-        completeSellOrder(sellOrder, tradeQuantity, sellPrice)
+        buyOrder.Quantity = decimal.Zero
+        sellOrder.Quantity = decimal.Zero
+        if err := completeBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice); err != nil {
+            return err
+        }
+        return completeSellOrder(settlement, sellOrder, tradeQuantity, sellPrice)
+    })
+    if err != nil {
+        return err
     }
+
+    publishTrade(trade, buyOrder, sellOrder)
+    return nil
 }
 
-func completeBuyOrder(buyOrder *Order, tradeQuantity float64, buyPrice *float64, sellPrice *float64) {
+func completeBuyOrder(settlement *Settlement, buyOrder *Order, tradeQuantity decimal.Decimal, buyPrice *decimal.Decimal, sellPrice *decimal.Decimal) error {
+    // a filled iceberg slice only completes the order once its reserve is used up
+    if buyOrder.HiddenQuantity.IsPositive() {
+        return partialFulfillBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice)
+    }
+
     // Calculate refund amount
-    refundAmount := (*buyPrice - *sellPrice) * float64(tradeQuantity)
+    refundAmount := buyPrice.Sub(*sellPrice).Mul(tradeQuantity)
 
-    // Refund deducted money to the Buy user's wallet, adjusting for any price differences
-    if refundAmount > 0 {
-        if err := updateMoneyWallet(buyOrder.UserName, refundAmount, true); err != nil {
-            fmt.Println("Error updating different price refund to wallet: ", err)
-        }
+    // The hold covers the buy price, the fill is paid at the sell price and the difference becomes available again
+    settlement.spendHeldMoney(buyOrder.UserName, buyPrice.Mul(tradeQuantity), sellPrice.Mul(tradeQuantity))
 
-        // Update wallet transactions from BUY order
-        if err := updateWalletTransaction(buyOrder.UserName, *buyOrder, (*sellPrice)*tradeQuantity); err != nil {
-            fmt.Println("Error updating wallet transaction: ", err)
+    if refundAmount.IsPositive() {
+        // the BUY order's wallet transaction ends at what its last fill paid
+        if err := settleWalletTransaction(settlement.tx, *buyOrder, sellPrice.Mul(tradeQuantity)); err != nil {
+            return err
         }
     }
 
     // Update stock portfolio
-    if err := updateStockPortfolio(buyOrder.UserName, *buyOrder, tradeQuantity, true); err != nil {
-        fmt.Println("Error updating stock portfolio: ", err)
-    }
+    settlement.updateStockPortfolio(buyOrder.UserName, *buyOrder, tradeQuantity, true)
 
     // Set order status to COMPLETED
-    if err := setStatus(buyOrder, "COMPLETED", false); err != nil {
-        fmt.Println("Error setting status: ", err)
-    }
+    return setStatus(settlement.tx, buyOrder, "COMPLETED", false)
 }
 
 /** === END BUY Order === **/
@@ -572,18 +847,24 @@ func matchLimitSellOrder(book *OrderBook, order Order) {
     heap.Push(&book.SellOrders, &order)
     lowestSellOrder := book.SellOrders.Order[0]
 
-    for lowestSellOrder.Quantity > 0 && book.BuyOrders.Len() > 0 {
+    for lowestSellOrder.Quantity.IsPositive() && book.BuyOrders.Len() > 0 {
         highestBuyOrder := book.BuyOrders.Order[0]
 
         // If the lowest sell order price is less than or equal to the buy order price, execute the trade
-        if *lowestSellOrder.Price <= *highestBuyOrder.Price {
-            buyPrice := getStockOrderPrice(book, *highestBuyOrder);
-            sellPrice := getStockOrderPrice(book, *lowestSellOrder);
-
-            // execute the trade
-            executeSellTrade(highestBuyOrder, lowestSellOrder, buyPrice, sellPrice)
-            
-            if highestBuyOrder.Quantity == 0 {
+        if lowestSellOrder.Price.LessThanOrEqual(*highestBuyOrder.Price) {
+            // orders of the same user never trade with each other
+            if !preventSelfTrade(highestBuyOrder, lowestSellOrder) {
+                buyPrice := getStockOrderPrice(book, *highestBuyOrder)
+                sellPrice := getStockOrderPrice(book, *lowestSellOrder)
+
+                // execute the trade, a failed settlement leaves both orders untouched and stops matching
+                if err := executeSellTrade(highestBuyOrder, lowestSellOrder, buyPrice, sellPrice); err != nil {
+                    fmt.Println("Error settling trade: ", err)
+                    break
+                }
+            }
+
+            if highestBuyOrder.Quantity.IsZero() {
                 highestBuyOrder = heap.Pop(&book.BuyOrders).(*Order)
             }
         } else {
@@ -593,7 +874,7 @@ func matchLimitSellOrder(book *OrderBook, order Order) {
 
     lowestSellOrder = heap.Pop(&book.SellOrders).(*Order)
 
-    if lowestSellOrder.Quantity > 0 {
+    if lowestSellOrder.Quantity.IsPositive() {
         heap.Push(&book.SellOrders, lowestSellOrder)
     }
 }
@@ -601,70 +882,106 @@ func matchLimitSellOrder(book *OrderBook, order Order) {
 /*
 *
 
-    Assumption: The Buy order price will be equal and unchanged thoughout the Market trading process
-                means there is enough Buy orders quantity at the exact MARKET price to complete one Market order.
-                Thus, Cannot support Marekt order with different prices. 
-                e.g Market order Quan 100 will not work for Limit $5 with Quantity 50 and Limit $10 with Quantity 50
-    Error Handling: Refund stock, remove stock_transactions, exit with error
+    The Market Sell order walks the Buy queue level by level, each fill trading at the price of the Buy order it meets.
+    The sweep stops at the order's protection price, so a thin book cannot run it arbitrarily far from the top of book.
+    Error Handling: any quantity left once the sweep stops is refunded to the portfolio
 
 *
 */
 func matchMarketSellOrder(book *OrderBook, order Order) {
-    //TODO: refund stock, remove transaction from wallet_transactions, stock_transactions, exit with error????
-
-    // Match the Sell order with the highest Buy order that is greater than or equal to the sell order price
-    for order.Quantity > 0 && book.BuyOrders.Len() > 0 {
+    // Match the Sell order with the highest Buy orders until it is filled or the protection price is reached
+    for order.Quantity.IsPositive() && book.BuyOrders.Len() > 0 {
         highestBuyOrder := book.BuyOrders.Order[0]
+        if !withinProtectionPrice(order, *highestBuyOrder.Price) {
+            break
+        }
+
+        // orders of the same user never trade with each other
+        if preventSelfTrade(highestBuyOrder, &order) {
+            if highestBuyOrder.Quantity.IsZero() {
+                heap.Pop(&book.BuyOrders)
+            }
+            continue
+        }
 
-        buyPrice := getStockOrderPrice(book, *highestBuyOrder);
-        sellPrice := getStockOrderPrice(book, order);
+        buyPrice := getStockOrderPrice(book, *highestBuyOrder)
+        sellPrice := getStockOrderPrice(book, order)
 
         // execute the trade
-        executeSellTrade(highestBuyOrder, &order, buyPrice, sellPrice)
+        if err := executeSellTrade(highestBuyOrder, &order, buyPrice, sellPrice); err != nil {
+            fmt.Println("Error settling trade: ", err)
+            break
+        }
 
         // if highestBuyOrder.Quantity <= order.Quantity {
-        if highestBuyOrder.Quantity == 0 {
+        if highestBuyOrder.Quantity.IsZero() {
             highestBuyOrder = heap.Pop(&book.BuyOrders).(*Order)
         }
     }
+
+    refundMarketSellRemainder(order)
 }
 
-func executeSellTrade(buyOrder *Order, sellOrder *Order, buyPrice *float64, sellPrice *float64) {
-    tradeQuantity := min(buyOrder.Quantity, sellOrder.Quantity)
-
-    if buyOrder.Quantity > sellOrder.Quantity {
-        // execute partial trade for buy order and complete trade for sell order
-        buyOrder.Quantity -= tradeQuantity
-        sellOrder.Quantity = 0
-        completeSellOrder(sellOrder, tradeQuantity, sellPrice)
-        partialFulfillBuyOrder(buyOrder, tradeQuantity, buyPrice, sellPrice)
-    } else if buyOrder.Quantity < sellOrder.Quantity {
-        // execute partial trade for sell order and complete trade for buy order
-        sellOrder.Quantity -= tradeQuantity
-        buyOrder.Quantity = 0
-        completeBuyOrder(buyOrder, tradeQuantity, buyPrice, sellPrice)
-        partialFulfillSellOrder(sellOrder, tradeQuantity, sellPrice)
-    } else {
-        // execute complete trade for both buy and sell orders
-        buyOrder.Quantity = 0
-        sellOrder.Quantity = 0
-        completeBuyOrder(buyOrder, tradeQuantity, buyPrice, sellPrice)
-        completeSellOrder(sellOrder, tradeQuantity, sellPrice)
+// refundMarketSellRemainder returns the shares of a Market Sell order that the sweep could not sell
+func refundMarketSellRemainder(order Order) {
+    if !order.Quantity.IsPositive() {
+        return
     }
-}
 
-func partialFulfillSellOrder(sellOrder *Order, tradeQuantity float64, sellPrice *float64) {
-    if err := updateMarketStockPrice(sellOrder.StockID, sellPrice); err != nil {
-        fmt.Println("Failed to update Market Stock Price after Limit Sell: ", err)
+    if err := updateStockHold(order.UserName, order, order.Quantity, false); err != nil {
+        fmt.Println("Error releasing unsold Market order stocks: ", err)
     }
+}
+
+func executeSellTrade(buyOrder *Order, sellOrder *Order, buyPrice *decimal.Decimal, sellPrice *decimal.Decimal) error {
+    tradeQuantity := decimal.Min(buyOrder.Quantity, sellOrder.Quantity)
+
+    trade := newTrade(buyOrder, sellOrder, tradeQuantity, *sellPrice)
+    err := settleTrade(&trade, buyOrder, sellOrder, func(settlement *Settlement) error {
+        if buyOrder.Quantity.GreaterThan(sellOrder.Quantity) {
+            // execute partial trade for buy order and complete trade for sell order
+            buyOrder.Quantity = buyOrder.Quantity.Sub(tradeQuantity)
+            sellOrder.Quantity = decimal.Zero
+            if err := completeSellOrder(settlement, sellOrder, tradeQuantity, sellPrice); err != nil {
+                return err
+            }
+            return partialFulfillBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice)
+        } else if buyOrder.Quantity.LessThan(sellOrder.Quantity) {
+            // execute partial trade for sell order and complete trade for buy order
+            sellOrder.Quantity = sellOrder.Quantity.Sub(tradeQuantity)
+            buyOrder.Quantity = decimal.Zero
+            if err := completeBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice); err != nil {
+                return err
+            }
+            return partialFulfillSellOrder(settlement, sellOrder, tradeQuantity, sellPrice)
+        }
 
-    amount := (*sellPrice) * float64(tradeQuantity)
-    if err := updateMoneyWallet(sellOrder.UserName, amount, true); err != nil {
-        fmt.Println("Error updating wallet: ", err)
+        // execute complete trade for both buy and sell orders
+        buyOrder.Quantity = decimal.Zero
+        sellOrder.Quantity = decimal.Zero
+        if err := completeBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice); err != nil {
+            return err
+        }
+        return completeSellOrder(settlement, sellOrder, tradeQuantity, sellPrice)
+    })
+    if err != nil {
+        return err
     }
 
-    if err := setStatus(sellOrder, "PARTIAL_FULFILLED", false); err != nil {
-        fmt.Println("Error setting status: ", err)
+    publishTrade(trade, buyOrder, sellOrder)
+    return nil
+}
+
+func partialFulfillSellOrder(settlement *Settlement, sellOrder *Order, tradeQuantity decimal.Decimal, sellPrice *decimal.Decimal) error {
+    settlement.updateMarketStockPrice(sellOrder.StockID, sellPrice)
+    settlement.updateStockCandles(sellOrder.StockID, sellPrice, tradeQuantity)
+
+    amount := sellPrice.Mul(tradeQuantity)
+    settlement.updateMoneyWallet(sellOrder.UserName, amount, true)
+    settlement.spendHeldStocks(sellOrder.UserName, *sellOrder, tradeQuantity)
+
+    if err := setStatus(settlement.tx, sellOrder, "PARTIAL_FULFILLED", false); err != nil {
+        return err
     }
 
     completedOrder := Order{
@@ -682,41 +999,30 @@ func partialFulfillSellOrder(sellOrder *Order, tradeQuantity float64, sellPrice
     }
 
     // setWalletTransaction should always be before the setStockTransaction
-    if err := setWalletTransaction(sellOrder.UserName, completedOrder.WalletTxID, completedOrder.TimeStamp, sellPrice, tradeQuantity, true); err != nil {
-        fmt.Println("Error setting wallet transaction: ", err)
+    if err := setWalletTransaction(settlement.tx, sellOrder.UserName, completedOrder.WalletTxID, completedOrder.TimeStamp, amount, true); err != nil {
+        return err
     }
 
-    if err := setStockTransaction(sellOrder.UserName, completedOrder, sellPrice, tradeQuantity); err != nil {
-        fmt.Println("Error setting stock transaction: ", err)
-    }
+    return setStockTransaction(settlement.tx, sellOrder.UserName, completedOrder, sellPrice, tradeQuantity)
 }
 
-func partialFulfillBuyOrder(order *Order, tradeQuantity float64, buyPrice *float64, sellPrice *float64) {
-    refundAmount := (*buyPrice - *sellPrice) * float64(tradeQuantity)
+func partialFulfillBuyOrder(settlement *Settlement, order *Order, tradeQuantity decimal.Decimal, buyPrice *decimal.Decimal, sellPrice *decimal.Decimal) error {
+    refundAmount := buyPrice.Sub(*sellPrice).Mul(tradeQuantity)
 
-    if refundAmount > 0 {
-        newWalletTxAmount, err := getWalletTransactionsAmount(order.UserName, order.WalletTxID)
-        if err != nil {
-            fmt.Println("Error getting wallet transaction amount: ", err)
-        }
-        
-        // Refund deducted money to the Buy user's wallet, adjusting for any price differences
-        if err := updateMoneyWallet(order.UserName, refundAmount, true); err != nil {
-            fmt.Println("Error updating different price refund to wallet: ", err)
-        }
+    // The hold covers the buy price, the fill is paid at the sell price and the difference becomes available again
+    settlement.spendHeldMoney(order.UserName, buyPrice.Mul(tradeQuantity), sellPrice.Mul(tradeQuantity))
 
-        // update wallet_transactions from BUY order
-        if err := updateWalletTransaction(order.UserName, *order, newWalletTxAmount - refundAmount); err != nil {
-            fmt.Println("Error updating wallet transaction: ", err)
+    if refundAmount.IsPositive() {
+        // the price improvement is credited against the BUY order's wallet transaction
+        if err := adjustWalletTransaction(settlement.tx, *order, refundAmount.Neg()); err != nil {
+            return err
         }
     } 
 
-    if err := updateStockPortfolio(order.UserName, *order, tradeQuantity, true); err != nil {
-        fmt.Println("Error updating stock portfolio: ", err)
-    }
+    settlement.updateStockPortfolio(order.UserName, *order, tradeQuantity, true)
 
-    if err := setStatus(order, "PARTIAL_FULFILLED", false); err != nil {
-        fmt.Println("Error setting status: ", err)
+    if err := setStatus(settlement.tx, order, "PARTIAL_FULFILLED", false); err != nil {
+        return err
     }
 
     completedOrder := Order{
@@ -734,133 +1040,139 @@ func partialFulfillBuyOrder(order *Order, tradeQuantity float64, buyPrice *float
     }
 
     // setWalletTransaction should always be before the setStockTransaction
-    if err := setWalletTransaction(order.UserName, completedOrder.WalletTxID, completedOrder.TimeStamp, sellPrice, tradeQuantity, false); err != nil {
-        fmt.Println("Error setting wallet transaction: ", err)
-    }
-
-    if err := setStockTransaction(order.UserName, completedOrder, sellPrice, tradeQuantity); err != nil {
-        fmt.Println("Error setting stock transaction: ", err)
+    if err := setWalletTransaction(settlement.tx, order.UserName, completedOrder.WalletTxID, completedOrder.TimeStamp, sellPrice.Mul(tradeQuantity), false); err != nil {
+        return err
     }
 
+    return setStockTransaction(settlement.tx, order.UserName, completedOrder, sellPrice, tradeQuantity)
 }
 
-func completeSellOrder(sellOrder *Order, tradeQuantity float64, sellPrice *float64) {
-    if err := updateMarketStockPrice(sellOrder.StockID, sellPrice); err != nil {
-        fmt.Println("Failed to update Market Stock Price after Limit Sell: ", err)
+func completeSellOrder(settlement *Settlement, sellOrder *Order, tradeQuantity decimal.Decimal, sellPrice *decimal.Decimal) error {
+    // a filled iceberg slice only completes the order once its reserve is used up
+    if sellOrder.HiddenQuantity.IsPositive() {
+        return partialFulfillSellOrder(settlement, sellOrder, tradeQuantity, sellPrice)
     }
 
-    amount := (*sellPrice) * float64(tradeQuantity)
-    if err := updateMoneyWallet(sellOrder.UserName, amount, true); err != nil {
-        fmt.Println("Error updating wallet: ", err)
-    }
+    settlement.updateMarketStockPrice(sellOrder.StockID, sellPrice)
+    settlement.updateStockCandles(sellOrder.StockID, sellPrice, tradeQuantity)
 
-    if err := setStatus(sellOrder, "COMPLETED", true); err != nil {
-        fmt.Println("Error setting status: ", err)
-    }
+    amount := sellPrice.Mul(tradeQuantity)
+    settlement.updateMoneyWallet(sellOrder.UserName, amount, true)
+    settlement.spendHeldStocks(sellOrder.UserName, *sellOrder, tradeQuantity)
 
-    if err := setWalletTransaction(sellOrder.UserName, sellOrder.WalletTxID, sellOrder.TimeStamp, sellPrice, tradeQuantity, true); err != nil {
-        fmt.Println("Error setting wallet transaction: ", err)
+    if err := setStatus(settlement.tx, sellOrder, "COMPLETED", true); err != nil {
+        return err
     }
+
+    return setWalletTransaction(settlement.tx, sellOrder.UserName, sellOrder.WalletTxID, sellOrder.TimeStamp, amount, true)
 }
 
 /** === END SELL Order === **/
 
 /** === BUY/SELL Order === **/
-func updateWalletTransaction(userName string, order Order, amount float64) error {
-    // Update the wallet transaction
-    _, err := stmtUpdateWalletTransaction.Exec(amount, userName, order.WalletTxID)
-    if err != nil {
-        return fmt.Errorf("Failed to update wallet transaction: %w", err)
+// adjustWalletTransaction appends an adjusting entry to a buy order's wallet transaction instead of changing it:
+// a TRADE debit when the order takes more (delta > 0), a REFUND when it takes less. Wallet transactions are never
+// updated or deleted, what an order took is its own transaction plus the adjustments linked to it by stock_tx_id.
+func adjustWalletTransaction(tx *sql.Tx, order Order, delta decimal.Decimal) error {
+    if delta.IsZero() {
+        return nil
     }
 
+    _, err := txStmt(tx, stmtSetWalletAdjustment).Exec(generateWalletID(), order.UserName, delta.IsPositive(), delta.Abs(), time.Now().Format(time.RFC3339Nano), order.StockTxID)
+    if err != nil {
+        return fmt.Errorf("Failed to adjust wallet transaction: %w", err)
+    }
     return nil
 }
 
-func updateMoneyWallet(userName string, amount float64, isAdded bool) error {
-    // Adjust the amount based on the transaction type
-    if !isAdded {
-        amount *= -1 // Deduct funds if buying
-    }
-    _, err := stmtUpdateMoneyWallet.Exec(amount, userName)
+// settleWalletTransaction adjusts a buy order's wallet transaction until what the order took adds up to amount
+func settleWalletTransaction(tx *sql.Tx, order Order, amount decimal.Decimal) error {
+    taken, err := getOrderWalletAmount(tx, order)
     if err != nil {
-        return fmt.Errorf("Failed to update wallet: %w", err)
+        return err
     }
-    return nil
+    return adjustWalletTransaction(tx, order, amount.Sub(taken))
 }
 
-/** === END SELL Order === **/
-
-func updateStockPortfolio(userName string, order Order, quantity float64, isAdded bool) error {
-    // Calculate the total quantity to be added or deducted
-    total := quantity
-    if !isAdded {
-        total *= -1 // Reduce stocks if selling
+// updateMoneyHold holds money of the user's wallet for an order, or releases it when isHeld is false.
+// The money stays in the wallet until a fill spends it.
+func updateMoneyHold(userName string, amount decimal.Decimal, isHeld bool) error {
+    kind := "HOLD"
+    if !isHeld {
+        amount = amount.Neg() // Release funds if cancelled or refunded
+        kind = "RELEASE"
     }
 
-    // Check if user already owns this stock
-    var currentQuantity float64
-    err := stmtCheckUserStocks.QueryRow(userName, order.StockID).Scan(&currentQuantity)
-    if err != nil && err != sql.ErrNoRows {
-        return fmt.Errorf("Failed to query user stocks: %w", err)
+    tx, err := user_db.Begin()
+    if err != nil {
+        return fmt.Errorf("Failed to begin wallet hold: %w", err)
     }
+    defer tx.Rollback()
 
-    if currentQuantity+total <= 0 {
-        // Delete user's stock if the total quantity becomes zero or negative
-        _, err = stmtDeleteUserStocks.Exec(userName, order.StockID)
-    } else if currentQuantity > 0 {
-        // Update user's stock quantity
-        _, err = stmtUpdateUserStocks.Exec(total, userName, order.StockID)
-    } else {
-        // Insert new user's stock
-        _, err = stmtInsertUserStocks.Exec(userName, order.StockID, quantity)
+    if _, err := tx.Stmt(stmtUpdateMoneyHold).Exec(amount, userName); err != nil {
+        return fmt.Errorf("Failed to update wallet hold: %w", err)
     }
-    if err != nil {
-        return fmt.Errorf("Failed to update user stocks: %w", err)
+    if err := postLedgerEntry(tx, stmtInsertUserLedgerEntry, generateOrderID(), kind, ledgerCash, ledgerLines(userName, decimal.Zero, amount, "")); err != nil {
+        return err
     }
-    return nil
+    return tx.Commit()
 }
 
-// Store completed wallet transactions based on order matched
-func setWalletTransaction(userName string, walletTxID string, timestamp string, price *float64, quantity float64, isAdded bool) error {
-    amount := *price * quantity // Calculate transaction amount
-    isDebit := !isAdded         // Determine if it's a debit transaction
+/** === END SELL Order === **/
+
+// updateStockHold holds stocks of the user's portfolio for an order, or releases them when isHeld is false.
+// The stocks stay in the portfolio until a fill sells them.
+func updateStockHold(userName string, order Order, quantity decimal.Decimal, isHeld bool) error {
+    kind := "HOLD"
+    if !isHeld {
+        quantity = quantity.Neg() // Release stocks if cancelled or refunded
+        kind = "RELEASE"
+    }
 
-    _, err := stmtSetWalletTransaction.Exec(walletTxID, userName, isDebit, amount, timestamp)
+    tx, err := stock_db.Begin()
     if err != nil {
-        return fmt.Errorf("Failed to commit wallet transaction: %w", err)
+        return fmt.Errorf("Failed to begin user stocks hold: %w", err)
     }
-    return nil
+    defer tx.Rollback()
+
+    if _, err := tx.Stmt(stmtUpdateStockHold).Exec(quantity, userName, order.StockID); err != nil {
+        return fmt.Errorf("Failed to update user stocks hold: %w", err)
+    }
+    if err := postLedgerEntry(tx, stmtInsertStockLedgerEntry, generateOrderID(), kind, order.StockID, ledgerLines(userName, decimal.Zero, quantity, "")); err != nil {
+        return err
+    }
+    return tx.Commit()
 }
 
-func deleteWalletTransaction(userName string, order Order) error {
-    // Insert transaction to wallet transactions
-    _, err := stmtDeleteWalletTransaction.Exec(userName, order.WalletTxID)
+// Store completed wallet transactions based on order matched, amount is price * quantity of the fill or reservation
+func setWalletTransaction(tx *sql.Tx, userName string, walletTxID string, timestamp string, amount decimal.Decimal, isAdded bool) error {
+    isDebit := !isAdded // Determine if it's a debit transaction
+
+    _, err := txStmt(tx, stmtSetWalletTransaction).Exec(walletTxID, userName, isDebit, amount, timestamp)
     if err != nil {
-        return fmt.Errorf("Failed to delete wallet transaction: %w", err)
+        return fmt.Errorf("Failed to commit wallet transaction: %w", err)
     }
     return nil
 }
 
-func getWalletTransactionsAmount(userName string, walletTxID string) (float64, error) {
-    // Query the database to get the total amount of wallet transactions for the specified user and wallet ID
-    var totalAmount float64
-    err := stmtGetWalletTransactionsAmount.QueryRow(userName, walletTxID).Scan(&totalAmount)
+// getOrderWalletAmount returns what a buy order took from the wallet: its wallet transaction and its adjustments
+func getOrderWalletAmount(tx *sql.Tx, order Order) (decimal.Decimal, error) {
+    var totalAmount decimal.Decimal
+    err := txStmt(tx, stmtGetOrderWalletAmount).QueryRow(order.UserName, order.WalletTxID, order.StockTxID).Scan(&totalAmount)
     if err != nil {
-        return 0, fmt.Errorf("Failed to get wallet transactions amount: %w", err)
+        return decimal.Zero, fmt.Errorf("Failed to get wallet transactions amount: %w", err)
     }
 
     return totalAmount, nil
 }
 
 // Store transaction based on the order user created
-func setStockTransaction(userName string, tx Order, price *float64, quantity float64) error {
+func setStockTransaction(dbTx *sql.Tx, userName string, tx Order, price *decimal.Decimal, quantity decimal.Decimal) error {
     // Check if a wallet transaction has been made for this order yet
-    rows, err := stmtCheckWalletTransaction.Query(userName, tx.WalletTxID)
+    rows, err := txStmt(dbTx, stmtCheckWalletTransaction).Query(userName, tx.WalletTxID)
     if err != nil {
         return fmt.Errorf("Error querying wallet transactions: %w", err)
     }
-    defer rows.Close()
-
     var wallet_tx_id *string
 
     // if a wallet transaction is found in wallet_transaction table db, then add it to stock_transaction table OR,
@@ -868,47 +1180,47 @@ func setStockTransaction(userName string, tx Order, price *float64, quantity flo
     if rows.Next() || tx.Status == "COMPLETED" {
         wallet_tx_id = &tx.WalletTxID
     }
+    // close before the insert, a settlement transaction cannot run a statement while rows are still open
+    rows.Close()
 
     // Insert transaction to stock transactions
-    _, err = stmtSetStockTransaction.Exec(tx.StockTxID, userName, tx.StockID, wallet_tx_id, tx.Status, tx.ParentTxID, tx.IsBuy, tx.OrderType, *price, quantity, tx.TimeStamp)
+    _, err = txStmt(dbTx, stmtSetStockTransaction).Exec(tx.StockTxID, userName, tx.StockID, wallet_tx_id, tx.Status, tx.ParentTxID, tx.IsBuy, tx.OrderType, *price, quantity, tx.TimeStamp, tx.TimeInForce, tx.StopPrice, tx.DisplayQuantity, tx.ClientOrderID, tx.FeeHeld, tx.PostOnly, tx.ReduceOnly, tx.SelfTradePrevention)
     if err != nil {
         return fmt.Errorf("Failed to commit transaction: %w", err)
     }
     return nil
 }
 
-func deleteStockTransaction(userName string, order Order) error {
-    if order.Status != "IN_PROGRESS" {
-        return fmt.Errorf("Cannot delete completed or partially completed transactions")
-    }
-
-    // Insert transaction to wallet transactions
-    _, err := stmtDeleteStockTransaction.Exec(userName, order.StockTxID)
-    if err != nil {
-        return fmt.Errorf("Failed to delete stock transaction: %w", err)
-    }
-    return nil
-}
-
-func setStatus(order *Order, status string, isUpdateWalletTxId bool) error {
+func setStatus(tx *sql.Tx, order *Order, status string, isUpdateWalletTxId bool) error {
     if status == "PARTIAL_FULFILLED" {
         order.Status = status
     }
 
     // Insert transaction to wallet transactions
-    _, err := stmtSetStatus.Exec(status, order.UserName, order.StockTxID)
+    _, err := txStmt(tx, stmtSetStatus).Exec(status, order.UserName, order.StockTxID)
     if err != nil {
         return fmt.Errorf("Failed to update status: %w", err)
     }
 
     // assign wallet_tx_id to stock_tx_id if the Sell order is completed
     if isUpdateWalletTxId {
-        _, err = stmtUpdateWalletTxId.Exec(order.WalletTxID, order.UserName, order.StockTxID)
+        _, err = txStmt(tx, stmtUpdateWalletTxId).Exec(order.WalletTxID, order.UserName, order.StockTxID)
+        if err != nil {
+            return fmt.Errorf("Failed to update wallet transaction ID: %w", err)
+        }
     }
 
     return nil
 }
 
+// txStmt binds a prepared statement to tx when the write belongs to a settlement, a nil tx runs it on its own
+func txStmt(tx *sql.Tx, stmt *sql.Stmt) *sql.Stmt {
+    if tx == nil {
+        return stmt
+    }
+    return tx.Stmt(stmt)
+}
+
 func initializePriorityQueue(order Order) (*OrderBook, error) {
     // Add the order to the order book corresponding to the stock ID
     orderBookMap.mu.Lock()
@@ -917,16 +1229,74 @@ func initializePriorityQueue(order Order) (*OrderBook, error) {
     if !ok {
         // If the order book for this stock does not exist, create a new one
         book = &OrderBook{
-            BuyOrders:  PriorityQueue{Order: make([]*Order, 0), LessFunc: highPriorityLess},
-            SellOrders: PriorityQueue{Order: make([]*Order, 0), LessFunc: lowPriorityLess},
+            BuyOrders:    PriorityQueue{Order: make([]*Order, 0), LessFunc: highPriorityLess},
+            SellOrders:   PriorityQueue{Order: make([]*Order, 0), LessFunc: lowPriorityLess},
+            StockID:      order.StockID,
+            Session:      sessionPhaseAt(clock.Now()),
+            commands:     make(chan bookCommand, bookCommandBuffer),
         }
+        book.MatchingMode, book.TickSize, book.LotSize = getStockSettings(order.StockID)
+        loadTradingControls(book)
+        loadFeeSchedule(book)
+        loadLastTradePrice(book)
         orderBookMap.OrderBooks[order.StockID] = book
+        go book.run()
     }
     return book, nil
 }
 
+// getStockSettings returns the matching algorithm, tick size and lot size configured for a stock,
+// defaulting to FIFO, a cent and a single share
+func getStockSettings(stockID string) (string, decimal.Decimal, decimal.Decimal) {
+    var matchingMode string
+    var tickSize, lotSize decimal.Decimal
+    err := stmtGetStockSettings.QueryRow(stockID).Scan(&matchingMode, &tickSize, &lotSize)
+    if err != nil {
+        if err != sql.ErrNoRows {
+            fmt.Println("Failed to get stock settings: ", err)
+        }
+        return "FIFO", decimal.New(1, -2), decimal.NewFromInt(1)
+    }
+    return matchingMode, tickSize, lotSize
+}
+
+// knownOrderBook returns the book of a stock, creating it only if the stock exists,
+// so a lookup of an unknown stock id does not start a book for it
+func knownOrderBook(stockID string) (*OrderBook, bool, error) {
+    if book, ok := findOrderBook(stockID); ok {
+        return book, true, nil
+    }
+    var exists bool
+    if err := stmtStockExists.QueryRow(stockID).Scan(&exists); err != nil {
+        return nil, false, err
+    }
+    if !exists {
+        return nil, false, nil
+    }
+    book, err := initializePriorityQueue(Order{StockID: stockID})
+    if err != nil {
+        return nil, false, err
+    }
+    return book, true, nil
+}
+
 // ProcessOrder processes a buy or sell order based on the order type
 func processOrder(book *OrderBook, order Order) {
+    // Outside continuous trading, or while halted, orders are only collected and an auction matches them
+    if book.Session != "CONTINUOUS" || book.Halted {
+        if order.IsBuy {
+            heap.Push(&book.BuyOrders, &order)
+        } else {
+            heap.Push(&book.SellOrders, &order)
+        }
+        return
+    }
+
+    if book.MatchingMode == "PRO_RATA" {
+        matchProRataOrder(book, order)
+        return
+    }
+
     if order.IsBuy {
         if order.OrderType == "MARKET" {
             matchMarketBuyOrder(book, order)
@@ -945,7 +1315,7 @@ func processOrder(book *OrderBook, order Order) {
 // Update db of Market price of a stock X to the last sold price of a stock X
 // For UI display only, backend will NOT use the last sold price to find Market price
 // Backend will use the top of the queue for the Market price 
-func updateMarketStockPrice(stockID string, price *float64) error {
+func updateMarketStockPrice(stockID string, price *decimal.Decimal) error {
     // Update the stock price
     _, err := stmtUpdateMarketStockPrice.Exec(*price, stockID)
     if err != nil {
@@ -957,7 +1327,7 @@ func updateMarketStockPrice(stockID string, price *float64) error {
 // get stock Order price for Limit or Market order
 // if order is MARKET, get the top of the queue price
 // if order is LIMIT, get the price of the order
-func getStockOrderPrice(book *OrderBook, order Order) *float64 {
+func getStockOrderPrice(book *OrderBook, order Order) *decimal.Decimal {
     if order.OrderType == "MARKET" {
         if book.SellOrders.Len() > 0 && order.IsBuy {
             return book.SellOrders.Order[0].Price
@@ -972,12 +1342,13 @@ func getStockOrderPrice(book *OrderBook, order Order) *float64 {
 }
 
 // APRIL 10/24 - Removed join from query to support database split 
-func verifyWalletBeforeTransaction(userName string, book *OrderBook, order Order) error {
+// The wallet must cover the amount to hold and the fee held with it
+func verifyWalletBeforeTransaction(userName string, amount decimal.Decimal, fee decimal.Decimal) error {
     // Execute the SQL query
     row := stmtVerifyWalletBeforeTransaction.QueryRow(userName)
 
     // Declare variables to store the results
-    var wallet float64
+    var wallet decimal.Decimal
 
     // Scan the results into variables
     err := row.Scan(&wallet)
@@ -985,67 +1356,87 @@ func verifyWalletBeforeTransaction(userName string, book *OrderBook, order Order
         return fmt.Errorf("Failed to get user wallet: %w", err)
     }
 
-    // Calculate the order price
-    price := getStockOrderPrice(book, order)
-
     // Check if user has enough funds to buy the stock
-    if wallet < (*price)*float64(order.Quantity) {
+    if wallet.LessThan(amount) {
         return fmt.Errorf("Insufficient funds")
     }
+    if wallet.LessThan(amount.Add(fee)) {
+        return fmt.Errorf("Insufficient funds for the trading fee of %v", fee)
+    }
 
     return nil
 }
 
-func verifyQueueBeforeMarketTransaction(book *OrderBook, order Order) error {
-    if order.OrderType == "MARKET" && order.IsBuy && book.SellOrders.Len() <= 0 {
-        return fmt.Errorf("No Sell orders available")
+/*
+    projectMarketSweep walks the opposite side of the book the way a Market order would and returns the projected
+    cost of the sweep together with the protection price it may not cross.
+    The protection price is marketPriceBandPercent away from the top of book, a band of 0 disables it.
+    The order is rejected if the quantity resting within the band cannot fill it completely.
+*/
+func projectMarketSweep(book *OrderBook, order Order) (decimal.Decimal, *decimal.Decimal, error) {
+    restingOrders := book.SellOrders
+    if !order.IsBuy {
+        restingOrders = book.BuyOrders
     }
 
-    if order.OrderType == "MARKET" && !order.IsBuy && book.BuyOrders.Len() <= 0 {
-        return fmt.Errorf("No Buy orders available")
+    if order.IsBuy && restingOrders.Len() <= 0 {
+        return decimal.Zero, nil, fmt.Errorf("No Sell orders available")
     }
 
-    // check if stocks in sell orders in queue with the same price is enough to fulfill the buy order
-    // Assumption: The Market Buy order price will be equal and unchanged thoughout the trading process
-    if order.OrderType == "MARKET" && order.IsBuy {
-        var totalSellQuantity float64
-        for i := 0; i < book.SellOrders.Len(); i++ {
-            if *book.SellOrders.Order[i].Price == *(getStockOrderPrice(book, order)) {
-                totalSellQuantity += book.SellOrders.Order[i].Quantity
-            }
-        }
-        if totalSellQuantity < order.Quantity {
-            return fmt.Errorf("Insufficient Sell stocks")
+    if !order.IsBuy && restingOrders.Len() <= 0 {
+        return decimal.Zero, nil, fmt.Errorf("No Buy orders available")
+    }
+
+    // walk a sorted copy of the queue so the heap itself is left untouched
+    sweep := PriorityQueue{Order: append([]*Order(nil), restingOrders.Order...), LessFunc: restingOrders.LessFunc}
+    sort.Sort(sweep)
+
+    var protectionPrice *decimal.Decimal
+    if marketPriceBandPercent.IsPositive() {
+        band := marketPriceBandPercent.Div(decimal.NewFromInt(100))
+        price := sweep.Order[0].Price.Mul(decimal.NewFromInt(1).Add(band))
+        if !order.IsBuy {
+            price = sweep.Order[0].Price.Mul(decimal.NewFromInt(1).Sub(band))
         }
+        protectionPrice = &price
     }
 
-    // check if stocks in buy orders in queue with the same price is enough to fulfill the sell order
-    // Assumption: The Market Sell order price will be equal and unchanged thoughout the trading process
-    if order.OrderType == "MARKET" && !order.IsBuy {
-        var totalBuyQuantity float64
-        for i := 0; i < book.BuyOrders.Len(); i++ {
-            if *book.BuyOrders.Order[i].Price == *(getStockOrderPrice(book, order)) {
-                totalBuyQuantity += book.BuyOrders.Order[i].Quantity
-            }
+    remaining := order.Quantity
+    var cost decimal.Decimal
+    for _, restingOrder := range sweep.Order {
+        if !remaining.IsPositive() {
+            break
         }
-        if totalBuyQuantity < order.Quantity {
-            return fmt.Errorf("Insufficient Buy stocks")
+        if !withinProtectionPrice(Order{IsBuy: order.IsBuy, ProtectionPrice: protectionPrice}, *restingOrder.Price) {
+            break
         }
+
+        quantity := decimal.Min(remaining, restingOrder.Quantity)
+        cost = cost.Add(quantity.Mul(*restingOrder.Price))
+        remaining = remaining.Sub(quantity)
     }
-        
-    return nil
+
+    if remaining.IsPositive() && order.IsBuy {
+        return decimal.Zero, nil, fmt.Errorf("Insufficient Sell stocks within the price band")
+    }
+
+    if remaining.IsPositive() && !order.IsBuy {
+        return decimal.Zero, nil, fmt.Errorf("Insufficient Buy stocks within the price band")
+    }
+
+    return cost, protectionPrice, nil
 }
 
 func verifyStockBeforeTransaction(userName string, order Order) error {
     // Get stock id and check if it exists
-    var quantity float64
+    var quantity decimal.Decimal
     err := stmtVerifyStockBeforeTransaction.QueryRow(userName, order.StockID).Scan(&quantity)
     if err != nil {
         return fmt.Errorf("failed to get user stock portfolio: %w", err)
     }
 
     // Check if user has enough stock to sell
-    if quantity < order.Quantity {
+    if quantity.LessThan(order.Quantity) {
         return fmt.Errorf("insufficient stock")
     }
 
@@ -1053,36 +1444,24 @@ func verifyStockBeforeTransaction(userName string, order Order) error {
 }
 
 func checkAndRemoveExpiredOrders() {
-    // Iterate over each order book and check for expired orders
-    for _, book := range orderBookMap.OrderBooks {
-        book.mu.Lock()
-        defer book.mu.Unlock()
-
-        // Iterate over buy orders
-        for i := 0; i < book.BuyOrders.Len(); {
-            order := book.BuyOrders.Order[i]
-            if isOrderExpired(order) {
-                // Execute the function to remove the expired order and perform post-processing
-                executeRemoveOrder(*order, &book.BuyOrders, i)
-            } else {
-                i++
-            }
-        }
-
-        // Iterate over sell orders
-        for i := 0; i < book.SellOrders.Len(); {
-            order := book.SellOrders.Order[i]
-            if isOrderExpired(order) {
-                // Execute the function to remove the expired order and perform post-processing
-                executeRemoveOrder(*order, &book.SellOrders, i)
-            } else {
-                i++
-            }
-        }
-    }
+    // Every book expires its own orders on its own goroutine, in parallel
+    var wg sync.WaitGroup
+    for _, book := range allOrderBooks() {
+        wg.Add(1)
+        go func(book *OrderBook) {
+            defer wg.Done()
+            book.expireOrders()
+        }(book)
+    }
+    wg.Wait()
 }
 
 func isOrderExpired(order *Order) bool {
+    // Good till cancelled orders only leave the book when they are filled or cancelled
+    if order.TimeInForce == "GTC" {
+        return false
+    }
+
     // Parse the timestamp of the order
     orderTime, err := time.Parse(time.RFC3339Nano, order.TimeStamp)
     if err != nil {
@@ -1090,41 +1469,23 @@ func isOrderExpired(order *Order) bool {
         return false
     }
 
-    // Check if the order is older than 15 minutes
-    return time.Since(orderTime) > 14*time.Minute
+    // Day orders expire at the first session close after they were placed
+    return !clock.Now().Before(nextSessionClose(orderTime))
 }
 
 func prepareStatements() error {
     var err error
 
-    stmtUpdateWalletTransaction, err = tx_db.Prepare(`
-        UPDATE wallet_transactions SET amount = $1 WHERE user_name = $2 AND wallet_tx_id = $3`)
-    if err != nil {
-        return fmt.Errorf("failed to prepare update wallet transaction statement: %v", err)
-    }
-
     stmtUpdateMoneyWallet, err = user_db.Prepare(`
-        UPDATE users SET wallet = wallet + $1 WHERE user_name = $2`)
+        UPDATE users SET wallet = wallet + $1, wallet_held = wallet_held + $2 WHERE user_name = $3`)
     if err != nil {
         return fmt.Errorf("failed to prepare update money wallet statement: %v", err)
     }
 
-    stmtCheckUserStocks, err = stock_db.Prepare(`
-        SELECT quantity FROM user_stocks WHERE user_name = $1 AND stock_id = $2`)
+    stmtUpdateMoneyHold, err = user_db.Prepare(`
+        UPDATE users SET wallet_held = wallet_held + $1 WHERE user_name = $2`)
     if err != nil {
-        return fmt.Errorf("failed to prepare check user stocks statement: %v", err)
-    }
-
-    stmtDeleteUserStocks, err = stock_db.Prepare(`
-        DELETE FROM user_stocks WHERE user_name = $1 AND stock_id = $2`)
-    if err != nil {
-        return fmt.Errorf("failed to prepare delete user stocks statement: %v", err)
-    }
-
-    stmtInsertUserStocks, err = stock_db.Prepare(`
-        INSERT INTO user_stocks VALUES ($1, $2, $3)`)
-    if err != nil {
-        return fmt.Errorf("failed to prepare insert user stocks statement: %v", err)
+        return fmt.Errorf("failed to prepare update money hold statement: %v", err)
     }
 
     stmtSetWalletTransaction, err = tx_db.Prepare(`
@@ -1134,31 +1495,31 @@ func prepareStatements() error {
         return fmt.Errorf("failed to prepare set wallet transaction statement: %v", err)
     }
 
-    stmtDeleteWalletTransaction, err = tx_db.Prepare(`
-        DELETE FROM wallet_transactions WHERE user_name = $1 AND wallet_tx_id = $2`)
+    stmtSetWalletAdjustment, err = tx_db.Prepare(`
+        INSERT INTO wallet_transactions (wallet_tx_id, user_name, is_debit, amount, time_stamp, tx_type, stock_tx_id)
+        VALUES ($1, $2, $3, $4, $5, CASE WHEN $3 THEN 'TRADE' ELSE 'REFUND' END, $6)`)
     if err != nil {
-        return fmt.Errorf("failed to prepare delete wallet transaction statement: %v", err)
+        return fmt.Errorf("failed to prepare set wallet adjustment statement: %v", err)
     }
 
-    stmtGetWalletTransactionsAmount, err = tx_db.Prepare(`
-        SELECT SUM(amount) FROM wallet_transactions WHERE user_name = $1 AND wallet_tx_id = $2`)
+    stmtGetOrderWalletAmount, err = tx_db.Prepare(`
+        SELECT COALESCE(SUM(CASE WHEN is_debit THEN amount ELSE -amount END), 0) FROM wallet_transactions
+        WHERE user_name = $1 AND (wallet_tx_id = $2 OR (stock_tx_id = $3 AND tx_type IN ('TRADE', 'REFUND')))`)
     if err != nil {
-        return fmt.Errorf("failed to prepare get wallet transactions amount statement: %v", err)
+        return fmt.Errorf("failed to prepare get order wallet amount statement: %v", err)
     }
 
     stmtSetStockTransaction, err = tx_db.Prepare(`
-        INSERT INTO stock_transactions (stock_tx_id, user_name, stock_id, wallet_tx_id, order_status, parent_stock_tx_id, is_buy, order_type, stock_price, quantity,  time_stamp)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`)
+        INSERT INTO stock_transactions (stock_tx_id, user_name, stock_id, wallet_tx_id, order_status, parent_stock_tx_id, is_buy, order_type, stock_price, quantity,  time_stamp, time_in_force, stop_price, display_quantity, client_order_id, fee_held, post_only, reduce_only, self_trade_prevention)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), $13, $14, NULLIF($15, ''), $16, $17, $18, NULLIF($19, ''))
+        ON CONFLICT (stock_tx_id) DO UPDATE SET
+            wallet_tx_id = EXCLUDED.wallet_tx_id, order_status = EXCLUDED.order_status, order_type = EXCLUDED.order_type,
+            stock_price = EXCLUDED.stock_price, quantity = EXCLUDED.quantity, time_stamp = EXCLUDED.time_stamp, fee_held = EXCLUDED.fee_held
+        WHERE stock_transactions.order_status = 'PENDING_TRIGGER'`)
     if err != nil {
         return fmt.Errorf("failed to prepare set stock transaction statement: %v", err)
     }
 
-    stmtDeleteStockTransaction, err = tx_db.Prepare(`
-        DELETE FROM stock_transactions WHERE user_name = $1 AND stock_tx_id = $2`)
-    if err != nil {
-        return fmt.Errorf("failed to prepare delete stock transaction statement: %v", err)
-    }
-
     stmtSetStatus, err = tx_db.Prepare(`
         UPDATE stock_transactions SET order_status = $1 WHERE user_name = $2 AND stock_tx_id = $3`)
     if err != nil {
@@ -1172,13 +1533,13 @@ func prepareStatements() error {
     }
 
     stmtVerifyWalletBeforeTransaction, err = user_db.Prepare(`
-        SELECT wallet FROM users WHERE user_name = $1`)
+        SELECT wallet - wallet_held FROM users WHERE user_name = $1`)
     if err != nil {
         return fmt.Errorf("failed to prepare verify wallet before transaction statement: %v", err)
     }
 
     stmtVerifyStockBeforeTransaction, err = stock_db.Prepare(`
-        SELECT quantity FROM user_stocks WHERE user_name = $1 AND stock_id = $2`)
+        SELECT quantity - quantity_held FROM user_stocks WHERE user_name = $1 AND stock_id = $2`)
     if err != nil {
         return fmt.Errorf("failed to prepare verify stock before transaction statement: %v", err)
     }
@@ -1189,10 +1550,10 @@ func prepareStatements() error {
         return fmt.Errorf("failed to prepare update market stock price statement: %v", err)
     }
 
-    stmtUpdateUserStocks, err = stock_db.Prepare(`
-        UPDATE user_stocks SET quantity = quantity + $1 WHERE user_name = $2 AND stock_id = $3`)
+    stmtUpdateStockHold, err = stock_db.Prepare(`
+        UPDATE user_stocks SET quantity_held = quantity_held + $1 WHERE user_name = $2 AND stock_id = $3`)
     if err != nil {
-        return fmt.Errorf("failed to prepare update user stocks statement: %v", err)
+        return fmt.Errorf("failed to prepare update stock hold statement: %v", err)
     }
 
     stmtCheckWalletTransaction, err = tx_db.Prepare(`
@@ -1201,10 +1562,268 @@ func prepareStatements() error {
         return fmt.Errorf("failed to prepare check wallet transaction statement: %v", err)
     }
 
+    stmtGetStockSettings, err = stock_db.Prepare(`
+        SELECT matching_mode, tick_size, lot_size FROM stocks WHERE stock_id = $1`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get stock settings statement: %v", err)
+    }
+
+    stmtStockExists, err = stock_db.Prepare(`
+        SELECT EXISTS(SELECT 1 FROM stocks WHERE stock_id = $1)`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare stock exists statement: %v", err)
+    }
+
+    stmtUpsertStockCandle, err = stock_db.Prepare(`
+        INSERT INTO stock_candles (stock_id, candle_interval, bucket_start, open, high, low, close, volume, trade_count, open_time, close_time)
+        VALUES ($1, $2, $3, $4, $4, $4, $4, $5, 1, $6, $6)
+        ON CONFLICT (stock_id, candle_interval, bucket_start) DO UPDATE SET
+            open = CASE WHEN EXCLUDED.open_time < stock_candles.open_time THEN EXCLUDED.open ELSE stock_candles.open END,
+            open_time = LEAST(stock_candles.open_time, EXCLUDED.open_time),
+            high = GREATEST(stock_candles.high, EXCLUDED.high),
+            low = LEAST(stock_candles.low, EXCLUDED.low),
+            close = CASE WHEN EXCLUDED.close_time >= stock_candles.close_time THEN EXCLUDED.close ELSE stock_candles.close END,
+            close_time = GREATEST(stock_candles.close_time, EXCLUDED.close_time),
+            volume = stock_candles.volume + EXCLUDED.volume,
+            trade_count = stock_candles.trade_count + 1`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare upsert stock candle statement: %v", err)
+    }
+
+    stmtGetCompletedTrades, err = tx_db.Prepare(`
+        SELECT st.stock_id, wt.amount / (st.quantity - COALESCE(SUM(child.quantity), 0)), st.quantity - COALESCE(SUM(child.quantity), 0), st.time_stamp
+        FROM stock_transactions st
+        JOIN wallet_transactions wt ON wt.wallet_tx_id = st.wallet_tx_id
+        LEFT JOIN stock_transactions child ON child.parent_stock_tx_id = st.stock_tx_id AND child.order_status = 'COMPLETED'
+        WHERE st.is_buy = FALSE AND st.order_status = 'COMPLETED'
+        GROUP BY st.stock_tx_id, st.stock_id, wt.amount, st.quantity, st.time_stamp
+        HAVING st.quantity - COALESCE(SUM(child.quantity), 0) > 0
+        ORDER BY st.time_stamp ASC`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get completed trades statement: %v", err)
+    }
+
+    stmtInsertTrade, err = tx_db.Prepare(`
+        INSERT INTO trades (trade_id, stock_id, price, quantity, buy_stock_tx_id, sell_stock_tx_id, aggressor, time_stamp)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare insert trade statement: %v", err)
+    }
+
+    stmtGetTradingControls, err = stock_db.Prepare(`
+        SELECT COALESCE(static_band_percent, $2), COALESCE(dynamic_band_percent, $3), current_price, is_halted, halted_until
+        FROM stocks WHERE stock_id = $1`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get trading controls statement: %v", err)
+    }
+
+    stmtSetStockHalt, err = stock_db.Prepare(`
+        UPDATE stocks SET is_halted = $1, halted_until = $2 WHERE stock_id = $3`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare set stock halt statement: %v", err)
+    }
+
+    stmtInsertSettlementOutbox, err = tx_db.Prepare(`
+        INSERT INTO settlement_outbox (settlement_id, seq, kind, user_name, stock_id, amount, held, price, time_stamp)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare insert settlement outbox statement: %v", err)
+    }
+
+    stmtMarkSettlementApplied, err = tx_db.Prepare(`
+        UPDATE settlement_outbox SET status = 'APPLIED' WHERE settlement_id = $1 AND seq = $2`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare mark settlement applied statement: %v", err)
+    }
+
+    stmtGetPendingSettlements, err = tx_db.Prepare(`
+        SELECT settlement_id, seq, kind, user_name, stock_id, amount, held, price, time_stamp
+        FROM settlement_outbox
+        WHERE status = 'PENDING'
+        ORDER BY time_stamp ASC, seq ASC`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get pending settlements statement: %v", err)
+    }
+
+    stmtMarkUserSettlementApplied, err = user_db.Prepare(`
+        INSERT INTO applied_settlements (settlement_id, seq) VALUES ($1, $2) ON CONFLICT DO NOTHING`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare mark user settlement applied statement: %v", err)
+    }
+
+    stmtMarkStockSettlementApplied, err = stock_db.Prepare(`
+        INSERT INTO applied_settlements (settlement_id, seq) VALUES ($1, $2) ON CONFLICT DO NOTHING`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare mark stock settlement applied statement: %v", err)
+    }
+
+    stmtAddUserStocks, err = stock_db.Prepare(`
+        INSERT INTO user_stocks (user_name, stock_id, quantity, quantity_held) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_name, stock_id) DO UPDATE SET quantity = user_stocks.quantity + EXCLUDED.quantity,
+            quantity_held = user_stocks.quantity_held + EXCLUDED.quantity_held`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare add user stocks statement: %v", err)
+    }
+
+    stmtDeleteEmptyUserStocks, err = stock_db.Prepare(`
+        DELETE FROM user_stocks WHERE user_name = $1 AND stock_id = $2 AND quantity <= 0`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare delete empty user stocks statement: %v", err)
+    }
+
+    stmtGetOpenOrders, err = tx_db.Prepare(`
+        SELECT st.stock_tx_id, st.stock_id, st.wallet_tx_id, st.user_name, st.is_buy, st.order_type, st.order_status,
+            st.stock_price, st.quantity - COALESCE(SUM(child.quantity), 0), st.time_stamp, COALESCE(st.time_in_force, 'DAY'),
+            st.stop_price, st.display_quantity, COALESCE(st.fee, 0), COALESCE(st.fee_held, 0), COALESCE(st.client_order_id, ''),
+            COALESCE(st.post_only, FALSE), COALESCE(st.reduce_only, FALSE), COALESCE(st.self_trade_prevention, $1)
+        FROM stock_transactions st
+        LEFT JOIN stock_transactions child ON child.parent_stock_tx_id = st.stock_tx_id AND child.order_status = 'COMPLETED'
+        WHERE st.parent_stock_tx_id IS NULL
+            AND ((st.order_type = 'LIMIT' AND st.order_status IN ('IN_PROGRESS', 'PARTIAL_FULFILLED', 'STP_DECREMENTED'))
+                OR (st.order_type IN ('STOP', 'STOP_LIMIT') AND st.order_status = 'PENDING_TRIGGER'))
+        GROUP BY st.stock_tx_id, st.stock_id, st.wallet_tx_id, st.user_name, st.is_buy, st.order_type, st.order_status,
+            st.stock_price, st.quantity, st.time_stamp, st.time_in_force, st.stop_price, st.display_quantity, st.fee, st.fee_held,
+            st.client_order_id, st.post_only, st.reduce_only, st.self_trade_prevention
+        ORDER BY st.time_stamp ASC`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get open orders statement: %v", err)
+    }
+
+    stmtDecrementStockTransaction, err = tx_db.Prepare(`
+        UPDATE stock_transactions SET quantity = quantity - $1, order_status = $2 WHERE user_name = $3 AND stock_tx_id = $4`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare decrement stock transaction statement: %v", err)
+    }
+
+    stmtAmendStockTransaction, err = tx_db.Prepare(`
+        UPDATE stock_transactions SET stock_price = $1, quantity = quantity + $2, time_stamp = $3
+        WHERE user_name = $4 AND stock_tx_id = $5`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare amend stock transaction statement: %v", err)
+    }
+
+    stmtGetClientOrder, err = tx_db.Prepare(`
+        SELECT c.stock_tx_id, COALESCE(st.order_status, 'CANCELLED') FROM client_orders c
+        LEFT JOIN stock_transactions st ON st.stock_tx_id = c.stock_tx_id AND st.parent_stock_tx_id IS NULL
+        WHERE c.user_name = $1 AND c.client_order_id = $2`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get client order statement: %v", err)
+    }
+
+    stmtClaimClientOrder, err = tx_db.Prepare(`
+        INSERT INTO client_orders (user_name, client_order_id, stock_tx_id) VALUES ($1, $2, $3)
+        ON CONFLICT (user_name, client_order_id) DO NOTHING`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare claim client order statement: %v", err)
+    }
+
+    stmtReleaseClientOrder, err = tx_db.Prepare(`
+        DELETE FROM client_orders WHERE user_name = $1 AND client_order_id = $2 AND stock_tx_id = $3`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare release client order statement: %v", err)
+    }
+
+    stmtInsertUserLedgerEntry, err = user_db.Prepare(`
+        INSERT INTO ledger_entries (journal_id, account, sub_account, asset, amount, kind) VALUES ($1, $2, $3, $4, $5, $6)`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare insert user ledger entry statement: %v", err)
+    }
+
+    stmtInsertStockLedgerEntry, err = stock_db.Prepare(`
+        INSERT INTO ledger_entries (journal_id, account, sub_account, asset, amount, kind) VALUES ($1, $2, $3, $4, $5, $6)`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare insert stock ledger entry statement: %v", err)
+    }
+
+    unbalancedJournals := `
+        SELECT 'journal ' || journal_id, asset, 'sums to ' || SUM(amount)
+        FROM ledger_entries
+        GROUP BY journal_id, asset
+        HAVING SUM(amount) <> 0`
+
+    stmtUnbalancedUserJournals, err = user_db.Prepare(unbalancedJournals)
+    if err != nil {
+        return fmt.Errorf("failed to prepare unbalanced user journals statement: %v", err)
+    }
+
+    stmtUnbalancedStockJournals, err = stock_db.Prepare(unbalancedJournals)
+    if err != nil {
+        return fmt.Errorf("failed to prepare unbalanced stock journals statement: %v", err)
+    }
+
+    stmtAuditUserLedger, err = user_db.Prepare(`
+        SELECT COALESCE(u.user_name, l.account), 'CASH',
+            'wallet ' || COALESCE(u.wallet, 0) || ' held ' || COALESCE(u.wallet_held, 0) ||
+            ', ledger ' || COALESCE(l.total, 0) || ' held ' || COALESCE(l.held, 0)
+        FROM users u
+        FULL OUTER JOIN (
+            SELECT account, SUM(amount) AS total, COALESCE(SUM(amount) FILTER (WHERE sub_account = 'HELD'), 0) AS held
+            FROM ledger_entries
+            WHERE sub_account IN ('AVAILABLE', 'HELD')
+            GROUP BY account
+        ) l ON l.account = u.user_name
+        WHERE COALESCE(u.wallet, 0) <> COALESCE(l.total, 0) OR COALESCE(u.wallet_held, 0) <> COALESCE(l.held, 0)`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare audit user ledger statement: %v", err)
+    }
+
+    stmtAuditStockLedger, err = stock_db.Prepare(`
+        SELECT COALESCE(us.user_name, l.account), COALESCE(us.stock_id, l.asset),
+            'quantity ' || COALESCE(us.quantity, 0) || ' held ' || COALESCE(us.quantity_held, 0) ||
+            ', ledger ' || COALESCE(l.total, 0) || ' held ' || COALESCE(l.held, 0)
+        FROM user_stocks us
+        FULL OUTER JOIN (
+            SELECT account, asset, SUM(amount) AS total, COALESCE(SUM(amount) FILTER (WHERE sub_account = 'HELD'), 0) AS held
+            FROM ledger_entries
+            WHERE sub_account IN ('AVAILABLE', 'HELD')
+            GROUP BY account, asset
+        ) l ON l.account = us.user_name AND l.asset = us.stock_id
+        WHERE COALESCE(us.quantity, 0) <> COALESCE(l.total, 0) OR COALESCE(us.quantity_held, 0) <> COALESCE(l.held, 0)`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare audit stock ledger statement: %v", err)
+    }
+
+    stmtGetFeeSchedule, err = stock_db.Prepare(`
+        SELECT COALESCE(maker_fee_percent, $2), COALESCE(taker_fee_percent, $3), COALESCE(min_fee, $4)
+        FROM stocks WHERE stock_id = $1`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get fee schedule statement: %v", err)
+    }
+
+    // trades name the orders, the orders name their users
+    stmtGetTradingVolume, err = tx_db.Prepare(`
+        SELECT COALESCE(SUM(t.price * t.quantity), 0)
+        FROM trades t
+        WHERE t.time_stamp >= $2 AND t.trade_id <> $3
+            AND (t.buy_stock_tx_id IN (SELECT stock_tx_id FROM stock_transactions WHERE user_name = $1)
+                OR t.sell_stock_tx_id IN (SELECT stock_tx_id FROM stock_transactions WHERE user_name = $1))`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get trading volume statement: %v", err)
+    }
+
+    stmtSetFeeTransaction, err = tx_db.Prepare(`
+        INSERT INTO wallet_transactions (wallet_tx_id, user_name, is_debit, amount, time_stamp, tx_type, stock_tx_id)
+        VALUES ($1, $2, TRUE, $3, $4, 'FEE', $5)`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare set fee transaction statement: %v", err)
+    }
+
+    stmtAddStockTransactionFee, err = tx_db.Prepare(`
+        UPDATE stock_transactions SET fee = COALESCE(fee, 0) + $1, fee_held = COALESCE(fee_held, 0) + $2
+        WHERE user_name = $3 AND stock_tx_id = $4`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare add stock transaction fee statement: %v", err)
+    }
+
+    stmtGetLastTradePrice, err = tx_db.Prepare(`
+        SELECT price FROM trades WHERE stock_id = $1 ORDER BY time_stamp DESC, trade_id DESC LIMIT 1`)
+    if err != nil {
+        return fmt.Errorf("failed to prepare get last trade price statement: %v", err)
+    }
+
     return nil
 }
 
-
 func initializeDB() error {
     var err error
     postgresqlUserDbInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", user_host, user_port, user, password, dbname)
@@ -1257,6 +1876,8 @@ func initializeDB() error {
 }
 
 func main() {
+    connectLogger()
+
     err := initializeDB()
     if err != nil {
         fmt.Printf("Failed to initialize the database: %v\n", err)
@@ -1271,23 +1892,54 @@ func main() {
         fmt.Printf("Failed to prepare SQL statements: %v\n", err)
         return
     }
-    defer stmtUpdateWalletTransaction.Close()
     defer stmtUpdateMoneyWallet.Close()
-    defer stmtCheckUserStocks.Close()
-    defer stmtDeleteUserStocks.Close()
-    defer stmtInsertUserStocks.Close()
+    defer stmtUpdateMoneyHold.Close()
     defer stmtSetWalletTransaction.Close()
-    defer stmtDeleteWalletTransaction.Close()
-    defer stmtGetWalletTransactionsAmount.Close()
+    defer stmtSetWalletAdjustment.Close()
+    defer stmtGetOrderWalletAmount.Close()
     defer stmtSetStockTransaction.Close()
-    defer stmtDeleteStockTransaction.Close()
     defer stmtSetStatus.Close()
     defer stmtUpdateWalletTxId.Close()
     defer stmtVerifyWalletBeforeTransaction.Close()
     defer stmtVerifyStockBeforeTransaction.Close()
-    defer stmtUpdateUserStocks.Close()
+    defer stmtUpdateStockHold.Close()
     defer stmtCheckWalletTransaction.Close()
-
+    defer stmtGetStockSettings.Close()
+    defer stmtStockExists.Close()
+    defer stmtInsertSettlementOutbox.Close()
+    defer stmtUpsertStockCandle.Close()
+    defer stmtGetCompletedTrades.Close()
+    defer stmtInsertTrade.Close()
+    defer stmtGetTradingControls.Close()
+    defer stmtSetStockHalt.Close()
+    defer stmtMarkSettlementApplied.Close()
+    defer stmtGetPendingSettlements.Close()
+    defer stmtMarkUserSettlementApplied.Close()
+    defer stmtMarkStockSettlementApplied.Close()
+    defer stmtAddUserStocks.Close()
+    defer stmtDeleteEmptyUserStocks.Close()
+    defer stmtGetOpenOrders.Close()
+    defer stmtAmendStockTransaction.Close()
+    defer stmtDecrementStockTransaction.Close()
+    defer stmtGetClientOrder.Close()
+    defer stmtClaimClientOrder.Close()
+    defer stmtReleaseClientOrder.Close()
+    defer stmtInsertUserLedgerEntry.Close()
+    defer stmtInsertStockLedgerEntry.Close()
+    defer stmtUnbalancedUserJournals.Close()
+    defer stmtUnbalancedStockJournals.Close()
+    defer stmtAuditUserLedger.Close()
+    defer stmtAuditStockLedger.Close()
+    defer stmtGetFeeSchedule.Close()
+    defer stmtGetTradingVolume.Close()
+    defer stmtSetFeeTransaction.Close()
+    defer stmtAddStockTransactionFee.Close()
+    defer stmtGetLastTradePrice.Close()
+
+    // `engine audit` checks the ledger and exits instead of serving
+    if len(os.Args) > 1 && os.Args[1] == "audit" {
+        os.Exit(runLedgerAudit())
+    }
 
     user_db.SetMaxOpenConns(10) // Set maximum number of open connections
     user_db.SetMaxIdleConns(5) // Set maximum number of idle connections
@@ -1298,6 +1950,23 @@ func main() {
     tx_db.SetMaxOpenConns(10) // Set maximum number of open connections
     tx_db.SetMaxIdleConns(5) // Set maximum number of idle connections
 
+    // Repair fills that were committed but not fully applied before the last shutdown
+    reconcileSettlements()
+    go runSettlementWorker()
+
+    // Rebuild the resting orders that were in the books before the last shutdown
+    if err := restoreOrderBooks(); err != nil {
+        fmt.Printf("Failed to restore order books: %v\n", err)
+        return
+    }
+
+    // Rebuild the candles from the completed trades, e.g. after the candle tables were first added
+    if candleBackfill {
+        if err := backfillStockCandles(); err != nil {
+            fmt.Printf("Failed to backfill stock candles: %v\n", err)
+        }
+    }
+
     router := gin.Default()
 
     config := cors.DefaultConfig()
@@ -1309,13 +1978,27 @@ func main() {
 
     identification.Test()
     router.POST("/placeStockOrder", identification.Identification, HandlePlaceStockOrder)
+    router.POST("/placeStockOrders", identification.Identification, HandlePlaceStockOrders)
     router.POST("/cancelStockTransaction", identification.Identification, HandleCancelStockTransaction)
+    router.POST("/cancelAllOrders", identification.Identification, HandleCancelAllOrders)
+    router.POST("/modifyStockOrder", identification.Identification, HandleModifyStockOrder)
+    router.GET("/getOrderBook", identification.Identification, HandleGetOrderBook)
+    router.GET("/getAuctionIndicative", identification.Identification, HandleGetAuctionIndicative)
+    router.POST("/haltStock", identification.Identification, HandleHaltStock)
+    router.POST("/resumeStock", identification.Identification, HandleResumeStock)
+    router.GET("/auditLedger", identification.Identification, HandleAuditLedger)
+    router.GET("/streamMarketData", HandleStreamMarketData)
+    router.GET("/streamOrders", identification.Identification, HandleStreamOrders)
+
+    // Move the books through the trading session, its auctions and timed halts
+    go runSessionScheduler()
 
     // Start a background goroutine to periodically check and remove expired orders
     go func() {
         for {
             time.Sleep(time.Minute)
             checkAndRemoveExpiredOrders()
+            reconcileSettlements()
         }
     }()
 
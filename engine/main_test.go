@@ -0,0 +1,218 @@
+package main
+
+import (
+    "container/heap"
+    "encoding/json"
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+// dec parses a decimal literal of a test case
+func dec(t *testing.T, value string) decimal.Decimal {
+    t.Helper()
+    parsed, err := decimal.NewFromString(value)
+    if err != nil {
+        t.Fatalf("invalid decimal %q: %v", value, err)
+    }
+    return parsed
+}
+
+// limitOrder builds a resting LIMIT order, time stamps order orders of the same price
+func limitOrder(t *testing.T, id string, isBuy bool, price string, quantity string, timeStamp string) *Order {
+    t.Helper()
+    orderPrice := dec(t, price)
+    return &Order{
+        StockTxID: id,
+        StockID:   "stock",
+        IsBuy:     isBuy,
+        OrderType: "LIMIT",
+        Quantity:  dec(t, quantity),
+        Price:     &orderPrice,
+        TimeStamp: timeStamp,
+        UserName:  "user-" + id,
+    }
+}
+
+// icebergOrder builds a resting iceberg LIMIT order showing display of its quantity
+func icebergOrder(t *testing.T, id string, isBuy bool, price string, quantity string, display string, timeStamp string) *Order {
+    t.Helper()
+    order := limitOrder(t, id, isBuy, price, quantity, timeStamp)
+    displayQuantity := dec(t, display)
+    order.DisplayQuantity = &displayQuantity
+    showIcebergSlice(order)
+    return order
+}
+
+// bookSide pushes orders into a side of a book the way the engine does
+func bookSide(isBuy bool, orders ...*Order) PriorityQueue {
+    queue := PriorityQueue{LessFunc: lowPriorityLess}
+    if isBuy {
+        queue.LessFunc = highPriorityLess
+    }
+    for _, order := range orders {
+        heap.Push(&queue, order)
+    }
+    return queue
+}
+
+// registerBook adds a book to the engine's books for the duration of a test
+func registerBook(t *testing.T, book *OrderBook) {
+    t.Helper()
+    orderBookMap.mu.Lock()
+    orderBookMap.OrderBooks[book.StockID] = book
+    orderBookMap.mu.Unlock()
+    t.Cleanup(func() {
+        orderBookMap.mu.Lock()
+        delete(orderBookMap.OrderBooks, book.StockID)
+        orderBookMap.mu.Unlock()
+    })
+}
+
+func TestPriorityQueueOrdersByPriceThenTime(t *testing.T) {
+    sells := bookSide(false,
+        limitOrder(t, "a", false, "10.5", "1", "3"),
+        limitOrder(t, "b", false, "10", "1", "2"),
+        limitOrder(t, "c", false, "10", "1", "1"),
+        limitOrder(t, "d", false, "11", "1", "0"),
+    )
+
+    want := []string{"c", "b", "a", "d"}
+    for _, id := range want {
+        order := heap.Pop(&sells).(*Order)
+        if order.StockTxID != id {
+            t.Fatalf("popped %s, want %s", order.StockTxID, id)
+        }
+    }
+}
+
+func TestProjectMarketSweep(t *testing.T) {
+    saved := marketPriceBandPercent
+    defer func() { marketPriceBandPercent = saved }()
+    marketPriceBandPercent = dec(t, "10")
+
+    book := &OrderBook{
+        StockID: "stock",
+        SellOrders: bookSide(false,
+            limitOrder(t, "a", false, "11", "100", "1"),
+            limitOrder(t, "b", false, "10", "50", "2"),
+            limitOrder(t, "c", false, "12", "100", "3"),
+            limitOrder(t, "d", false, "10.5", "30", "4"),
+        ),
+        BuyOrders: bookSide(true),
+    }
+
+    buy := Order{IsBuy: true, OrderType: "MARKET", Quantity: dec(t, "100")}
+    cost, protectionPrice, err := projectMarketSweep(book, buy)
+    if err != nil {
+        t.Fatalf("projecting a sweep of 100: %v", err)
+    }
+    // 50 @ 10, 30 @ 10.5 and 20 @ 11
+    if !cost.Equal(dec(t, "1035")) {
+        t.Errorf("a sweep of 100 costs %v, want 1035", cost)
+    }
+    if protectionPrice == nil || !protectionPrice.Equal(dec(t, "11")) {
+        t.Errorf("the protection price is %v, want 11", protectionPrice)
+    }
+    if book.SellOrders.Order[0].StockTxID != "b" || book.SellOrders.Len() != 4 {
+        t.Errorf("projecting a sweep changed the book")
+    }
+
+    // 12 is outside the band, so only 180 can fill
+    buy.Quantity = dec(t, "200")
+    if _, _, err := projectMarketSweep(book, buy); err == nil {
+        t.Errorf("a sweep past the protection price was accepted")
+    }
+
+    sell := Order{IsBuy: false, OrderType: "MARKET", Quantity: dec(t, "1")}
+    if _, _, err := projectMarketSweep(book, sell); err == nil {
+        t.Errorf("a sell was accepted against an empty bid side")
+    }
+
+    marketPriceBandPercent = decimal.Zero
+    if cost, protectionPrice, err := projectMarketSweep(book, buy); err != nil || protectionPrice != nil || !cost.Equal(dec(t, "2155")) {
+        t.Errorf("without a band a sweep of 200 costs %v (protection %v, %v), want 2155", cost, protectionPrice, err)
+    }
+}
+
+func TestWithinProtectionPrice(t *testing.T) {
+    protection := dec(t, "11")
+    buy := Order{IsBuy: true, ProtectionPrice: &protection}
+    sell := Order{IsBuy: false, ProtectionPrice: &protection}
+
+    if !withinProtectionPrice(buy, dec(t, "11")) || withinProtectionPrice(buy, dec(t, "11.01")) {
+        t.Errorf("a buy may trade up to its protection price only")
+    }
+    if !withinProtectionPrice(sell, dec(t, "11")) || withinProtectionPrice(sell, dec(t, "10.99")) {
+        t.Errorf("a sell may trade down to its protection price only")
+    }
+    if !withinProtectionPrice(Order{IsBuy: true}, dec(t, "1000")) {
+        t.Errorf("an order without a protection price was limited")
+    }
+}
+
+func TestValidateOrderIncrements(t *testing.T) {
+    book := &OrderBook{StockID: "stock", TickSize: dec(t, "0.05"), LotSize: dec(t, "10")}
+
+    tests := []struct {
+        quantity string
+        price    string
+        valid    bool
+    }{
+        {"20", "10.05", true},
+        {"25", "10.05", false},
+        {"0", "10.05", false},
+        {"20", "10.01", false},
+        {"20", "-10", false},
+        {"20", "", true},
+    }
+    for _, test := range tests {
+        quantity := dec(t, test.quantity)
+        var price *decimal.Decimal
+        if test.price != "" {
+            parsed := dec(t, test.price)
+            price = &parsed
+        }
+        if err := validateOrderIncrements(book, &quantity, price, nil); (err == nil) != test.valid {
+            t.Errorf("%s @ %q: valid is %v, want %v (%v)", test.quantity, test.price, err == nil, test.valid, err)
+        }
+    }
+}
+
+func TestMoneyIsExact(t *testing.T) {
+    // 0.1 + 0.2 is not 0.3 in floating point, it must be in the engine's arithmetic
+    price := dec(t, "0.1").Add(dec(t, "0.2"))
+    if !price.Equal(dec(t, "0.3")) {
+        t.Errorf("0.1 + 0.2 is %v", price)
+    }
+    if cost := dec(t, "19.99").Mul(dec(t, "3")); !cost.Equal(dec(t, "59.97")) {
+        t.Errorf("3 @ 19.99 costs %v, want 59.97", cost)
+    }
+
+    encoded, err := json.Marshal(struct {
+        Price decimal.Decimal `json:"price"`
+    }{dec(t, "10.50")})
+    if err != nil || string(encoded) != `{"price":10.5}` {
+        t.Errorf("a price is written as %s (%v), want a JSON number", encoded, err)
+    }
+}
+
+func TestAHoldStaysInTheWallet(t *testing.T) {
+    // holding 52 moves it from the available to the held part of the wallet, the balance does not change
+    hold := ledgerLines("buyer", decimal.Zero, dec(t, "52"), "")
+    if len(hold) != 2 || hold[0].SubAccount != "AVAILABLE" || !hold[0].Amount.Equal(dec(t, "-52")) || hold[1].SubAccount != "HELD" || !hold[1].Amount.Equal(dec(t, "52")) {
+        t.Errorf("a hold posts %+v, want 52 from AVAILABLE to HELD", hold)
+    }
+
+    // a fill of 50 spends the hold, the 2 left over become available again
+    s := &Settlement{}
+    s.spendHeldMoney("buyer", dec(t, "52"), dec(t, "50"))
+    fill := ledgerLines("buyer", s.effects[0].Amount, s.effects[0].Held, ledgerClearing)
+    balances := map[string]decimal.Decimal{}
+    for _, line := range append(hold, fill...) {
+        balances[line.SubAccount] = balances[line.SubAccount].Add(line.Amount)
+    }
+    if !balances["AVAILABLE"].Equal(dec(t, "-50")) || !balances["HELD"].IsZero() {
+        t.Errorf("after the fill the wallet changed by %v available and %v held, want -50 and 0", balances["AVAILABLE"], balances["HELD"])
+    }
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Streaming over Server-Sent Events.
+
+    /streamMarketData?stock_id= is the public feed of a stock: every trade, every change of the best bid or ask
+    (top_of_book) and the price levels that changed since the last event (depth, a level with quantity 0 is gone).
+    Depth covers the best MARKET_DATA_DEPTH levels of each side, a level pushed out of them is reported as gone.
+    The first event is a snapshot of those levels. Every event carries the stock's sequence number, which goes up
+    by one per event, so a client that sees a gap knows it missed something and subscribes again for a new snapshot.
+
+    /streamOrders is the private feed of the authenticated user: every status transition of their own orders
+    (IN_PROGRESS, PENDING_TRIGGER, PARTIAL_FULFILLED, COMPLETED, CANCELLED, EXPIRED, REJECTED, STP_*), with a
+    sequence number per user.
+
+    Market data events of a stock are only published from its book's goroutine, and subscribing runs there too,
+    so the snapshot and the events that follow it line up exactly. A subscriber that cannot keep up is dropped.
+*/
+type StreamEvent struct {
+    Type     string      `json:"type"`
+    Sequence uint64      `json:"seq"`
+    Time     string      `json:"time_stamp"`
+    Data     interface{} `json:"data"`
+}
+
+// StreamHub fans events out to the subscribers of a key (a stock ID or a user name)
+type StreamHub struct {
+    subscribers map[string]map[chan StreamEvent]struct{}
+    sequences   map[string]uint64
+    mu          sync.Mutex
+}
+
+const (
+    streamBuffer            = 256
+    streamHeartbeatInterval = 15 * time.Second
+)
+
+var marketDataHub = newStreamHub()
+var orderStatusHub = newStreamHub()
+
+func newStreamHub() *StreamHub {
+    return &StreamHub{
+        subscribers: make(map[string]map[chan StreamEvent]struct{}),
+        sequences:   make(map[string]uint64),
+    }
+}
+
+// subscribe registers a new subscriber and returns the sequence number of the last event published for key
+func (hub *StreamHub) subscribe(key string) (chan StreamEvent, uint64) {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+
+    events := make(chan StreamEvent, streamBuffer)
+    if hub.subscribers[key] == nil {
+        hub.subscribers[key] = make(map[chan StreamEvent]struct{})
+    }
+    hub.subscribers[key][events] = struct{}{}
+    return events, hub.sequences[key]
+}
+
+func (hub *StreamHub) unsubscribe(key string, events chan StreamEvent) {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+
+    // a slow subscriber may already have been dropped by publish
+    if _, ok := hub.subscribers[key][events]; ok {
+        delete(hub.subscribers[key], events)
+        close(events)
+    }
+}
+
+func (hub *StreamHub) publish(key string, eventType string, data interface{}) {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+
+    hub.sequences[key]++
+    event := StreamEvent{
+        Type:     eventType,
+        Sequence: hub.sequences[key],
+        Time:     time.Now().Format(time.RFC3339Nano),
+        Data:     data,
+    }
+
+    for events := range hub.subscribers[key] {
+        select {
+        case events <- event:
+        default:
+            // the subscriber fell behind, closing its stream tells it to subscribe again
+            delete(hub.subscribers[key], events)
+            close(events)
+        }
+    }
+}
+
+// TradeEvent is a fill between two orders, the aggressor is the side of the newest order
+type TradeEvent struct {
+    TradeID   string          `json:"trade_id"`
+    StockID   string          `json:"stock_id"`
+    Price     decimal.Decimal `json:"price"`
+    Quantity  decimal.Decimal `json:"quantity"`
+    Aggressor string          `json:"aggressor"` // BUY or SELL
+}
+
+// TopOfBookEvent is the best bid and ask, nil when that side of the book is empty
+type TopOfBookEvent struct {
+    StockID string      `json:"stock_id"`
+    Bid     *PriceLevel `json:"bid"`
+    Ask     *PriceLevel `json:"ask"`
+}
+
+// OrderStatusEvent is a status transition of one order, Quantity is what is left of it
+type OrderStatusEvent struct {
+    StockTxID string           `json:"stock_tx_id"`
+    StockID   string           `json:"stock_id"`
+    IsBuy     bool             `json:"is_buy"`
+    OrderType string           `json:"order_type"`
+    Status    string           `json:"status"`
+    Quantity  decimal.Decimal  `json:"quantity"`
+    Price     *decimal.Decimal `json:"price"`
+}
+
+// publishTrade reports a settled fill on the stock's feed and to the owners of both orders
+func publishTrade(trade Trade, buyOrder *Order, sellOrder *Order) {
+    marketDataHub.publish(trade.StockID, "trade", TradeEvent{
+        TradeID:   trade.TradeID,
+        StockID:   trade.StockID,
+        Price:     trade.Price,
+        Quantity:  trade.Quantity,
+        Aggressor: trade.Aggressor,
+    })
+
+    for _, order := range []*Order{buyOrder, sellOrder} {
+        status := "PARTIAL_FULFILLED"
+        if remainingQuantity(*order).IsZero() {
+            status = "COMPLETED"
+        }
+        publishOrderStatus(*order, status)
+    }
+}
+
+func publishOrderStatus(order Order, status string) {
+    orderStatusHub.publish(order.UserName, "order", OrderStatusEvent{
+        StockTxID: order.StockTxID,
+        StockID:   order.StockID,
+        IsBuy:     order.IsBuy,
+        OrderType: order.OrderType,
+        Status:    status,
+        Quantity:  order.Quantity,
+        Price:     order.Price,
+    })
+}
+
+// publishBookChanges compares the top marketDataDepth levels of the book with what was last published and reports the
+// difference. Must run on the book's goroutine.
+func (book *OrderBook) publishBookChanges() {
+    bids := aggregatePriceLevels(book.BuyOrders, marketDataDepth)
+    asks := aggregatePriceLevels(book.SellOrders, marketDataDepth)
+
+    changedBids := diffPriceLevels(book.publishedBids, bids)
+    changedAsks := diffPriceLevels(book.publishedAsks, asks)
+    if len(changedBids) == 0 && len(changedAsks) == 0 {
+        return
+    }
+
+    topChanged := !samePriceLevel(topPriceLevel(book.publishedBids), topPriceLevel(bids)) ||
+        !samePriceLevel(topPriceLevel(book.publishedAsks), topPriceLevel(asks))
+
+    book.publishedBids, book.publishedAsks = bids, asks
+
+    if topChanged {
+        marketDataHub.publish(book.StockID, "top_of_book", TopOfBookEvent{
+            StockID: book.StockID,
+            Bid:     topPriceLevel(bids),
+            Ask:     topPriceLevel(asks),
+        })
+    }
+    marketDataHub.publish(book.StockID, "depth", OrderBookDepth{
+        StockID: book.StockID,
+        Bids:    changedBids,
+        Asks:    changedAsks,
+    })
+}
+
+// diffPriceLevels returns the levels that are new or changed, and the removed ones with quantity 0
+func diffPriceLevels(previous []PriceLevel, current []PriceLevel) []PriceLevel {
+    previousLevels := make(map[string]PriceLevel, len(previous))
+    for _, level := range previous {
+        previousLevels[level.Price.String()] = level
+    }
+
+    changed := make([]PriceLevel, 0)
+    for _, level := range current {
+        key := level.Price.String()
+        if old, ok := previousLevels[key]; !ok || !samePriceLevel(&old, &level) {
+            changed = append(changed, level)
+        }
+        delete(previousLevels, key)
+    }
+    for _, removed := range previousLevels {
+        changed = append(changed, PriceLevel{Price: removed.Price, Quantity: decimal.Zero})
+    }
+    return changed
+}
+
+func topPriceLevel(levels []PriceLevel) *PriceLevel {
+    if len(levels) == 0 {
+        return nil
+    }
+    return &levels[0]
+}
+
+func samePriceLevel(a *PriceLevel, b *PriceLevel) bool {
+    if a == nil || b == nil {
+        return a == b
+    }
+    return a.Price.Equal(b.Price) && a.Quantity.Equal(b.Quantity) && a.OrderCount == b.OrderCount
+}
+
+// subscribeMarketData subscribes to a stock's feed together with a snapshot of the top of its book
+func (book *OrderBook) subscribeMarketData() (events chan StreamEvent, snapshot StreamEvent) {
+    book.execute(func(book *OrderBook) {
+        var sequence uint64
+        events, sequence = marketDataHub.subscribe(book.StockID)
+        snapshot = StreamEvent{
+            Type:     "snapshot",
+            Sequence: sequence,
+            Time:     time.Now().Format(time.RFC3339Nano),
+            Data: OrderBookDepth{
+                StockID: book.StockID,
+                Bids:    aggregatePriceLevels(book.BuyOrders, marketDataDepth),
+                Asks:    aggregatePriceLevels(book.SellOrders, marketDataDepth),
+            },
+        }
+    })
+    return events, snapshot
+}
+
+// HandleStreamMarketData is public, since an EventSource cannot send the token header
+func HandleStreamMarketData(c *gin.Context) {
+    stockID := c.Query("stock_id")
+    if stockID == "" {
+        handleError(c, http.StatusBadRequest, "stock_id is required", nil)
+        return
+    }
+
+    book, ok, err := knownOrderBook(stockID)
+    if err != nil {
+        handleError(c, http.StatusInternalServerError, "Failed to get order book", err)
+        return
+    }
+    if !ok {
+        handleError(c, http.StatusNotFound, "Stock not found", nil)
+        return
+    }
+
+    events, snapshot := book.subscribeMarketData()
+    defer marketDataHub.unsubscribe(stockID, events)
+
+    streamEvents(c, events, &snapshot)
+}
+
+func HandleStreamOrders(c *gin.Context) {
+    userName, exists := c.Get("user_name")
+    if !exists || userName == nil {
+        handleError(c, http.StatusUnauthorized, "User not authenticated", nil)
+        return
+    }
+
+    events, _ := orderStatusHub.subscribe(userName.(string))
+    defer orderStatusHub.unsubscribe(userName.(string), events)
+
+    streamEvents(c, events, nil)
+}
+
+// streamEvents writes the first event (if any) and then every event of the subscription until either side closes it
+func streamEvents(c *gin.Context, events chan StreamEvent, first *StreamEvent) {
+    // the reverse proxy must pass events through as they are written
+    c.Header("X-Accel-Buffering", "no")
+    c.Header("Cache-Control", "no-cache")
+
+    heartbeat := time.NewTicker(streamHeartbeatInterval)
+    defer heartbeat.Stop()
+
+    c.Stream(func(w io.Writer) bool {
+        if first != nil {
+            c.SSEvent(first.Type, first)
+            first = nil
+            return true
+        }
+
+        select {
+        case event, ok := <-events:
+            if !ok {
+                return false
+            }
+            c.SSEvent(event.Type, event)
+            return true
+        case <-heartbeat.C:
+            c.SSEvent("heartbeat", gin.H{"time_stamp": time.Now().Format(time.RFC3339Nano)})
+            return true
+        case <-c.Request.Context().Done():
+            return false
+        }
+    })
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+    "container/heap"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/shopspring/decimal"
+)
+
+// Define the structure of the request body for modifying a resting order, omitted fields keep their current value
+type ModifyStockOrderRequest struct {
+    StockTxID string           `json:"stock_tx_id"`
+    ClientOrderID string       `json:"client_order_id"` // used when stock_tx_id is empty
+    Price     *decimal.Decimal `json:"price"`
+    Quantity  *decimal.Decimal `json:"quantity"` // remaining quantity of the order
+}
+
+// Define the structure of the response body for modifying a resting order
+type ModifyStockOrderResponse struct {
+    Success bool        `json:"success"`
+    Data    interface{} `json:"data"`
+}
+
+func HandleModifyStockOrder(c *gin.Context) {
+    userName, exists := c.Get("user_name")
+    if !exists || userName == nil {
+        handleError(c, http.StatusUnauthorized, "User not authenticated", nil)
+        return
+    }
+
+    var request ModifyStockOrderRequest
+    if err := c.ShouldBindJSON(&request); err != nil {
+        handleError(c, http.StatusBadRequest, "Invalid request body", err)
+        return
+    }
+
+    if request.Price == nil && request.Quantity == nil {
+        handleError(c, http.StatusBadRequest, "Price or quantity must be provided", nil)
+        return
+    }
+
+    StockTxID, err := resolveStockTxID(userName.(string), request.StockTxID, request.ClientOrderID)
+    if err != nil {
+        handleError(c, http.StatusOK, err.Error(), err)
+        return
+    }
+    request.StockTxID = StockTxID
+
+    // The order index leads straight to the book the order is in
+    if book, ok := lookupOrderBook(request.StockTxID); ok {
+        if err := validateOrderIncrements(book, request.Quantity, request.Price, nil); err != nil {
+            handleError(c, http.StatusBadRequest, err.Error(), err)
+            return
+        }
+
+        order, orderErr, found := book.modifyOrder(request, userName.(string))
+        if orderErr != nil {
+            handleError(c, orderErr.StatusCode, orderErr.Message, orderErr.Err)
+            return
+        }
+
+        if found {
+            response := ModifyStockOrderResponse{
+                Success: true,
+                Data:    order,
+            }
+            c.IndentedJSON(http.StatusOK, response)
+            return
+        }
+    }
+
+    errorMessage := fmt.Sprintf("Order [StockTxID: %s] not found", request.StockTxID)
+    handleError(c, http.StatusOK, errorMessage, nil)
+}
+
+// findRestingOrder returns the index of a user's resting LIMIT order in the queue, or -1
+func findRestingOrder(bookOrders *PriorityQueue, StockTxID string, userName string) int {
+    for i, order := range bookOrders.Order {
+        if order.StockTxID == StockTxID && order.UserName == userName && order.OrderType == "LIMIT" {
+            return i
+        }
+    }
+    return -1
+}
+
+/*
+    modifyRestingOrder amends the price and/or remaining quantity of a resting LIMIT order in place.
+    The wallet reservation (buy) or stock hold (sell) is adjusted by the delta before the order changes.
+    Priority: a quantity decrease keeps the order's place in the queue, a price change or a quantity increase
+              gives it a new time stamp, and it is matched again as if it had just arrived.
+    Must run on the book's goroutine.
+*/
+func modifyRestingOrder(book *OrderBook, bookOrders *PriorityQueue, index int, request ModifyStockOrderRequest) (Order, *OrderError) {
+    order := bookOrders.Order[index]
+    if order.DisplayQuantity != nil {
+        return Order{}, &OrderError{http.StatusBadRequest, "Iceberg orders cannot be amended, cancel and place a new one", nil}
+    }
+
+    newPrice := *order.Price
+    if request.Price != nil {
+        newPrice = *request.Price
+    }
+    newQuantity := order.Quantity
+    if request.Quantity != nil {
+        newQuantity = *request.Quantity
+    }
+
+    priceChanged := !newPrice.Equal(*order.Price)
+    quantityDelta := newQuantity.Sub(order.Quantity)
+
+    if priceChanged {
+        if orderErr := checkPriceBands(book, &newPrice); orderErr != nil {
+            return Order{}, orderErr
+        }
+    }
+
+    // an amended post only order must still rest, it is rejected rather than repriced
+    if order.PostOnly && priceChanged {
+        amended := *order
+        amended.Price = &newPrice
+        if _, crosses := postOnlyPrice(book, amended); crosses && book.Session == "CONTINUOUS" && !book.Halted {
+            return Order{}, &OrderError{http.StatusBadRequest, "Post only order would cross the book", nil}
+        }
+    }
+
+    if order.IsBuy {
+        // the reservation covers price * remaining quantity
+        reservationDelta := newPrice.Mul(newQuantity).Sub(order.Price.Mul(order.Quantity))
+        // and the fee hold what the fees of the new remaining notional can cost
+        newFeeHold := book.Fees.feeHold(*order, newPrice.Mul(newQuantity))
+        feeDelta := newFeeHold.Sub(order.FeeHeld)
+        holdDelta := reservationDelta.Add(feeDelta)
+
+        if holdDelta.IsPositive() {
+            if err := verifyWalletBeforeTransaction(order.UserName, reservationDelta, feeDelta); err != nil {
+                return Order{}, &OrderError{http.StatusBadRequest, "Failed to verify Wallet", err}
+            }
+            if err := updateMoneyHold(order.UserName, holdDelta, true); err != nil {
+                return Order{}, &OrderError{http.StatusInternalServerError, "Failed to hold money in user's wallet", err}
+            }
+        } else if holdDelta.IsNegative() {
+            if err := updateMoneyHold(order.UserName, holdDelta.Neg(), false); err != nil {
+                return Order{}, &OrderError{http.StatusInternalServerError, "Failed to release money in user's wallet", err}
+            }
+        }
+
+        order.FeeHeld = newFeeHold
+        if err := recordOrderFee(nil, *order, decimal.Zero, feeDelta); err != nil {
+            fmt.Println(err)
+        }
+        if err := adjustWalletTransaction(nil, *order, reservationDelta); err != nil {
+            fmt.Println("Error adjusting wallet transaction: ", err)
+        }
+    } else {
+        // the hold covers the remaining quantity
+        if quantityDelta.IsPositive() {
+            extra := *order
+            extra.Quantity = quantityDelta
+            if err := verifyStockBeforeTransaction(order.UserName, extra); err != nil {
+                return Order{}, &OrderError{http.StatusBadRequest, "Failed to verify stocks", err}
+            }
+            if err := updateStockHold(order.UserName, *order, quantityDelta, true); err != nil {
+                return Order{}, &OrderError{http.StatusInternalServerError, "Failed to hold stock in user's portfolio", err}
+            }
+        } else if quantityDelta.IsNegative() {
+            if err := updateStockHold(order.UserName, *order, quantityDelta.Neg(), false); err != nil {
+                return Order{}, &OrderError{http.StatusInternalServerError, "Failed to release stock in user's portfolio", err}
+            }
+        }
+    }
+
+    keepsPriority := !priceChanged && !quantityDelta.IsPositive()
+
+    order.Price = &newPrice
+    order.Quantity = newQuantity
+    if !keepsPriority {
+        order.TimeStamp = clock.Now().Format(time.RFC3339Nano)
+    }
+
+    // the row's quantity moves by the same delta, so filled + remaining stays consistent for recovery
+    if _, err := stmtAmendStockTransaction.Exec(newPrice, quantityDelta, order.TimeStamp, order.UserName, order.StockTxID); err != nil {
+        fmt.Println("Error amending stock transaction: ", err)
+    }
+
+    amended := *order
+    if !keepsPriority {
+        // lose queue priority: take the order out and match it again as a new arrival
+        heap.Remove(bookOrders, index)
+        processOrder(book, amended)
+        releaseTriggeredOrders(book)
+    }
+
+    return amended, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestFindRestingOrder(t *testing.T) {
+    stop := limitOrder(t, "stop", true, "10", "1", "3")
+    stop.OrderType = "STOP_LIMIT"
+    bids := bookSide(true,
+        limitOrder(t, "a", true, "10", "1", "1"),
+        limitOrder(t, "b", true, "11", "1", "2"),
+        stop,
+    )
+
+    if index := findRestingOrder(&bids, "a", "user-a"); index < 0 || bids.Order[index].StockTxID != "a" {
+        t.Errorf("the user's resting order was not found")
+    }
+    if index := findRestingOrder(&bids, "a", "user-b"); index != -1 {
+        t.Errorf("another user's order was found")
+    }
+    if index := findRestingOrder(&bids, "stop", "user-stop"); index != -1 {
+        t.Errorf("an order that is not a LIMIT order was found")
+    }
+}
+
+func TestIcebergOrdersCannotBeAmended(t *testing.T) {
+    book := &OrderBook{StockID: "stock", Session: "CONTINUOUS", BuyOrders: bookSide(true, icebergOrder(t, "ice", true, "10", "100", "10", "1")), SellOrders: bookSide(false)}
+    quantity := dec(t, "50")
+
+    _, orderErr := modifyRestingOrder(book, &book.BuyOrders, 0, ModifyStockOrderRequest{Quantity: &quantity})
+    if orderErr == nil || orderErr.StatusCode != http.StatusBadRequest {
+        t.Fatalf("amending an iceberg order returned %v", orderErr)
+    }
+    if !book.BuyOrders.Order[0].Quantity.Equal(dec(t, "10")) || !book.BuyOrders.Order[0].HiddenQuantity.Equal(dec(t, "90")) {
+        t.Errorf("the rejected amendment changed the order")
+    }
+}
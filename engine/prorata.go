@@ -0,0 +1,222 @@
+package main
+
+import (
+    "container/heap"
+    "fmt"
+    "sort"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Pro Rata matching: when an incoming order crosses a price level, its quantity is split across every
+    resting order at that level in proportion to the resting order's size.
+
+    Rounding: each share is rounded down to a multiple of the stock's lot size, and shares below proRataMinAllocation
+              are dropped.
+    Remainder: whatever is left after rounding is handed out by time priority (oldest order first),
+               each order taking as much as it can until the remainder is used up.
+*/
+func matchProRataOrder(book *OrderBook, order Order) {
+    restingOrders := &book.SellOrders
+    if !order.IsBuy {
+        restingOrders = &book.BuyOrders
+
+        // initialize the market price if there isn't one yet
+        if order.OrderType == "LIMIT" && book.SellOrders.Len() == 0 {
+            if err := updateMarketStockPrice(order.StockID, order.Price); err != nil {
+                fmt.Println("Failed to update Market Stock Price after Limit Sell: ", err)
+            }
+        }
+    }
+
+    var spent, finalFill decimal.Decimal
+    settled := true
+
+    for settled && order.Quantity.IsPositive() && restingOrders.Len() > 0 {
+        price := *restingOrders.Order[0].Price
+        levelPrice := &price
+
+        // Limit orders stop at the first price level they do not cross, Market orders at their protection price
+        if order.OrderType == "LIMIT" && !crossesPriceLevel(order, price) {
+            break
+        }
+        if order.OrderType == "MARKET" && !withinProtectionPrice(order, price) {
+            break
+        }
+
+        // Market orders take the price of the level they are matched against
+        incomingPrice := order.Price
+        if order.OrderType == "MARKET" {
+            incomingPrice = levelPrice
+        }
+
+        level := ordersAtPriceLevel(restingOrders, price)
+        allocations := allocateProRata(order.Quantity, level, book.LotSize)
+
+        for i, restingOrder := range level {
+            if !order.Quantity.IsPositive() {
+                break
+            }
+            if !allocations[i].IsPositive() {
+                continue
+            }
+
+            buyOrder, sellOrder := &order, restingOrder
+            if !order.IsBuy {
+                buyOrder, sellOrder = restingOrder, &order
+            }
+
+            // orders of the same user never trade with each other, which may also shrink the incoming order
+            if preventSelfTrade(buyOrder, sellOrder) {
+                continue
+            }
+            tradeQuantity := decimal.Min(allocations[i], order.Quantity)
+
+            var err error
+            if order.IsBuy {
+                err = executeTradeQuantity(&order, restingOrder, tradeQuantity, incomingPrice, restingOrder.Price)
+            } else {
+                err = executeTradeQuantity(restingOrder, &order, tradeQuantity, restingOrder.Price, incomingPrice)
+            }
+
+            // a failed settlement leaves both orders untouched and stops matching
+            if err != nil {
+                fmt.Println("Error settling trade: ", err)
+                settled = false
+                break
+            }
+
+            finalFill = price.Mul(tradeQuantity)
+            spent = spent.Add(finalFill)
+        }
+
+        removeFilledOrders(restingOrders)
+    }
+
+    if order.OrderType == "MARKET" {
+        if order.IsBuy {
+            refundMarketBuyReservation(order, spent, finalFill)
+        } else {
+            refundMarketSellRemainder(order)
+        }
+        return
+    }
+
+    // If the limit order was not fully executed, it rests in the book
+    if order.OrderType == "LIMIT" && order.Quantity.IsPositive() {
+        if order.IsBuy {
+            heap.Push(&book.BuyOrders, &order)
+        } else {
+            heap.Push(&book.SellOrders, &order)
+        }
+    }
+}
+
+// crossesPriceLevel reports whether a limit order can trade against the opposite side at the given price
+func crossesPriceLevel(order Order, price decimal.Decimal) bool {
+    if order.IsBuy {
+        return price.LessThanOrEqual(*order.Price)
+    }
+    return price.GreaterThanOrEqual(*order.Price)
+}
+
+// ordersAtPriceLevel returns the resting orders at the given price, oldest first
+func ordersAtPriceLevel(bookOrders *PriorityQueue, price decimal.Decimal) []*Order {
+    level := make([]*Order, 0)
+    for _, order := range bookOrders.Order {
+        if order.Price.Equal(price) {
+            level = append(level, order)
+        }
+    }
+
+    sort.SliceStable(level, func(i, j int) bool {
+        return level[i].TimeStamp < level[j].TimeStamp
+    })
+    return level
+}
+
+// allocateProRata splits quantity across the (time ordered) level, returning one allocation per resting order
+func allocateProRata(quantity decimal.Decimal, level []*Order, lotSize decimal.Decimal) []decimal.Decimal {
+    allocations := make([]decimal.Decimal, len(level))
+
+    var levelQuantity decimal.Decimal
+    for _, order := range level {
+        levelQuantity = levelQuantity.Add(order.Quantity)
+    }
+
+    // The incoming order takes the whole level
+    if quantity.GreaterThanOrEqual(levelQuantity) {
+        for i, order := range level {
+            allocations[i] = order.Quantity
+        }
+        return allocations
+    }
+
+    var allocated decimal.Decimal
+    for i, order := range level {
+        // whole lots of quantity * order.Quantity / levelQuantity, divided exactly
+        lots, _ := quantity.Mul(order.Quantity).QuoRem(levelQuantity.Mul(lotSize), 0)
+        share := lots.Mul(lotSize)
+        if share.LessThan(proRataMinAllocation) {
+            share = decimal.Zero
+        }
+        allocations[i] = share
+        allocated = allocated.Add(share)
+    }
+
+    // Hand out the rounding remainder by time priority
+    remainder := quantity.Sub(allocated)
+    for i, order := range level {
+        if !remainder.IsPositive() {
+            break
+        }
+        extra := decimal.Min(remainder, order.Quantity.Sub(allocations[i]))
+        allocations[i] = allocations[i].Add(extra)
+        remainder = remainder.Sub(extra)
+    }
+
+    return allocations
+}
+
+// executeTradeQuantity trades an explicit quantity between a buy and a sell order, which may leave both partially filled
+func executeTradeQuantity(buyOrder *Order, sellOrder *Order, tradeQuantity decimal.Decimal, buyPrice *decimal.Decimal, sellPrice *decimal.Decimal) error {
+    trade := newTrade(buyOrder, sellOrder, tradeQuantity, *sellPrice)
+    err := settleTrade(&trade, buyOrder, sellOrder, func(settlement *Settlement) error {
+        buyOrder.Quantity = buyOrder.Quantity.Sub(tradeQuantity)
+        sellOrder.Quantity = sellOrder.Quantity.Sub(tradeQuantity)
+
+        var err error
+        if sellOrder.Quantity.IsPositive() {
+            err = partialFulfillSellOrder(settlement, sellOrder, tradeQuantity, sellPrice)
+        } else {
+            err = completeSellOrder(settlement, sellOrder, tradeQuantity, sellPrice)
+        }
+        if err != nil {
+            return err
+        }
+
+        if buyOrder.Quantity.IsPositive() {
+            return partialFulfillBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice)
+        }
+        return completeBuyOrder(settlement, buyOrder, tradeQuantity, buyPrice, sellPrice)
+    })
+    if err != nil {
+        return err
+    }
+
+    publishTrade(trade, buyOrder, sellOrder)
+    return nil
+}
+
+// removeFilledOrders drops every fully executed order from the queue and restores the heap order
+func removeFilledOrders(bookOrders *PriorityQueue) {
+    remaining := bookOrders.Order[:0]
+    for _, order := range bookOrders.Order {
+        if order.Quantity.IsPositive() {
+            remaining = append(remaining, order)
+        }
+    }
+    bookOrders.Order = remaining
+    heap.Init(bookOrders)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/shopspring/decimal"
+)
+
+func TestAllocateProRata(t *testing.T) {
+    level := []*Order{
+        limitOrder(t, "a", false, "10", "60", "1"),
+        limitOrder(t, "b", false, "10", "30", "2"),
+        limitOrder(t, "c", false, "10", "10", "3"),
+    }
+
+    tests := []struct {
+        name          string
+        quantity      string
+        lotSize       string
+        minAllocation string
+        allocations   []string
+    }{
+        {"exact shares", "50", "1", "1", []string{"30", "15", "5"}},
+        {"whole level", "200", "1", "1", []string{"60", "30", "10"}},
+        {"remainder by time priority", "7", "1", "1", []string{"5", "2", "0"}},
+        {"shares below the minimum", "10", "1", "5", []string{"10", "0", "0"}},
+        {"whole lots", "50", "5", "1", []string{"30", "15", "5"}},
+    }
+    saved := proRataMinAllocation
+    defer func() { proRataMinAllocation = saved }()
+
+    for _, test := range tests {
+        proRataMinAllocation = dec(t, test.minAllocation)
+        allocations := allocateProRata(dec(t, test.quantity), level, dec(t, test.lotSize))
+
+        total := decimal.Zero
+        for i, allocation := range allocations {
+            if !allocation.Equal(dec(t, test.allocations[i])) {
+                t.Errorf("%s: order %s is allocated %v, want %s", test.name, level[i].StockTxID, allocation, test.allocations[i])
+            }
+            total = total.Add(allocation)
+        }
+        if want := decimal.Min(dec(t, test.quantity), dec(t, "100")); !total.Equal(want) {
+            t.Errorf("%s: allocated %v in total, want %v", test.name, total, want)
+        }
+    }
+}
+
+func TestOrdersAtPriceLevel(t *testing.T) {
+    asks := bookSide(false,
+        limitOrder(t, "late", false, "10", "1", "3"),
+        limitOrder(t, "other", false, "11", "1", "1"),
+        limitOrder(t, "early", false, "10", "1", "2"),
+    )
+
+    level := ordersAtPriceLevel(&asks, dec(t, "10"))
+    if len(level) != 2 || level[0].StockTxID != "early" || level[1].StockTxID != "late" {
+        t.Errorf("the level at 10 is not the two orders at 10 oldest first")
+    }
+}
+
+func TestCrossesPriceLevel(t *testing.T) {
+    buy := *limitOrder(t, "buy", true, "10", "1", "1")
+    sell := *limitOrder(t, "sell", false, "10", "1", "1")
+
+    if !crossesPriceLevel(buy, dec(t, "9.99")) || crossesPriceLevel(buy, dec(t, "10.01")) {
+        t.Errorf("a buy at 10 must cross asks up to 10")
+    }
+    if !crossesPriceLevel(sell, dec(t, "10.01")) || crossesPriceLevel(sell, dec(t, "9.99")) {
+        t.Errorf("a sell at 10 must cross bids down to 10")
+    }
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "container/heap"
+    "fmt"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    restoreOrderBooks rebuilds every OrderBook from tx_db when the engine starts.
+
+    Resting orders are the parent LIMIT rows of stock_transactions that are still IN_PROGRESS, PARTIAL_FULFILLED or
+    STP_DECREMENTED, and waiting stop orders are the STOP/STOP_LIMIT rows that are still PENDING_TRIGGER.
+    Their remaining quantity is the original quantity minus the quantity of their COMPLETED child rows, and their
+    original time stamp is kept so time priority survives the restart. An iceberg order is split into its visible slice
+    and hidden reserve again, and every order keeps its client order id, flags and self-trade prevention mode (rows
+    written before the mode was stored get the engine default). The wallet or portfolio reservation taken when the
+    order was placed is still in place, so nothing is reserved again. A buy order gets back the fee it still holds and
+    the fees it was charged, its volume discount is looked up again on its next fill.
+*/
+func restoreOrderBooks() error {
+    rows, err := stmtGetOpenOrders.Query(selfTradePreventionMode)
+    if err != nil {
+        return fmt.Errorf("Failed to query open orders: %w", err)
+    }
+    defer rows.Close()
+
+    restored := 0
+    for rows.Next() {
+        var order Order
+        var walletTxID *string
+        var price decimal.Decimal
+        var timeStamp time.Time
+
+        err := rows.Scan(&order.StockTxID, &order.StockID, &walletTxID, &order.UserName, &order.IsBuy, &order.OrderType, &order.Status, &price, &order.Quantity, &timeStamp, &order.TimeInForce, &order.StopPrice, &order.DisplayQuantity, &order.FeeCharged, &order.FeeHeld, &order.ClientOrderID, &order.PostOnly, &order.ReduceOnly, &order.SelfTradePrevention)
+        if err != nil {
+            return fmt.Errorf("Failed to scan open order: %w", err)
+        }
+
+        if !order.Quantity.IsPositive() {
+            continue
+        }
+
+        order.Price = &price
+        order.TimeStamp = timeStamp.Format(time.RFC3339Nano)
+        order.FeeAccrued = order.FeeCharged
+
+        // Sell orders only get their wallet transaction once they complete
+        if walletTxID != nil {
+            order.WalletTxID = *walletTxID
+        } else {
+            order.WalletTxID = generateWalletID()
+        }
+
+        book, err := initializePriorityQueue(order)
+        if err != nil {
+            return fmt.Errorf("Failed to restore order book: %w", err)
+        }
+
+        restoredOrder := order
+        book.execute(func(book *OrderBook) {
+            restoreOrder(book, restoredOrder)
+        })
+        indexOrder(order.StockTxID, order.StockID)
+        restored++
+    }
+
+    if err := rows.Err(); err != nil {
+        return fmt.Errorf("Failed to read open orders: %w", err)
+    }
+
+    fmt.Printf("Restored %d resting orders\n", restored)
+    return nil
+}
+
+// restoreOrder puts a restored order back into its book without matching it. It must run on the book's goroutine.
+func restoreOrder(book *OrderBook, order Order) {
+    if order.Status == "PENDING_TRIGGER" {
+        // a waiting STOP order recorded its stop price as its price
+        if order.OrderType == "STOP" {
+            order.Price = nil
+        }
+        book.TriggerOrders = append(book.TriggerOrders, &order)
+        return
+    }
+
+    // an iceberg shows one slice again, the rest of it goes back into its reserve
+    showIcebergSlice(&order)
+    if order.IsBuy {
+        heap.Push(&book.BuyOrders, &order)
+    } else {
+        heap.Push(&book.SellOrders, &order)
+    }
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestRestoredOrdersKeepTheirPlace(t *testing.T) {
+    book := &OrderBook{StockID: "stock", BuyOrders: bookSide(true, limitOrder(t, "new", true, "10", "5", "2026-03-02T10:00:00Z")), SellOrders: bookSide(false)}
+
+    // restored after the newer order, it still goes first
+    restoreOrder(book, *limitOrder(t, "old", true, "10", "5", "2026-03-02T09:00:00Z"))
+    if book.BuyOrders.Order[0].StockTxID != "old" {
+        t.Errorf("the restored order lost its time priority")
+    }
+
+    iceberg := *limitOrder(t, "ice", false, "11", "25", "2026-03-02T09:00:00Z")
+    display := dec(t, "10")
+    iceberg.DisplayQuantity = &display
+    restoreOrder(book, iceberg)
+    if restored := book.SellOrders.Order[0]; !restored.Quantity.Equal(dec(t, "10")) || !restored.HiddenQuantity.Equal(dec(t, "15")) {
+        t.Errorf("the restored iceberg shows %v and hides %v, want 10 and 15", restored.Quantity, restored.HiddenQuantity)
+    }
+
+    stop := *limitOrder(t, "stop", true, "12", "1", "2026-03-02T09:00:00Z")
+    stop.OrderType, stop.Status, stop.StopPrice = "STOP", "PENDING_TRIGGER", stop.Price
+    restoreOrder(book, stop)
+    if len(book.TriggerOrders) != 1 || book.TriggerOrders[0].Price != nil || !book.TriggerOrders[0].StopPrice.Equal(dec(t, "12")) {
+        t.Errorf("the waiting STOP order was not restored with only its stop price")
+    }
+    if book.BuyOrders.Len() != 2 || book.SellOrders.Len() != 1 {
+        t.Errorf("a waiting order entered the book")
+    }
+}
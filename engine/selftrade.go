@@ -0,0 +1,127 @@
+package main
+
+import (
+    "fmt"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Self-trade prevention: a buy and a sell of the same user never trade with each other, so nobody can wash-trade
+    the last price. When they meet, the self_trade_prevention mode of the newest of the two orders decides:
+
+    CANCEL_NEWEST (default): the newest order is cancelled
+    CANCEL_OLDEST: the oldest (resting) order is cancelled
+    CANCEL_BOTH: both orders are cancelled
+    DECREMENT_AND_CANCEL: both orders are reduced by the smaller quantity, so the smaller one is cancelled and the
+                          larger one keeps matching with what is left
+
+    Cancelled orders are closed with status STP_CANCELLED and decremented orders get status STP_DECREMENTED.
+    The funds or stocks released from an order are refunded the same way as a user cancellation.
+*/
+func validateSelfTradePrevention(request *PlaceStockOrderRequest) error {
+    if request.SelfTradePrevention == "" {
+        request.SelfTradePrevention = selfTradePreventionMode
+    }
+
+    if !isSelfTradePreventionMode(request.SelfTradePrevention) {
+        return fmt.Errorf("Invalid self trade prevention, must be CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT_AND_CANCEL")
+    }
+    return nil
+}
+
+func isSelfTradePreventionMode(mode string) bool {
+    return mode == "CANCEL_NEWEST" || mode == "CANCEL_OLDEST" || mode == "CANCEL_BOTH" || mode == "DECREMENT_AND_CANCEL"
+}
+
+// preventSelfTrade resolves a buy and a sell of the same user before they trade.
+// It returns false when the orders belong to different users and may trade.
+func preventSelfTrade(buyOrder *Order, sellOrder *Order) bool {
+    if buyOrder.UserName != sellOrder.UserName {
+        return false
+    }
+
+    newest, oldest := buyOrder, sellOrder
+    if sellOrder.TimeStamp > buyOrder.TimeStamp {
+        newest, oldest = sellOrder, buyOrder
+    }
+
+    switch newest.SelfTradePrevention {
+    case "CANCEL_OLDEST":
+        cancelSelfTradeOrder(oldest)
+    case "CANCEL_BOTH":
+        cancelSelfTradeOrder(newest)
+        cancelSelfTradeOrder(oldest)
+    case "DECREMENT_AND_CANCEL":
+        quantity := decimal.Min(buyOrder.Quantity, sellOrder.Quantity)
+        decrementSelfTradeOrder(buyOrder, quantity)
+        decrementSelfTradeOrder(sellOrder, quantity)
+    default:
+        cancelSelfTradeOrder(newest)
+    }
+    return true
+}
+
+// cancelSelfTradeOrder closes an order with STP_CANCELLED, leaving it with no quantity so matching drops it
+func cancelSelfTradeOrder(order *Order) {
+    releaseSelfTradeQuantity(order, remainingQuantity(*order))
+
+    // the remaining reservation of a limit buy is credited back, as on a user cancellation. The order's stock
+    // transaction keeps pointing at its wallet transaction, which is never deleted.
+    if order.IsBuy && order.OrderType == "LIMIT" {
+        if err := settleWalletTransaction(nil, *order, decimal.Zero); err != nil {
+            fmt.Println("Error adjusting wallet transaction: ", err)
+        }
+        releaseFeeHold(order)
+    }
+
+    order.Quantity = decimal.Zero
+    order.HiddenQuantity = decimal.Zero
+    order.Status = "STP_CANCELLED"
+    if err := setStatus(nil, order, order.Status, false); err != nil {
+        fmt.Println("Error setting status: ", err)
+    }
+    publishOrderStatus(*order, order.Status)
+}
+
+// decrementSelfTradeOrder takes quantity off an order, cancelling it when nothing is left
+func decrementSelfTradeOrder(order *Order, quantity decimal.Decimal) {
+    if quantity.GreaterThanOrEqual(order.Quantity) {
+        cancelSelfTradeOrder(order)
+        return
+    }
+
+    releaseSelfTradeQuantity(order, quantity)
+
+    if order.IsBuy && order.OrderType == "LIMIT" {
+        if err := adjustWalletTransaction(nil, *order, order.Price.Mul(quantity).Neg()); err != nil {
+            fmt.Println("Error adjusting wallet transaction: ", err)
+        }
+    }
+
+    order.Quantity = order.Quantity.Sub(quantity)
+    order.Status = "STP_DECREMENTED"
+    if _, err := stmtDecrementStockTransaction.Exec(quantity, order.Status, order.UserName, order.StockTxID); err != nil {
+        fmt.Println("Error decrementing stock transaction: ", err)
+    }
+    publishOrderStatus(*order, order.Status)
+}
+
+// releaseSelfTradeQuantity refunds the funds or stocks reserved for quantity of an order
+func releaseSelfTradeQuantity(order *Order, quantity decimal.Decimal) {
+    if !order.IsBuy {
+        if err := updateStockHold(order.UserName, *order, quantity, false); err != nil {
+            fmt.Println("Error updating stock portfolio: ", err)
+        }
+        return
+    }
+
+    // a Market buy's reservation is settled once its sweep ends
+    if order.OrderType == "MARKET" {
+        return
+    }
+
+    if err := updateMoneyHold(order.UserName, order.Price.Mul(quantity), false); err != nil {
+        fmt.Println("Error updating wallet: ", err)
+    }
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestValidateSelfTradePrevention(t *testing.T) {
+    saved := selfTradePreventionMode
+    defer func() { selfTradePreventionMode = saved }()
+    selfTradePreventionMode = "CANCEL_BOTH"
+
+    request := PlaceStockOrderRequest{}
+    if err := validateSelfTradePrevention(&request); err != nil || request.SelfTradePrevention != "CANCEL_BOTH" {
+        t.Errorf("an order without a mode got %q (%v), want the engine default", request.SelfTradePrevention, err)
+    }
+
+    for _, mode := range []string{"CANCEL_NEWEST", "CANCEL_OLDEST", "CANCEL_BOTH", "DECREMENT_AND_CANCEL"} {
+        if err := validateSelfTradePrevention(&PlaceStockOrderRequest{SelfTradePrevention: mode}); err != nil {
+            t.Errorf("%s was rejected: %v", mode, err)
+        }
+    }
+    if err := validateSelfTradePrevention(&PlaceStockOrderRequest{SelfTradePrevention: "CANCEL_ALL"}); err == nil {
+        t.Errorf("an unknown mode was accepted")
+    }
+}
+
+func TestOrdersOfDifferentUsersTrade(t *testing.T) {
+    buy := limitOrder(t, "buy", true, "10", "5", "2")
+    sell := limitOrder(t, "sell", false, "10", "5", "1")
+
+    if preventSelfTrade(buy, sell) {
+        t.Fatalf("orders of different users were stopped")
+    }
+    if !buy.Quantity.Equal(dec(t, "5")) || !sell.Quantity.Equal(dec(t, "5")) || buy.Status != "" || sell.Status != "" {
+        t.Errorf("orders of different users were changed")
+    }
+}
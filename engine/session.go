@@ -0,0 +1,137 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "time"
+)
+
+/*
+    Trading session of a stock, when SESSION_AUCTIONS is enabled (otherwise every book is always CONTINUOUS):
+
+    PRE_OPEN:     SESSION_PRE_OPEN to SESSION_OPEN, LIMIT orders are collected without matching
+    CONTINUOUS:   SESSION_OPEN to SESSION_CLOSING_CALL, opened by the opening auction, orders match as they arrive
+    CLOSING_CALL: SESSION_CLOSING_CALL to SESSION_CLOSE, LIMIT orders are collected without matching
+    CLOSED:       SESSION_CLOSE to SESSION_PRE_OPEN, entered through the closing auction, no new orders are accepted
+
+    Leaving a call phase (PRE_OPEN or CLOSING_CALL) uncrosses the book in a call auction. The phase is derived from
+    the clock, so the schedule is fully described by the session times and a test can swap the clock to step
+    through it. Each book moves to the phase of the clock on the session scheduler's tick and before it expires
+    orders, so the closing auction always runs before DAY orders expire.
+*/
+
+// Clock is the engine's source of time for the session schedule and order expiry
+type Clock interface {
+    Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+    return time.Now()
+}
+
+var clock Clock = systemClock{}
+
+const sessionSchedulerInterval = time.Second
+
+// sessionPhaseAt returns the phase of the trading session at t
+func sessionPhaseAt(t time.Time) string {
+    if !sessionAuctions {
+        return "CONTINUOUS"
+    }
+
+    local := t.In(sessionLocation())
+    minute := local.Hour()*60 + local.Minute()
+
+    switch {
+    case minute >= sessionMinute(sessionPreOpen, "09:00") && minute < sessionMinute(sessionOpen, "09:30"):
+        return "PRE_OPEN"
+    case minute >= sessionMinute(sessionOpen, "09:30") && minute < sessionMinute(sessionClosingCall, "15:50"):
+        return "CONTINUOUS"
+    case minute >= sessionMinute(sessionClosingCall, "15:50") && minute < sessionMinute(sessionClose, "16:00"):
+        return "CLOSING_CALL"
+    default:
+        return "CLOSED"
+    }
+}
+
+func isCallPhase(session string) bool {
+    return session == "PRE_OPEN" || session == "CLOSING_CALL"
+}
+
+// sessionLocation returns SESSION_TIMEZONE, or UTC when it cannot be loaded
+func sessionLocation() *time.Location {
+    location, err := time.LoadLocation(sessionTimeZone)
+    if err != nil {
+        return time.UTC
+    }
+    return location
+}
+
+// sessionMinute returns a session time (HH:MM) as minutes after midnight, using fallback when it is invalid
+func sessionMinute(value string, fallback string) int {
+    parsed, err := time.Parse("15:04", value)
+    if err != nil {
+        parsed, _ = time.Parse("15:04", fallback)
+    }
+    return parsed.Hour()*60 + parsed.Minute()
+}
+
+// SessionEvent is a change of a stock's session phase
+type SessionEvent struct {
+    StockID string `json:"stock_id"`
+    Session string `json:"session"`
+}
+
+// advanceSession moves the book to the session phase of now, running the call auction when a call phase ends.
+// It must run on the book's goroutine.
+func advanceSession(book *OrderBook, now time.Time) {
+    session := sessionPhaseAt(now)
+    if session == book.Session {
+        return
+    }
+
+    // a halted book keeps its collected orders until trading resumes
+    previous := book.Session
+    if isCallPhase(previous) && !book.Halted {
+        uncrossAuction(book)
+    }
+    if session == "CONTINUOUS" {
+        book.ReferencePrice = book.LastPrice
+    }
+    book.Session = session
+    fmt.Printf("Order book %s moved from %s to %s\n", book.StockID, previous, session)
+    marketDataHub.publish(book.StockID, "session", SessionEvent{StockID: book.StockID, Session: session})
+
+    // the auction may have moved the last price past the stop price of waiting stop orders
+    releaseTriggeredOrders(book)
+    pruneOrderIndex(book)
+}
+
+// runSessionScheduler moves every book through the session schedule and ends timed halts
+func runSessionScheduler() {
+    for {
+        time.Sleep(sessionSchedulerInterval)
+        now := clock.Now()
+        for _, book := range allOrderBooks() {
+            book.execute(func(book *OrderBook) {
+                advanceSession(book, now)
+                resumeExpiredHalt(book, now)
+            })
+        }
+    }
+}
+
+// checkSessionAccepts rejects orders the book's session phase does not take: nothing is accepted while CLOSED,
+// and orders that must execute on arrival (MARKET, IOC, FOK) are not accepted during a call phase
+func checkSessionAccepts(book *OrderBook, order Order) *OrderError {
+    if book.Session == "CLOSED" {
+        return &OrderError{http.StatusBadRequest, "The market is closed", nil}
+    }
+
+    if isCallPhase(book.Session) && (order.OrderType == "MARKET" || order.TimeInForce == "IOC" || order.TimeInForce == "FOK") {
+        return &OrderError{http.StatusBadRequest, "Only limit orders are accepted during the " + book.Session + " phase", nil}
+    }
+    return nil
+}
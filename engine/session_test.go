@@ -0,0 +1,268 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/shopspring/decimal"
+)
+
+// fakeClock is a Clock that only moves when a test sets it
+type fakeClock struct {
+    now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+    return c.now
+}
+
+// useAuctionSession enables the default session schedule in UTC for the duration of a test
+func useAuctionSession(t *testing.T) *fakeClock {
+    t.Helper()
+    previousAuctions, previousZone, previousClock := sessionAuctions, sessionTimeZone, clock
+    t.Cleanup(func() {
+        sessionAuctions, sessionTimeZone, clock = previousAuctions, previousZone, previousClock
+    })
+
+    fake := &fakeClock{}
+    sessionAuctions, sessionTimeZone, clock = true, "UTC", fake
+    return fake
+}
+
+// at returns a time of day on a fixed date in UTC
+func at(t *testing.T, value string) time.Time {
+    t.Helper()
+    parsed, err := time.Parse("2006-01-02 15:04", "2026-03-02 "+value)
+    if err != nil {
+        t.Fatalf("invalid time %q: %v", value, err)
+    }
+    return parsed
+}
+
+// auctionFill stands in for the settlement of an auction fill and records it
+type auctionFill struct {
+    buyID, sellID string
+    quantity      decimal.Decimal
+    price         decimal.Decimal
+}
+
+func recordAuctionFills(t *testing.T) *[]auctionFill {
+    t.Helper()
+    previous := executeAuctionFill
+    t.Cleanup(func() { executeAuctionFill = previous })
+
+    fills := &[]auctionFill{}
+    executeAuctionFill = func(buyOrder *Order, sellOrder *Order, tradeQuantity decimal.Decimal, buyPrice *decimal.Decimal, sellPrice *decimal.Decimal) error {
+        buyOrder.Quantity = buyOrder.Quantity.Sub(tradeQuantity)
+        sellOrder.Quantity = sellOrder.Quantity.Sub(tradeQuantity)
+        *fills = append(*fills, auctionFill{buyOrder.StockTxID, sellOrder.StockTxID, tradeQuantity, *sellPrice})
+        return nil
+    }
+    return fills
+}
+
+func TestSessionPhaseAt(t *testing.T) {
+    useAuctionSession(t)
+
+    tests := []struct {
+        time string
+        want string
+    }{
+        {"08:59", "CLOSED"},
+        {"09:00", "PRE_OPEN"},
+        {"09:29", "PRE_OPEN"},
+        {"09:30", "CONTINUOUS"},
+        {"15:49", "CONTINUOUS"},
+        {"15:50", "CLOSING_CALL"},
+        {"15:59", "CLOSING_CALL"},
+        {"16:00", "CLOSED"},
+        {"23:30", "CLOSED"},
+    }
+    for _, test := range tests {
+        if got := sessionPhaseAt(at(t, test.time)); got != test.want {
+            t.Errorf("%s: got %s, want %s", test.time, got, test.want)
+        }
+    }
+
+    sessionAuctions = false
+    if got := sessionPhaseAt(at(t, "03:00")); got != "CONTINUOUS" {
+        t.Errorf("without auctions: got %s, want CONTINUOUS", got)
+    }
+}
+
+func TestAdvanceSessionFollowsTheClock(t *testing.T) {
+    fake := useAuctionSession(t)
+    fills := recordAuctionFills(t)
+
+    book := &OrderBook{StockID: "stock", Session: "CLOSED", BuyOrders: bookSide(true), SellOrders: bookSide(false)}
+
+    steps := []struct {
+        time    string
+        session string
+    }{
+        {"08:00", "CLOSED"},
+        {"09:00", "PRE_OPEN"},
+        {"09:30", "CONTINUOUS"},
+        {"15:50", "CLOSING_CALL"},
+        {"16:00", "CLOSED"},
+        {"09:05", "PRE_OPEN"},
+    }
+    for _, step := range steps {
+        fake.now = at(t, step.time)
+        advanceSession(book, clock.Now())
+        if book.Session != step.session {
+            t.Fatalf("%s: session is %s, want %s", step.time, book.Session, step.session)
+        }
+    }
+    if len(*fills) != 0 {
+        t.Errorf("an empty book executed %d fills", len(*fills))
+    }
+}
+
+func TestOpeningAuctionUncrossesTheBook(t *testing.T) {
+    fake := useAuctionSession(t)
+
+    tests := []struct {
+        name      string
+        buys      []*Order
+        sells     []*Order
+        price     string
+        volume    string
+        remaining map[string]string // quantity left in the book per order, including the hidden reserve
+    }{
+        {
+            name:      "no cross",
+            buys:      []*Order{limitOrder(t, "b1", true, "9", "5", "1")},
+            sells:     []*Order{limitOrder(t, "s1", false, "10", "5", "2")},
+            volume:    "0",
+            remaining: map[string]string{"b1": "5", "s1": "5"},
+        },
+        {
+            name: "most volume",
+            buys: []*Order{
+                limitOrder(t, "b1", true, "11", "3", "1"),
+                limitOrder(t, "b2", true, "10", "4", "2"),
+            },
+            sells: []*Order{
+                limitOrder(t, "s1", false, "9", "2", "3"),
+                limitOrder(t, "s2", false, "10", "3", "4"),
+                limitOrder(t, "s3", false, "12", "5", "5"),
+            },
+            price:     "10",
+            volume:    "5",
+            remaining: map[string]string{"b2": "2", "s3": "5"},
+        },
+        {
+            name: "iceberg reserve",
+            buys: []*Order{icebergOrder(t, "b1", true, "10", "9", "2", "1")},
+            sells: []*Order{
+                limitOrder(t, "s1", false, "10", "4", "2"),
+                limitOrder(t, "s2", false, "10", "3", "3"),
+            },
+            price:     "10",
+            volume:    "7",
+            remaining: map[string]string{"b1": "2"},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            fills := recordAuctionFills(t)
+            book := &OrderBook{StockID: "stock", BuyOrders: bookSide(true, test.buys...), SellOrders: bookSide(false, test.sells...)}
+
+            fake.now = at(t, "09:10")
+            advanceSession(book, clock.Now())
+            if test.volume != "0" {
+                indicative := computeAuction(book, decimal.Zero)
+                if indicative.Price == nil || indicative.Price.String() != test.price || indicative.Volume.String() != test.volume {
+                    t.Fatalf("indicative auction is %v for %v, want %s for %s", indicative.Price, indicative.Volume, test.price, test.volume)
+                }
+            }
+
+            fake.now = at(t, "09:30")
+            advanceSession(book, clock.Now())
+            if book.Session != "CONTINUOUS" {
+                t.Fatalf("session is %s, want CONTINUOUS", book.Session)
+            }
+
+            executed := decimal.Zero
+            for _, fill := range *fills {
+                executed = executed.Add(fill.quantity)
+                if fill.price.String() != test.price {
+                    t.Errorf("fill %s/%s at %v, want %s", fill.buyID, fill.sellID, fill.price, test.price)
+                }
+            }
+            if executed.String() != test.volume {
+                t.Errorf("executed %v, want %s", executed, test.volume)
+            }
+
+            left := map[string]string{}
+            for _, order := range append(append([]*Order{}, book.BuyOrders.Order...), book.SellOrders.Order...) {
+                left[order.StockTxID] = remainingQuantity(*order).String()
+            }
+            if len(left) != len(test.remaining) {
+                t.Fatalf("book holds %v, want %v", left, test.remaining)
+            }
+            for id, quantity := range test.remaining {
+                if left[id] != quantity {
+                    t.Errorf("order %s has %q left, want %q", id, left[id], quantity)
+                }
+            }
+        })
+    }
+}
+
+func TestCheckSessionAccepts(t *testing.T) {
+    tests := []struct {
+        session     string
+        orderType   string
+        timeInForce string
+        accepted    bool
+    }{
+        {"CONTINUOUS", "MARKET", "", true},
+        {"PRE_OPEN", "LIMIT", "GTC", true},
+        {"PRE_OPEN", "MARKET", "", false},
+        {"CLOSING_CALL", "LIMIT", "IOC", false},
+        {"CLOSING_CALL", "LIMIT", "FOK", false},
+        {"CLOSED", "LIMIT", "GTC", false},
+    }
+    for _, test := range tests {
+        book := &OrderBook{Session: test.session}
+        err := checkSessionAccepts(book, Order{OrderType: test.orderType, TimeInForce: test.timeInForce})
+        if (err == nil) != test.accepted {
+            t.Errorf("%s %s %s: accepted is %v, want %v", test.session, test.orderType, test.timeInForce, err == nil, test.accepted)
+        }
+    }
+}
+
+func TestHandleGetAuctionIndicativeWithoutBook(t *testing.T) {
+    fake := useAuctionSession(t)
+    gin.SetMode(gin.TestMode)
+    get := func() (int, AuctionIndicativeResponse) {
+        recorder := httptest.NewRecorder()
+        c, _ := gin.CreateTestContext(recorder)
+        c.Request = httptest.NewRequest(http.MethodGet, "/getAuctionIndicative?stock_id=no-book", nil)
+        c.Set("user_name", "user")
+        HandleGetAuctionIndicative(c)
+        var response AuctionIndicativeResponse
+        json.Unmarshal(recorder.Body.Bytes(), &response)
+        return recorder.Code, response
+    }
+
+    fake.now = at(t, "09:10")
+    code, response := get()
+    if code != http.StatusOK || response.Data.StockID != "no-book" || response.Data.Session != "PRE_OPEN" || response.Data.Price != nil || !response.Data.Volume.IsZero() {
+        t.Errorf("got %d %+v, want an empty indicative result", code, response.Data)
+    }
+    if _, found := findOrderBook("no-book"); found {
+        t.Errorf("the lookup created a book")
+    }
+
+    fake.now = at(t, "12:00")
+    if code, _ := get(); code != http.StatusBadRequest {
+        t.Errorf("outside a call phase got %d, want 400", code)
+    }
+}
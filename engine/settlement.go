@@ -0,0 +1,274 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Settlement makes every fill all-or-nothing across the user, stock and transaction databases (transactional outbox).
+
+    All tx_db writes of a fill (stock/wallet transactions, statuses) go through one tx_db transaction. Balance changes
+    that live in user_db (wallet) or stock_db (portfolio, market price) are not written directly, they are recorded as
+    outbox effects and inserted into settlement_outbox inside that same transaction. The commit decides the fill:
+    before it nothing is visible anywhere, after it the effects are dispatched to user_db/stock_db.
+    A buy's money and a sell's stocks are held when the order is placed, a fill spends the hold (Held) and moves the
+    balance (Amount) in the same effect.
+
+    Each effect is applied in its own local transaction together with a marker row in applied_settlements, so an
+    effect is applied at most once no matter how often it is retried. The effects of a committed fill are handed to
+    the settlement worker, so a slow user_db or stock_db never stalls a book's matching. Effects that still fail after
+    the retries, or that did not fit into the queue, stay PENDING and are picked up by reconcileSettlements, which
+    also runs on startup to repair half-applied fills.
+*/
+type Settlement struct {
+    ID      string
+    Time    time.Time
+    tx      *sql.Tx
+    effects []SettlementEffect
+}
+
+// SettlementEffect is one balance change of a fill outside tx_db
+type SettlementEffect struct {
+    Kind      string  // WALLET, FEE, PORTFOLIO, MARKET_PRICE or CANDLE
+    UserName  string
+    StockID   string
+    Amount    decimal.Decimal // money for WALLET and FEE, stock quantity for PORTFOLIO and CANDLE, price for MARKET_PRICE
+    Held      decimal.Decimal // change of the held money for WALLET and held stock for PORTFOLIO
+    Price     decimal.Decimal // trade price for CANDLE
+    TimeStamp time.Time       // time of the fill
+}
+
+const settlementRetryAttempts = 3
+
+// How many committed effects may wait for the settlement worker, further effects are left to the reconciler
+const settlementQueueSize = 10000
+
+// pendingEffect is an effect of a committed settlement that still has to be applied
+type pendingEffect struct {
+    settlementID string
+    seq          int
+    effect       SettlementEffect
+}
+
+var settlementQueue = make(chan pendingEffect, settlementQueueSize)
+
+// runSettlementWorker applies the queued effects in the order their fills committed
+func runSettlementWorker() {
+    for item := range settlementQueue {
+        dispatchSettlementEffect(item.settlementID, item.seq, item.effect)
+    }
+}
+
+func beginSettlement() (*Settlement, error) {
+    tx, err := tx_db.Begin()
+    if err != nil {
+        return nil, fmt.Errorf("Failed to begin settlement: %w", err)
+    }
+    return &Settlement{ID: generateOrderID(), Time: time.Now().UTC(), tx: tx}, nil
+}
+
+// settleTrade checks the circuit breaker, then records the trade, runs apply and charges the fees inside a settlement. If anything fails the settlement is rolled back
+// and both orders are restored, so the in-memory book matches the databases.
+func settleTrade(trade *Trade, buyOrder *Order, sellOrder *Order, apply func(settlement *Settlement) error) error {
+    buySnapshot, sellSnapshot := *buyOrder, *sellOrder
+
+    if err := checkCircuitBreaker(trade); err != nil {
+        return err
+    }
+
+    settlement, err := beginSettlement()
+    if err != nil {
+        return err
+    }
+
+    if err := settlement.recordTrade(trade); err != nil {
+        settlement.tx.Rollback()
+        return err
+    }
+
+    err = apply(settlement)
+    if err == nil {
+        err = settlement.chargeFees(trade, buyOrder, sellOrder)
+    }
+    if err != nil {
+        settlement.tx.Rollback()
+        *buyOrder, *sellOrder = buySnapshot, sellSnapshot
+        return err
+    }
+
+    if err := settlement.commit(); err != nil {
+        *buyOrder, *sellOrder = buySnapshot, sellSnapshot
+        return err
+    }
+
+    recordTradePrice(trade)
+    queueIcebergRefills(buyOrder, sellOrder)
+    return nil
+}
+
+func (s *Settlement) updateMoneyWallet(userName string, amount decimal.Decimal, isAdded bool) {
+    if !isAdded {
+        amount = amount.Neg() // Deduct funds if buying
+    }
+    s.effects = append(s.effects, SettlementEffect{Kind: "WALLET", UserName: userName, Amount: amount})
+}
+
+func (s *Settlement) updateStockPortfolio(userName string, order Order, quantity decimal.Decimal, isAdded bool) {
+    if !isAdded {
+        quantity = quantity.Neg() // Reduce stocks if selling
+    }
+    s.effects = append(s.effects, SettlementEffect{Kind: "PORTFOLIO", UserName: userName, StockID: order.StockID, Amount: quantity})
+}
+
+// spendHeldMoney releases held money of a buy order and pays spent out of the wallet, the difference becomes available again
+func (s *Settlement) spendHeldMoney(userName string, held decimal.Decimal, spent decimal.Decimal) {
+    s.effects = append(s.effects, SettlementEffect{Kind: "WALLET", UserName: userName, Amount: spent.Neg(), Held: held.Neg()})
+}
+
+// spendHeldStocks takes the sold quantity of a sell order out of the portfolio and its hold
+func (s *Settlement) spendHeldStocks(userName string, order Order, quantity decimal.Decimal) {
+    s.effects = append(s.effects, SettlementEffect{Kind: "PORTFOLIO", UserName: userName, StockID: order.StockID, Amount: quantity.Neg(), Held: quantity.Neg()})
+}
+
+func (s *Settlement) updateMarketStockPrice(stockID string, price *decimal.Decimal) {
+    s.effects = append(s.effects, SettlementEffect{Kind: "MARKET_PRICE", StockID: stockID, Amount: *price})
+}
+
+func (s *Settlement) updateStockCandles(stockID string, price *decimal.Decimal, quantity decimal.Decimal) {
+    s.effects = append(s.effects, SettlementEffect{Kind: "CANDLE", StockID: stockID, Amount: quantity, Price: *price})
+}
+
+// commit writes the outbox, commits the tx_db transaction and queues the effects for the settlement worker
+func (s *Settlement) commit() error {
+    for seq := range s.effects {
+        effect := &s.effects[seq]
+        effect.TimeStamp = s.Time
+        _, err := s.tx.Stmt(stmtInsertSettlementOutbox).Exec(s.ID, seq, effect.Kind, effect.UserName, effect.StockID, effect.Amount, effect.Held, effect.Price, effect.TimeStamp)
+        if err != nil {
+            s.tx.Rollback()
+            return fmt.Errorf("Failed to write settlement outbox: %w", err)
+        }
+    }
+
+    if err := s.tx.Commit(); err != nil {
+        return fmt.Errorf("Failed to commit settlement: %w", err)
+    }
+
+    for seq, effect := range s.effects {
+        select {
+        case settlementQueue <- pendingEffect{s.ID, seq, effect}:
+        default:
+            fmt.Printf("Settlement queue full, effect %d of %s left to the reconciler\n", seq, s.ID)
+        }
+    }
+    return nil
+}
+
+// dispatchSettlementEffect applies an effect with retries, leaving it PENDING for the reconciler if it keeps failing
+func dispatchSettlementEffect(settlementID string, seq int, effect SettlementEffect) {
+    var err error
+    for attempt := 1; attempt <= settlementRetryAttempts; attempt++ {
+        if err = applySettlementEffect(settlementID, seq, effect); err == nil {
+            break
+        }
+        time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+    }
+    if err != nil {
+        fmt.Printf("Settlement %s effect %d left pending: %v\n", settlementID, seq, err)
+        return
+    }
+
+    if _, err := stmtMarkSettlementApplied.Exec(settlementID, seq); err != nil {
+        fmt.Println("Error marking settlement effect applied: ", err)
+    }
+}
+
+// applySettlementEffect applies an effect once, the marker row makes retries of an applied effect a no-op
+func applySettlementEffect(settlementID string, seq int, effect SettlementEffect) error {
+    db, stmtMarkApplied := stock_db, stmtMarkStockSettlementApplied
+    if effect.Kind == "WALLET" || effect.Kind == "FEE" {
+        db, stmtMarkApplied = user_db, stmtMarkUserSettlementApplied
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("Failed to begin settlement effect: %w", err)
+    }
+    defer tx.Rollback()
+
+    result, err := tx.Stmt(stmtMarkApplied).Exec(settlementID, seq)
+    if err != nil {
+        return fmt.Errorf("Failed to mark settlement effect: %w", err)
+    }
+    if applied, _ := result.RowsAffected(); applied == 0 {
+        // already applied by an earlier attempt
+        return nil
+    }
+
+    // the effect's journal entry is keyed by the effect, so it is posted exactly once as well
+    journalID := fmt.Sprintf("%s-%d", settlementID, seq)
+    lines := ledgerLines(effect.UserName, effect.Amount, effect.Held, ledgerClearing)
+
+    switch effect.Kind {
+    case "WALLET":
+        _, err = tx.Stmt(stmtUpdateMoneyWallet).Exec(effect.Amount, effect.Held, effect.UserName)
+        if err == nil {
+            err = postLedgerEntry(tx, stmtInsertUserLedgerEntry, journalID, "FILL", ledgerCash, lines)
+        }
+    case "FEE":
+        _, err = tx.Stmt(stmtUpdateMoneyWallet).Exec(effect.Amount, effect.Held, effect.UserName)
+        if err == nil {
+            err = postLedgerEntry(tx, stmtInsertUserLedgerEntry, journalID, "FEE", ledgerCash, ledgerLines(effect.UserName, effect.Amount, effect.Held, ledgerFees))
+        }
+    case "PORTFOLIO":
+        _, err = tx.Stmt(stmtAddUserStocks).Exec(effect.UserName, effect.StockID, effect.Amount, effect.Held)
+        if err == nil {
+            _, err = tx.Stmt(stmtDeleteEmptyUserStocks).Exec(effect.UserName, effect.StockID)
+        }
+        if err == nil {
+            err = postLedgerEntry(tx, stmtInsertStockLedgerEntry, journalID, "FILL", effect.StockID, lines)
+        }
+    case "MARKET_PRICE":
+        _, err = tx.Stmt(stmtUpdateMarketStockPrice).Exec(effect.Amount, effect.StockID)
+    case "CANDLE":
+        err = foldTradeIntoCandles(tx, effect.StockID, effect.Price, effect.Amount, effect.TimeStamp)
+    default:
+        err = fmt.Errorf("unknown settlement effect %s", effect.Kind)
+    }
+    if err != nil {
+        return fmt.Errorf("Failed to apply settlement effect: %w", err)
+    }
+
+    return tx.Commit()
+}
+
+// reconcileSettlements finds fills whose tx_db part committed but whose effects were not all applied, and applies them
+func reconcileSettlements() {
+    rows, err := stmtGetPendingSettlements.Query()
+    if err != nil {
+        fmt.Println("Error querying pending settlements: ", err)
+        return
+    }
+
+    var pending []pendingEffect
+    for rows.Next() {
+        var item pendingEffect
+        if err := rows.Scan(&item.settlementID, &item.seq, &item.effect.Kind, &item.effect.UserName, &item.effect.StockID, &item.effect.Amount, &item.effect.Held, &item.effect.Price, &item.effect.TimeStamp); err != nil {
+            fmt.Println("Error scanning pending settlement: ", err)
+            continue
+        }
+        pending = append(pending, item)
+    }
+    rows.Close()
+
+    if len(pending) > 0 {
+        fmt.Printf("Reconciling %d pending settlement effects\n", len(pending))
+    }
+    for _, item := range pending {
+        dispatchSettlementEffect(item.settlementID, item.seq, item.effect)
+    }
+}
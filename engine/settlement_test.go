@@ -0,0 +1,43 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestSettlementRecordsEffectsInsteadOfWriting(t *testing.T) {
+    s := &Settlement{ID: "settlement"}
+    sell := limitOrder(t, "sell", false, "10", "5", "1")
+    price := dec(t, "10")
+
+    s.spendHeldMoney("buyer", dec(t, "52"), dec(t, "50"))
+    s.spendHeldStocks("seller", *sell, dec(t, "5"))
+    s.updateMoneyWallet("seller", dec(t, "50"), true)
+    s.updateStockPortfolio("buyer", *sell, dec(t, "5"), true)
+    s.updateMarketStockPrice("stock", &price)
+    s.updateStockCandles("stock", &price, dec(t, "5"))
+
+    want := []struct {
+        kind   string
+        user   string
+        amount string
+        held   string
+    }{
+        {"WALLET", "buyer", "-50", "-52"},
+        {"PORTFOLIO", "seller", "-5", "-5"},
+        {"WALLET", "seller", "50", "0"},
+        {"PORTFOLIO", "buyer", "5", "0"},
+        {"MARKET_PRICE", "", "10", "0"},
+        {"CANDLE", "", "5", "0"},
+    }
+    if len(s.effects) != len(want) {
+        t.Fatalf("got %d effects, want %d", len(s.effects), len(want))
+    }
+    for i, effect := range s.effects {
+        if effect.Kind != want[i].kind || effect.UserName != want[i].user || !effect.Amount.Equal(dec(t, want[i].amount)) || !effect.Held.Equal(dec(t, want[i].held)) {
+            t.Errorf("effect %d is %s %s %v (held %v), want %v", i, effect.Kind, effect.UserName, effect.Amount, effect.Held, want[i])
+        }
+    }
+    if !s.effects[5].Price.Equal(price) || s.effects[1].StockID != "stock" {
+        t.Errorf("the candle or portfolio effect lost its stock or price")
+    }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    _ "time/tzdata" // the session time zone must resolve inside a bare container
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Time in force of LIMIT orders:
+    GTC: rests in the book until it is filled or cancelled
+    DAY: rests until the first session close after it was placed (default)
+    IOC: fills whatever crosses immediately, the rest is cancelled
+    FOK: fills completely on arrival or is rejected before anything is reserved
+*/
+func validateTimeInForce(request *PlaceStockOrderRequest) error {
+    if request.OrderType == "MARKET" || request.OrderType == "STOP" {
+        if request.TimeInForce != "" {
+            return fmt.Errorf("Time in force is only supported for limit and stop limit orders")
+        }
+        return nil
+    }
+
+    switch request.TimeInForce {
+    case "":
+        request.TimeInForce = "DAY"
+    case "GTC", "DAY", "IOC", "FOK":
+    default:
+        return fmt.Errorf("Invalid time in force, must be GTC, DAY, IOC or FOK")
+    }
+    return nil
+}
+
+// nextSessionClose returns the first session close (SESSION_CLOSE in SESSION_TIMEZONE) after t
+func nextSessionClose(t time.Time) time.Time {
+    location := sessionLocation()
+    closeMinute := sessionMinute(sessionClose, "16:00")
+
+    local := t.In(location)
+    sessionEnd := time.Date(local.Year(), local.Month(), local.Day(), closeMinute/60, closeMinute%60, 0, 0, location)
+    if !local.Before(sessionEnd) {
+        sessionEnd = sessionEnd.AddDate(0, 0, 1)
+    }
+    return sessionEnd
+}
+
+// fillableQuantity returns how much of a limit order the opposite side of the book can fill right now.
+// The user's own orders never fill it: self-trade prevention cancels them, and unless the order's mode is
+// CANCEL_OLDEST it also stops the order itself at the first one, so nothing behind that order counts either.
+// A fill that would trip the circuit breaker halts the book before it executes, so the sweep stops at its price.
+func fillableQuantity(book *OrderBook, order Order) decimal.Decimal {
+    restingOrders := book.SellOrders
+    if !order.IsBuy {
+        restingOrders = book.BuyOrders
+    }
+
+    // walk a sorted copy of the queue in matching order, the heap itself is left untouched
+    sweep := PriorityQueue{Order: append([]*Order(nil), restingOrders.Order...), LessFunc: restingOrders.LessFunc}
+    sort.Sort(sweep)
+
+    mode := order.SelfTradePrevention
+    if mode == "" {
+        mode = selfTradePreventionMode
+    }
+
+    var quantity decimal.Decimal
+    for _, restingOrder := range sweep.Order {
+        if !crossesPriceLevel(order, *restingOrder.Price) || tripsCircuitBreaker(book, *restingOrder.Price) {
+            break
+        }
+        if restingOrder.UserName == order.UserName {
+            if mode == "CANCEL_OLDEST" {
+                continue
+            }
+            break
+        }
+        quantity = quantity.Add(restingOrder.Quantity)
+    }
+    return quantity
+}
+
+// cancelUnfilledRemainder removes whatever is left of an IOC or FOK order once matching is done,
+// through the same refund path as a user cancellation
+func cancelUnfilledRemainder(book *OrderBook, order Order) {
+    if order.TimeInForce != "IOC" && order.TimeInForce != "FOK" {
+        return
+    }
+
+    bookOrders := &book.SellOrders
+    if order.IsBuy {
+        bookOrders = &book.BuyOrders
+    }
+
+    for i, restingOrder := range bookOrders.Order {
+        if restingOrder.StockTxID == order.StockTxID {
+            executeRemoveOrder(*restingOrder, bookOrders, i, "CANCELLED")
+            return
+        }
+    }
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestValidateTimeInForce(t *testing.T) {
+    tests := []struct {
+        orderType   string
+        timeInForce string
+        want        string
+        valid       bool
+    }{
+        {"LIMIT", "", "DAY", true},
+        {"LIMIT", "GTC", "GTC", true},
+        {"STOP_LIMIT", "FOK", "FOK", true},
+        {"LIMIT", "GTD", "", false},
+        {"MARKET", "", "", true},
+        {"MARKET", "IOC", "", false},
+        {"STOP", "DAY", "", false},
+    }
+    for _, test := range tests {
+        request := PlaceStockOrderRequest{OrderType: test.orderType, TimeInForce: test.timeInForce}
+        err := validateTimeInForce(&request)
+        if (err == nil) != test.valid {
+            t.Errorf("%s %q: valid is %v, want %v", test.orderType, test.timeInForce, err == nil, test.valid)
+            continue
+        }
+        if test.valid && request.TimeInForce != test.want {
+            t.Errorf("%s %q: time in force is %q, want %q", test.orderType, test.timeInForce, request.TimeInForce, test.want)
+        }
+    }
+}
+
+func TestDayOrdersExpireAtTheNextSessionClose(t *testing.T) {
+    fake := useAuctionSession(t)
+
+    if sessionEnd := nextSessionClose(at(t, "10:00")); !sessionEnd.Equal(at(t, "16:00")) {
+        t.Errorf("an order placed at 10:00 closes at %v, want 16:00 the same day", sessionEnd)
+    }
+    if sessionEnd := nextSessionClose(at(t, "16:00")); !sessionEnd.Equal(at(t, "16:00").AddDate(0, 0, 1)) {
+        t.Errorf("an order placed at the close closes at %v, want 16:00 the next day", sessionEnd)
+    }
+
+    day := Order{TimeInForce: "DAY", TimeStamp: at(t, "10:00").Format(time.RFC3339Nano)}
+    gtc := Order{TimeInForce: "GTC", TimeStamp: day.TimeStamp}
+    // a waiting STOP order has no time in force and expires like a DAY order
+    stop := Order{OrderType: "STOP", TimeStamp: day.TimeStamp}
+
+    fake.now = at(t, "15:59")
+    if isOrderExpired(&day) || isOrderExpired(&stop) {
+        t.Errorf("orders expired before the close")
+    }
+    fake.now = at(t, "16:00")
+    if !isOrderExpired(&day) || !isOrderExpired(&stop) {
+        t.Errorf("orders did not expire at the close")
+    }
+    if isOrderExpired(&gtc) {
+        t.Errorf("a GTC order expired")
+    }
+}
+
+func TestFillableQuantitySkipsOwnOrders(t *testing.T) {
+    own := limitOrder(t, "own", false, "10", "100", "2")
+    own.UserName = "me"
+    book := &OrderBook{
+        StockID: "stock",
+        BuyOrders: bookSide(true),
+        SellOrders: bookSide(false,
+            limitOrder(t, "a", false, "10", "3", "1"),
+            own,
+            limitOrder(t, "b", false, "10.5", "4", "3"),
+            limitOrder(t, "c", false, "11", "5", "4"),
+        ),
+    }
+
+    tests := []struct {
+        mode     string
+        quantity string
+    }{
+        {"CANCEL_NEWEST", "3"},
+        {"CANCEL_BOTH", "3"},
+        {"CANCEL_OLDEST", "7"},
+    }
+    for _, test := range tests {
+        order := *limitOrder(t, "buy", true, "10.5", "20", "5")
+        order.UserName = "me"
+        order.SelfTradePrevention = test.mode
+        if quantity := fillableQuantity(book, order); !quantity.Equal(dec(t, test.quantity)) {
+            t.Errorf("%s: fillable quantity is %v, want %s", test.mode, quantity, test.quantity)
+        }
+    }
+
+    other := *limitOrder(t, "other", true, "10.5", "20", "5")
+    if quantity := fillableQuantity(book, other); !quantity.Equal(dec(t, "107")) {
+        t.Errorf("another user can fill %v, want 107", quantity)
+    }
+}
+
+func TestFillableQuantityStopsAtTheCircuitBreaker(t *testing.T) {
+    savedClock, savedMove := clock, haltMovePercent
+    defer func() { clock, haltMovePercent = savedClock, savedMove }()
+    fake := &fakeClock{now: at(t, "10:00")}
+    clock, haltMovePercent = fake, dec(t, "15")
+
+    book := &OrderBook{
+        StockID:   "stock",
+        BuyOrders: bookSide(true),
+        SellOrders: bookSide(false,
+            limitOrder(t, "a", false, "10", "3", "1"),
+            limitOrder(t, "b", false, "11", "4", "2"),
+            limitOrder(t, "c", false, "12", "5", "3"),
+        ),
+        recentPrices: []tradePrice{{Time: at(t, "09:58"), Price: dec(t, "10")}},
+    }
+
+    // a fill at 12 moves the price 20% from the trade at 10
+    order := *limitOrder(t, "buy", true, "12", "12", "4")
+    if quantity := fillableQuantity(book, order); !quantity.Equal(dec(t, "7")) {
+        t.Errorf("fillable quantity is %v, want 7 below the circuit breaker", quantity)
+    }
+
+    // the trade at 10 left the halt window
+    fake.now = at(t, "10:10")
+    if quantity := fillableQuantity(book, order); !quantity.Equal(dec(t, "12")) {
+        t.Errorf("fillable quantity is %v, want 12 once the window moved on", quantity)
+    }
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    Trade tape: every match writes one row to the trades table of tx_db, linking the buy and sell order of the
+    execution. The row is written in the fill's settlement transaction, so a trade is on the tape exactly when
+    its stock_transactions rows are.
+*/
+type Trade struct {
+    TradeID   string
+    StockID   string
+    Price     decimal.Decimal
+    Quantity  decimal.Decimal
+    BuyTxID   string
+    SellTxID  string
+    Aggressor string // BUY or SELL, the side of the newest order
+    TimeStamp time.Time
+}
+
+func newTrade(buyOrder *Order, sellOrder *Order, quantity decimal.Decimal, price decimal.Decimal) Trade {
+    aggressor := "BUY"
+    if sellOrder.TimeStamp > buyOrder.TimeStamp {
+        aggressor = "SELL"
+    }
+
+    return Trade{
+        TradeID:   generateOrderID(),
+        StockID:   buyOrder.StockID,
+        Price:     price,
+        Quantity:  quantity,
+        BuyTxID:   buyOrder.StockTxID,
+        SellTxID:  sellOrder.StockTxID,
+        Aggressor: aggressor,
+    }
+}
+
+func (s *Settlement) recordTrade(trade *Trade) error {
+    trade.TimeStamp = s.Time
+
+    _, err := s.tx.Stmt(stmtInsertTrade).Exec(trade.TradeID, trade.StockID, trade.Price, trade.Quantity, trade.BuyTxID, trade.SellTxID, trade.Aggressor, trade.TimeStamp)
+    if err != nil {
+        return fmt.Errorf("Failed to record trade: %w", err)
+    }
+    return nil
+}
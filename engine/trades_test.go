@@ -0,0 +1,28 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestNewTradeLinksBothOrders(t *testing.T) {
+    buy := limitOrder(t, "buy", true, "10", "5", "2")
+    sell := limitOrder(t, "sell", false, "10", "5", "1")
+
+    trade := newTrade(buy, sell, dec(t, "3"), dec(t, "10"))
+    if trade.BuyTxID != "buy" || trade.SellTxID != "sell" || trade.StockID != "stock" || trade.TradeID == "" {
+        t.Errorf("the trade does not link both orders: %+v", trade)
+    }
+    if !trade.Quantity.Equal(dec(t, "3")) || !trade.Price.Equal(dec(t, "10")) {
+        t.Errorf("the trade is %v @ %v, want 3 @ 10", trade.Quantity, trade.Price)
+    }
+    if trade.Aggressor != "BUY" {
+        t.Errorf("the aggressor is %s, want the newer buy", trade.Aggressor)
+    }
+
+    if trade := newTrade(limitOrder(t, "old", true, "10", "5", "1"), limitOrder(t, "new", false, "10", "5", "2"), dec(t, "1"), dec(t, "10")); trade.Aggressor != "SELL" {
+        t.Errorf("the aggressor is %s, want the newer sell", trade.Aggressor)
+    }
+    if other := newTrade(buy, sell, dec(t, "1"), dec(t, "10")); other.TradeID == trade.TradeID {
+        t.Errorf("two trades share the id %s", trade.TradeID)
+    }
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "time"
+
+    "github.com/shopspring/decimal"
+)
+
+/*
+    STOP and STOP_LIMIT orders wait in the book's trigger book until the last trade price (the book's LastTradePrice,
+    set by recordTradePrice for every settled trade) reaches their stop price: at or above it for a buy, at or below it
+    for a sell. The stock's current_price is not used, a resting limit sell sets it without any trade.
+    Once triggered, a STOP order becomes a MARKET order and a STOP_LIMIT order a LIMIT order, and it is placed
+    through placeOrderInBook with the same wallet/stock checks and reservations as any other order.
+    Nothing is reserved while an order waits, its stock transaction row has status PENDING_TRIGGER. The triggered order
+    is written over that row, the only row the insert of an order may replace.
+*/
+func addTriggerOrder(book *OrderBook, order Order) error {
+    order.Status = "PENDING_TRIGGER"
+
+    // a STOP order has no price of its own yet, record the stop price instead
+    recordedPrice := order.Price
+    if recordedPrice == nil {
+        recordedPrice = order.StopPrice
+    }
+
+    if err := setStockTransaction(nil, order.UserName, order, recordedPrice, order.Quantity); err != nil {
+        return err
+    }
+
+    book.TriggerOrders = append(book.TriggerOrders, &order)
+    publishOrderStatus(order, order.Status)
+    return nil
+}
+
+// releaseTriggeredOrders places every waiting stop order whose stop price has been reached, oldest first.
+// Triggered orders can trade and move the price again, so the check repeats until nothing else triggers.
+func releaseTriggeredOrders(book *OrderBook) {
+    for len(book.TriggerOrders) > 0 {
+        lastPrice := book.LastTradePrice
+
+        // no trade has set a price for this stock yet
+        if !lastPrice.IsPositive() {
+            return
+        }
+
+        index := -1
+        for i, order := range book.TriggerOrders {
+            if isStopTriggered(*order, lastPrice) {
+                index = i
+                break
+            }
+        }
+        if index == -1 {
+            return
+        }
+
+        order := book.TriggerOrders[index]
+        book.TriggerOrders = append(book.TriggerOrders[:index], book.TriggerOrders[index+1:]...)
+        activateStopOrder(book, *order)
+    }
+}
+
+func isStopTriggered(order Order, lastPrice decimal.Decimal) bool {
+    if order.IsBuy {
+        return lastPrice.GreaterThanOrEqual(*order.StopPrice)
+    }
+    return lastPrice.LessThanOrEqual(*order.StopPrice)
+}
+
+func activateStopOrder(book *OrderBook, order Order) {
+    if order.OrderType == "STOP" {
+        order.OrderType = "MARKET"
+        order.Price = nil
+    } else {
+        order.OrderType = "LIMIT"
+    }
+    order.Status = "IN_PROGRESS"
+    order.TimeStamp = time.Now().Format(time.RFC3339Nano)
+
+    if orderErr := placeOrderInBook(book, order); orderErr != nil {
+        fmt.Println("Triggered stop order rejected: ", orderErr)
+        if err := setStatus(nil, &order, "REJECTED", false); err != nil {
+            fmt.Println("Error setting status: ", err)
+        }
+        publishOrderStatus(order, "REJECTED")
+    }
+}
+
+// cancelTriggerOrder removes a user's stop order that has not triggered yet, there is nothing to refund
+func cancelTriggerOrder(book *OrderBook, StockTxID string, userName string) bool {
+    for i, order := range book.TriggerOrders {
+        if order.StockTxID != StockTxID || order.UserName != userName {
+            continue
+        }
+
+        book.TriggerOrders = append(book.TriggerOrders[:i], book.TriggerOrders[i+1:]...)
+        if err := setStatus(nil, order, "CANCELLED", false); err != nil {
+            fmt.Println("Error setting status: ", err)
+        }
+        publishOrderStatus(*order, "CANCELLED")
+        return true
+    }
+    return false
+}
+
+// expireTriggerOrders closes the waiting stop orders that expired, STOP orders have no time in force and are DAY orders.
+// A waiting order holds nothing, so there is nothing to release.
+func expireTriggerOrders(book *OrderBook) {
+    waiting := book.TriggerOrders[:0]
+    for _, order := range book.TriggerOrders {
+        if !isOrderExpired(order) {
+            waiting = append(waiting, order)
+            continue
+        }
+
+        if err := setStatus(nil, order, "EXPIRED", false); err != nil {
+            fmt.Println("Error setting status: ", err)
+        }
+        publishOrderStatus(*order, "EXPIRED")
+    }
+    book.TriggerOrders = waiting
+}
+
+// loadLastTradePrice reads the price of the stock's last trade from the trade tape
+func loadLastTradePrice(book *OrderBook) {
+    err := stmtGetLastTradePrice.QueryRow(book.StockID).Scan(&book.LastTradePrice)
+    if err != nil && err != sql.ErrNoRows {
+        fmt.Println("Failed to get last trade price: ", err)
+    }
+}
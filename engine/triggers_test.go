@@ -0,0 +1,59 @@
+package main
+
+import (
+    "testing"
+)
+
+// stopOrder builds a waiting STOP order
+func stopOrder(t *testing.T, id string, isBuy bool, stopPrice string) *Order {
+    t.Helper()
+    price := dec(t, stopPrice)
+    return &Order{StockTxID: id, StockID: "stock", IsBuy: isBuy, OrderType: "STOP", Quantity: dec(t, "1"), StopPrice: &price, UserName: "user-" + id}
+}
+
+func TestIsStopTriggered(t *testing.T) {
+    buy := *stopOrder(t, "buy", true, "10")
+    sell := *stopOrder(t, "sell", false, "10")
+
+    if isStopTriggered(buy, dec(t, "9.99")) || !isStopTriggered(buy, dec(t, "10")) || !isStopTriggered(buy, dec(t, "11")) {
+        t.Errorf("a buy stop at 10 must trigger once the last trade is at or above 10")
+    }
+    if isStopTriggered(sell, dec(t, "10.01")) || !isStopTriggered(sell, dec(t, "10")) || !isStopTriggered(sell, dec(t, "9")) {
+        t.Errorf("a sell stop at 10 must trigger once the last trade is at or below 10")
+    }
+}
+
+func TestStopsWaitForTheLastTradePrice(t *testing.T) {
+    book := &OrderBook{StockID: "stock", BuyOrders: bookSide(true), SellOrders: bookSide(false)}
+    book.TriggerOrders = []*Order{stopOrder(t, "buy", true, "10"), stopOrder(t, "sell", false, "8")}
+    registerBook(t, book)
+
+    // a resting order moves the stock's price without a trade, that must not trigger anything
+    book.LastPrice = dec(t, "12")
+    releaseTriggeredOrders(book)
+    if len(book.TriggerOrders) != 2 {
+        t.Fatalf("a stop triggered before any trade")
+    }
+
+    trade := Trade{StockID: "stock", Price: dec(t, "9")}
+    recordTradePrice(&trade)
+    if !book.LastTradePrice.Equal(dec(t, "9")) {
+        t.Fatalf("the last trade price is %v, want 9", book.LastTradePrice)
+    }
+    releaseTriggeredOrders(book)
+    if len(book.TriggerOrders) != 2 {
+        t.Errorf("a stop triggered at 9 between the stop prices")
+    }
+}
+
+func TestStopOrdersAreOnlyCancelledByTheirOwner(t *testing.T) {
+    book := &OrderBook{StockID: "stock", BuyOrders: bookSide(true), SellOrders: bookSide(false)}
+    book.TriggerOrders = []*Order{stopOrder(t, "stop", true, "10")}
+
+    if cancelTriggerOrder(book, "stop", "user-other") {
+        t.Errorf("another user cancelled the stop order")
+    }
+    if len(book.TriggerOrders) != 1 {
+        t.Errorf("the stop order left the trigger book")
+    }
+}
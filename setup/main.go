@@ -11,10 +11,23 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
+	"github.com/shopspring/decimal"
 )
 
 type Stock struct {
-	StockName string `json:"stock_name"`
+	StockName    string           `json:"stock_name"`
+	MatchingMode string           `json:"matching_mode"`
+	TickSize     *decimal.Decimal `json:"tick_size"` // prices must be a multiple of it (default 0.01)
+	LotSize      *decimal.Decimal `json:"lot_size"`  // quantities must be a multiple of it (default 1)
+
+	// Price bands in percent around the reference and last price, nil uses the engine's defaults and 0 disables them
+	StaticBandPercent  *decimal.Decimal `json:"static_band_percent"`
+	DynamicBandPercent *decimal.Decimal `json:"dynamic_band_percent"`
+
+	// Trading fees in percent of a fill's notional and the minimum fee of a fill, nil uses the engine's defaults
+	MakerFeePercent *decimal.Decimal `json:"maker_fee_percent"`
+	TakerFeePercent *decimal.Decimal `json:"taker_fee_percent"`
+	MinFee          *decimal.Decimal `json:"min_fee"`
 }
 
 const (
@@ -31,8 +44,8 @@ const (
 )
 
 type AddStockRequest struct {
-	StockID  string  `json:"stock_id"`
-	Quantity float64 `json:"quantity"`
+	StockID  string          `json:"stock_id"`
+	Quantity decimal.Decimal `json:"quantity"`
 }
 
 type ErrorResponse struct {
@@ -67,6 +80,47 @@ func createStock(c *gin.Context) {
 		return
 	}
 
+	// Stocks are matched with price-time priority unless pro-rata is requested
+	if json.MatchingMode == "" {
+		json.MatchingMode = "FIFO"
+	}
+	if json.MatchingMode != "FIFO" && json.MatchingMode != "PRO_RATA" {
+		handleError(c, http.StatusBadRequest, "Invalid matching mode, must be FIFO or PRO_RATA", nil)
+		return
+	}
+
+	// Prices and quantities are stored with two decimals, so the increments must fit in them
+	if json.TickSize == nil {
+		tickSize := decimal.New(1, -2)
+		json.TickSize = &tickSize
+	}
+	if json.LotSize == nil {
+		lotSize := decimal.NewFromInt(1)
+		json.LotSize = &lotSize
+	}
+	if !isValidIncrement(*json.TickSize) || !isValidIncrement(*json.LotSize) {
+		handleError(c, http.StatusBadRequest, "Tick size and lot size must be positive multiples of 0.01", nil)
+		return
+	}
+
+	for _, band := range []*decimal.Decimal{json.StaticBandPercent, json.DynamicBandPercent} {
+		if band != nil && (band.IsNegative() || !band.Equal(band.Round(2))) {
+			handleError(c, http.StatusBadRequest, "Price bands must be non-negative percentages with at most two decimals", nil)
+			return
+		}
+	}
+
+	for _, rate := range []*decimal.Decimal{json.MakerFeePercent, json.TakerFeePercent} {
+		if rate != nil && (rate.IsNegative() || rate.GreaterThan(decimal.NewFromInt(100)) || !rate.Equal(rate.Round(4))) {
+			handleError(c, http.StatusBadRequest, "Fee rates must be percentages between 0 and 100 with at most four decimals", nil)
+			return
+		}
+	}
+	if json.MinFee != nil && (json.MinFee.IsNegative() || !json.MinFee.Equal(json.MinFee.Round(2))) {
+		handleError(c, http.StatusBadRequest, "Minimum fee must be a non-negative amount in whole cents", nil)
+		return
+	}
+
 	// Generate UUID as string for the new stock
 	stockID := uuid.New().String()
 
@@ -85,6 +139,10 @@ func createStock(c *gin.Context) {
 	})
 }
 
+func isValidIncrement(increment decimal.Decimal) bool {
+	return increment.IsPositive() && increment.Equal(increment.Round(2))
+}
+
 func saveStockToDatabase(stock Stock, stockID string) error {
 	// Define formatted string for database connection
 	postgresqlDbInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", stock_host, stock_port, user, password, dbname)
@@ -97,7 +155,7 @@ func saveStockToDatabase(stock Stock, stockID string) error {
 	defer db.Close()
 
 	// Insert stock into the stocks table with provided stockID
-    _, err = db.Exec("INSERT INTO stocks (stock_id, stock_name, time_added) VALUES ($1, $2, $3)", stockID, stock.StockName, time.Now())
+    _, err = db.Exec("INSERT INTO stocks (stock_id, stock_name, matching_mode, tick_size, lot_size, static_band_percent, dynamic_band_percent, maker_fee_percent, taker_fee_percent, min_fee, time_added) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)", stockID, stock.StockName, stock.MatchingMode, *stock.TickSize, *stock.LotSize, stock.StaticBandPercent, stock.DynamicBandPercent, stock.MakerFeePercent, stock.TakerFeePercent, stock.MinFee, time.Now())
 	if err != nil {
 		return err
 	}
@@ -130,8 +188,16 @@ func addStockToUser(c *gin.Context) {
 	fmt.Println("userName:", userName)
 	fmt.Println("ID:", req.StockID)
 	fmt.Println("quantity:", req.Quantity)
+	// The stocks and their ledger entry are written together
+	tx, err := db.Begin()
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to add stock to user", err)
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert stock into user_stocks table
-	_, err = db.Exec(`
+	_, err = tx.Exec(`
 		INSERT INTO user_stocks (user_name, stock_id, quantity)
 		VALUES ($1, $2, $3)
 		ON CONFLICT (user_name, stock_id)
@@ -142,6 +208,24 @@ func addStockToUser(c *gin.Context) {
 		return
 	}
 
+	// The stocks come from the EXTERNAL system account
+	_, err = tx.Exec(`
+		WITH journal AS (SELECT gen_random_uuid()::text AS journal_id)
+		INSERT INTO ledger_entries (journal_id, account, sub_account, asset, amount, kind)
+		SELECT journal_id, $1, 'AVAILABLE', $2, $3::numeric, 'DEPOSIT' FROM journal
+		UNION ALL
+		SELECT journal_id, 'EXTERNAL', 'MAIN', $2, -$3::numeric, 'DEPOSIT' FROM journal;
+	`, userName, req.StockID, req.Quantity)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to post ledger entry", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to add stock to user", err)
+		return
+	}
+
 	// If everything succeeded, return success response
 	response := PostResponse{
 		Success: true,
@@ -164,7 +248,7 @@ func wipeDatabaseTables(c *gin.Context) {
 	defer stock_db.Close()
 
 	// Define a list of tables to truncate
-	stock_tables := []string{"stocks", "user_stocks"}
+	stock_tables := []string{"stocks", "user_stocks", "applied_settlements", "ledger_entries"}
 
 	// Truncate each table. This will delete all rows in the table
 	for _, stock_table := range stock_tables {
@@ -192,7 +276,7 @@ func wipeDatabaseTables(c *gin.Context) {
 	defer user_db.Close()
 
 	// Define a list of tables to truncate
-	user_tables := []string{"users"}
+	user_tables := []string{"users", "applied_settlements", "ledger_entries"}
 
 	// Truncate each table. This will delete all rows in the table
 	for _, user_table := range user_tables {
@@ -211,7 +295,7 @@ func wipeDatabaseTables(c *gin.Context) {
 	defer tx_db.Close()
 
 	// Define a list of tables to truncate
-	tx_tables := []string{"stock_transactions", "wallet_transactions"}
+	tx_tables := []string{"stock_transactions", "wallet_transactions", "settlement_outbox", "withdrawals", "client_orders"}
 
 	// Truncate each table. This will delete all rows in the table
 	for _, tx_table := range tx_tables {
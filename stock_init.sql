@@ -2,6 +2,16 @@ CREATE TABLE IF NOT EXISTS stocks (
     stock_id TEXT UNIQUE PRIMARY KEY,
     stock_name TEXT UNIQUE,
     current_price NUMERIC(20,2) DEFAULT 0,
+    matching_mode TEXT DEFAULT 'FIFO' CHECK (matching_mode IN ('FIFO', 'PRO_RATA')),
+    tick_size NUMERIC(20,2) DEFAULT 0.01 CHECK (tick_size > 0),
+    lot_size NUMERIC(20,2) DEFAULT 1 CHECK (lot_size > 0),
+    static_band_percent NUMERIC(6,2) CHECK (static_band_percent >= 0),
+    dynamic_band_percent NUMERIC(6,2) CHECK (dynamic_band_percent >= 0),
+    maker_fee_percent NUMERIC(7,4) CHECK (maker_fee_percent >= 0), -- NULL uses the engine's FEE_MAKER_PERCENT
+    taker_fee_percent NUMERIC(7,4) CHECK (taker_fee_percent >= 0), -- NULL uses the engine's FEE_TAKER_PERCENT
+    min_fee NUMERIC(20,2) CHECK (min_fee >= 0),                     -- NULL uses the engine's FEE_MINIMUM
+    is_halted BOOLEAN NOT NULL DEFAULT FALSE,
+    halted_until TIMESTAMP,
     time_added TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -10,7 +20,58 @@ CREATE TABLE IF NOT EXISTS user_stocks (
     stock_id TEXT REFERENCES stocks(stock_id),
     quantity NUMERIC(20,2),
     time_added TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- part of quantity reserved by open sell orders, the rest is available
+    quantity_held NUMERIC(20,2) NOT NULL DEFAULT 0,
     PRIMARY KEY (user_name, stock_id)
 );
 
+-- OHLCV bars per stock and interval (1m, 5m, 1h, 1d), keyed by the UTC start of the bucket
+CREATE TABLE IF NOT EXISTS stock_candles (
+    stock_id TEXT REFERENCES stocks(stock_id),
+    candle_interval TEXT,
+    bucket_start TIMESTAMP,
+    open NUMERIC(20,2),
+    high NUMERIC(20,2),
+    low NUMERIC(20,2),
+    close NUMERIC(20,2),
+    volume NUMERIC(20,2) DEFAULT 0,
+    trade_count INT DEFAULT 0,
+    open_time TIMESTAMP,
+    close_time TIMESTAMP,
+    PRIMARY KEY (stock_id, candle_interval, bucket_start)
+);
+
+-- Settlement effects already applied to this database, makes retried fills idempotent
+CREATE TABLE IF NOT EXISTS applied_settlements (
+    settlement_id TEXT,
+    seq INT,
+    time_applied TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (settlement_id, seq)
+);
+
+-- General ledger, append only: every portfolio change is posted here as a journal entry whose lines sum to zero
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    entry_id BIGSERIAL PRIMARY KEY,
+    journal_id TEXT NOT NULL,
+    account TEXT NOT NULL,      -- user name, or the system account EXTERNAL or CLEARING
+    sub_account TEXT NOT NULL,  -- AVAILABLE or HELD for users, MAIN for system accounts
+    asset TEXT NOT NULL,        -- stock id
+    amount NUMERIC(20,2) NOT NULL,
+    kind TEXT NOT NULL,         -- DEPOSIT, HOLD, RELEASE or FILL
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_idx ON ledger_entries (account, asset);
+CREATE INDEX IF NOT EXISTS ledger_entries_journal_idx ON ledger_entries (journal_id);
+
+CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS TRIGGER AS $$
+    BEGIN
+    RAISE EXCEPTION 'ledger entries cannot be changed or deleted';
+    END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER ledger_entries_append_only
+BEFORE UPDATE OR DELETE ON ledger_entries
+FOR EACH ROW EXECUTE FUNCTION ledger_append_only();
+
 ALTER SYSTEM SET port = 5431;
\ No newline at end of file
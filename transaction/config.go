@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Most a user can withdraw per day, withdrawals that failed do not count
+var withdrawalDailyLimit = getEnvDecimal("WITHDRAWAL_DAILY_LIMIT", decimal.NewFromInt(10000))
+
+// How long the local fake payout provider takes to pay a withdrawal out, and the amount above which it fails them (0 never fails)
+var fakePayoutDelay = getEnvDuration("FAKE_PAYOUT_DELAY", 2*time.Second)
+var fakePayoutFailAbove = getEnvDecimal("FAKE_PAYOUT_FAIL_ABOVE", decimal.Zero)
+
+// The amount above which the local fake payment provider declines deposits (0 never declines)
+var fakePaymentFailAbove = getEnvDecimal("FAKE_PAYMENT_FAIL_ABOVE", decimal.Zero)
+
+// getEnvDecimal reads a numeric setting from the environment, falling back to the default when unset or invalid
+func getEnvDecimal(key string, fallback decimal.Decimal) decimal.Decimal {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := decimal.NewFromString(value)
+	if err != nil {
+		fmt.Printf("Invalid value %q for %s, using default %v\n", value, key, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// getEnvDuration reads a duration setting (e.g. 5m) from the environment, falling back to the default when unset or invalid
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("Invalid value %q for %s, using default %v\n", value, key, fallback)
+		return fallback
+	}
+	return parsed
+}
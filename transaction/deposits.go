@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+/*
+	Deposits: /addMoneyToWallet charges the amount through the payment provider before it reaches the wallet. The
+	deposit is written as a PENDING wallet transaction first, then credited (EXTERNAL to AVAILABLE in the ledger, under
+	the wallet_tx_id as journal id) and marked COMPLETED, or marked FAILED when the charge is declined.
+
+	A deposit may carry an idempotency_key that is unique per user. Its wallet_tx_id is derived from the user name and
+	key, so a retry finds the first deposit instead of charging again. Deposits still PENDING at startup are charged
+	again with the same wallet_tx_id, which the provider must not charge twice.
+*/
+
+// Deposit is money paid into a user's wallet, or the original deposit of a retry (Duplicate)
+type Deposit struct {
+	WalletTxID     string          `json:"wallet_tx_id"`
+	UserName       string          `json:"-"`
+	Amount         decimal.Decimal `json:"amount"`
+	Status         string          `json:"status"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	Duplicate      bool            `json:"duplicate"`
+}
+
+type AddMoney struct {
+	Amount         decimal.Decimal `json:"amount"`
+	IdempotencyKey string          `json:"idempotency_key"`
+}
+
+type DepositResponse struct {
+	Success bool    `json:"success"`
+	Data    Deposit `json:"data"`
+}
+
+// PaymentProvider collects deposits from the user's payment method, a declined charge returns an error
+type PaymentProvider interface {
+	ChargeDeposit(deposit Deposit) error
+}
+
+// fakePaymentProvider stands in for a card processor: it accepts every charge, except those above failAbove when it is set
+type fakePaymentProvider struct {
+	failAbove decimal.Decimal
+}
+
+func (provider fakePaymentProvider) ChargeDeposit(deposit Deposit) error {
+	if provider.failAbove.IsPositive() && deposit.Amount.GreaterThan(provider.failAbove) {
+		return fmt.Errorf("charge of %v is above the limit of %v", deposit.Amount, provider.failAbove)
+	}
+	return nil
+}
+
+var paymentProvider PaymentProvider = fakePaymentProvider{failAbove: fakePaymentFailAbove}
+
+func addMoneyToWallet(c *gin.Context) {
+	userName, _ := c.Get("user_name")
+
+	if userName == nil {
+		handleError(c, http.StatusBadRequest, "Failed to obtain the user name", nil)
+		return
+	}
+
+	var addMoney AddMoney
+	if err := c.ShouldBindJSON(&addMoney); err != nil {
+		handleError(c, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+
+	// Wallets hold whole cents, sub-cent amounts are rejected instead of being rounded by the database
+	if !addMoney.Amount.IsPositive() || !addMoney.Amount.Equal(addMoney.Amount.Round(2)) {
+		handleError(c, http.StatusOK, "Invalid amount", nil)
+		return
+	}
+
+	if len(addMoney.IdempotencyKey) > 64 {
+		handleError(c, http.StatusBadRequest, "Invalid idempotency_key, at most 64 characters", nil)
+		return
+	}
+
+	var balance, held decimal.Decimal
+	if err := stmtWalletBalance.QueryRow(userName).Scan(&balance, &held); err != nil {
+		if err == sql.ErrNoRows {
+			handleError(c, http.StatusBadRequest, "User not found", nil)
+			return
+		}
+		handleError(c, http.StatusInternalServerError, "Failed to query wallet balance", err)
+		return
+	}
+
+	deposit, err := insertDeposit(userName.(string), addMoney.Amount, addMoney.IdempotencyKey)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to create deposit", err)
+		return
+	}
+
+	if deposit.Duplicate {
+		if !deposit.Amount.Equal(addMoney.Amount) {
+			handleError(c, http.StatusConflict, "The idempotency_key was used for a different amount", nil)
+			return
+		}
+		if deposit.Status == "PENDING" {
+			handleError(c, http.StatusConflict, "A deposit with this idempotency_key is still being processed", nil)
+			return
+		}
+	} else {
+		chargeErr := paymentProvider.ChargeDeposit(deposit)
+		if err := finishDeposit(&deposit, chargeErr); err != nil {
+			handleError(c, http.StatusInternalServerError, "Failed to update wallet", err)
+			return
+		}
+	}
+
+	if deposit.Status == "FAILED" {
+		handleError(c, http.StatusOK, "Payment declined", nil)
+		return
+	}
+
+	response := DepositResponse{
+		Success: true,
+		Data:    deposit,
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// insertDeposit creates a PENDING deposit, or returns the user's deposit that already used the idempotency key
+func insertDeposit(userName string, amount decimal.Decimal, idempotencyKey string) (Deposit, error) {
+	deposit := Deposit{UserName: userName, Amount: amount, Status: "PENDING", IdempotencyKey: idempotencyKey}
+
+	err := stmtInsertDeposit.QueryRow(userName, amount, idempotencyKey).Scan(&deposit.WalletTxID)
+	if err != sql.ErrNoRows {
+		return deposit, err
+	}
+
+	// the insert only writes nothing when the key was used before
+	deposit.Duplicate = true
+	err = stmtGetDeposit.QueryRow(userName, idempotencyKey).Scan(&deposit.WalletTxID, &deposit.Amount, &deposit.Status)
+	return deposit, err
+}
+
+// finishDeposit credits a charged deposit and marks it COMPLETED, or marks it FAILED when the charge was declined
+func finishDeposit(deposit *Deposit, chargeErr error) error {
+	status := "COMPLETED"
+	if chargeErr == nil {
+		if err := applyWalletChange(deposit.WalletTxID, "DEPOSIT", deposit.UserName, deposit.Amount, decimal.Zero); err != nil {
+			return err
+		}
+	} else {
+		status = "FAILED"
+		fmt.Printf("Deposit %s declined: %v\n", deposit.WalletTxID, chargeErr)
+	}
+
+	// the deposit stays PENDING when this fails, the next startup finishes it again without crediting twice
+	if _, err := stmtSetWalletTransactionStatus.Exec(status, deposit.WalletTxID); err != nil {
+		return err
+	}
+	deposit.Status = status
+	return nil
+}
+
+// resumePendingDeposits finishes the deposits that were still PENDING at shutdown
+func resumePendingDeposits() {
+	rows, err := stmtPendingDeposits.Query()
+	if err != nil {
+		fmt.Println("Failed to query pending deposits: ", err)
+		return
+	}
+
+	var pending []Deposit
+	for rows.Next() {
+		deposit := Deposit{Status: "PENDING"}
+		if err := rows.Scan(&deposit.WalletTxID, &deposit.UserName, &deposit.Amount, &deposit.IdempotencyKey); err != nil {
+			fmt.Println("Failed to scan pending deposit: ", err)
+			continue
+		}
+		pending = append(pending, deposit)
+	}
+	rows.Close()
+
+	for i := range pending {
+		if err := finishDeposit(&pending[i], paymentProvider.ChargeDeposit(pending[i])); err != nil {
+			fmt.Printf("Failed to finish deposit %s: %v\n", pending[i].WalletTxID, err)
+		}
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("Resumed %d pending deposits\n", len(pending))
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestAddMoneyToWalletRejectsInvalidDeposits(t *testing.T) {
+	for _, body := range []string{`{"amount": 0}`, `{"amount": -5}`, `{"amount": 10.001}`} {
+		if _, message := postHandler(addMoneyToWallet, body); message != "Invalid amount" {
+			t.Errorf("%s got %q, want Invalid amount", body, message)
+		}
+	}
+
+	body := `{"amount": 10, "idempotency_key": "` + strings.Repeat("k", 65) + `"}`
+	if code, _ := postHandler(addMoneyToWallet, body); code != 400 {
+		t.Errorf("an idempotency key of 65 characters got %d, want 400", code)
+	}
+}
+
+func TestFakePaymentProvider(t *testing.T) {
+	provider := fakePaymentProvider{failAbove: decimal.NewFromInt(100)}
+	if err := provider.ChargeDeposit(Deposit{Amount: decimal.NewFromInt(100)}); err != nil {
+		t.Errorf("a charge at the limit was declined: %v", err)
+	}
+	if err := provider.ChargeDeposit(Deposit{Amount: decimal.NewFromInt(101)}); err == nil {
+		t.Errorf("a charge above the limit was accepted")
+	}
+	if err := (fakePaymentProvider{}).ChargeDeposit(Deposit{Amount: decimal.NewFromInt(1000000)}); err != nil {
+		t.Errorf("a provider without a limit declined a charge: %v", err)
+	}
+}
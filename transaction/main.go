@@ -4,12 +4,14 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Poomon001/day-trading-package/identification"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
+	"github.com/shopspring/decimal"
 )
 
 var user_db *sql.DB
@@ -30,26 +32,52 @@ const (
 )
 
 var (
-	stmtAddMoney *sql.Stmt
 	stmtWalletBalance *sql.Stmt
 	stmtStockPortfolio *sql.Stmt
 	stmtWalletTransactions *sql.Stmt
 	stmtStockTransactions *sql.Stmt
 	stmtStockPrices *sql.Stmt
+	stmtStockCandles *sql.Stmt
+	stmtTrades *sql.Stmt
+	stmtLockAvailableFunds *sql.Stmt
+	stmtUpdateWallet *sql.Stmt
+	stmtPostLedgerLine *sql.Stmt
+	stmtJournalPosted *sql.Stmt
+	stmtWithdrawnToday *sql.Stmt
+	stmtInsertWithdrawal *sql.Stmt
+	stmtInsertWithdrawalTransaction *sql.Stmt
+	stmtFinishWithdrawal *sql.Stmt
+	stmtSetWalletTransactionStatus *sql.Stmt
+	stmtPendingWithdrawals *sql.Stmt
+	stmtInsertDeposit *sql.Stmt
+	stmtGetDeposit *sql.Stmt
+	stmtPendingDeposits *sql.Stmt
 )
 
-type ErrorResponse struct {
-	Success bool              `json:"success"`
-	Data    map[string]string `json:"data"`
+// Candle intervals kept by the engine, and how many candles are returned when no from is given
+var candleIntervals = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
 }
 
-type AddMoney struct {
-	Amount float64 `json:"amount"`
+const defaultCandleCount = 100
+
+// Page size of /getTrades
+const (
+	defaultTradeLimit = 50
+	maxTradeLimit     = 500
+)
+
+func init() {
+	// amounts, prices and quantities are written as JSON numbers, the way the API has always returned them
+	decimal.MarshalJSONWithoutQuotes = true
 }
 
-type PostResponse struct {
-	Success bool    `json:"success"`
-	Data    *string `json:"data"`
+type ErrorResponse struct {
+	Success bool              `json:"success"`
+	Data    map[string]string `json:"data"`
 }
 
 type WalletBalanceResponse struct {
@@ -57,8 +85,11 @@ type WalletBalanceResponse struct {
 	Data    WalletData `json:"data"`
 }
 
+// Balance is the whole wallet, Held the part reserved by open buy orders and Available what can still be spent
 type WalletData struct {
-	Balance float64 `json:"balance"`
+	Balance   decimal.Decimal `json:"balance"`
+	Available decimal.Decimal `json:"available"`
+	Held      decimal.Decimal `json:"held"`
 }
 
 type StockResponse struct {
@@ -67,15 +98,19 @@ type StockResponse struct {
 }
 
 type StockData struct {
-	StockID      string  `json:"stock_id"`
-	StockName    string  `json:"stock_name"`
-	CurrentPrice float64 `json:"current_price"`
+	StockID      string          `json:"stock_id"`
+	StockName    string          `json:"stock_name"`
+	CurrentPrice decimal.Decimal `json:"current_price"`
+	IsHalted     bool            `json:"is_halted"`
 }
 
+// QuantityHeld is the part of QuantityOwned reserved by open sell orders
 type StockPortfolioItem struct {
-	StockID       string  `json:"stock_id"`
-	StockName     string  `json:"stock_name"`
-	QuantityOwned float64 `json:"quantity_owned"`
+	StockID           string          `json:"stock_id"`
+	StockName         string          `json:"stock_name"`
+	QuantityOwned     decimal.Decimal `json:"quantity_owned"`
+	QuantityAvailable decimal.Decimal `json:"quantity_available"`
+	QuantityHeld      decimal.Decimal `json:"quantity_held"`
 }
 
 type StockPortfolioResponse struct {
@@ -83,12 +118,15 @@ type StockPortfolioResponse struct {
 	Data    []StockPortfolioItem `json:"data"`
 }
 
+// Type is DEPOSIT, WITHDRAWAL, TRADE, REFUND or FEE, StockTxID is the order a TRADE, REFUND or FEE belongs to
 type WalletTransactionItem struct {
-	WalletTxID string  `json:"wallet_tx_id"`
-	StockTxID  string  `json:"stock_tx_id"`
-	IsDebit    bool    `json:"is_debit"`
-	Amount     float64 `json:"amount"`
-	TimeStamp  string  `json:"time_stamp"`
+	WalletTxID string          `json:"wallet_tx_id"`
+	StockTxID  *string         `json:"stock_tx_id"`
+	Type       string          `json:"type"`
+	IsDebit    bool            `json:"is_debit"`
+	Amount     decimal.Decimal `json:"amount"`
+	TimeStamp  string          `json:"time_stamp"`
+	Status     string          `json:"status"`
 }
 
 type WalletTransactionResponse struct {
@@ -97,16 +135,18 @@ type WalletTransactionResponse struct {
 }
 
 type StockTransactionItem struct {
-	StockTxID   string  `json:"stock_tx_id"`
-	StockID     string  `json:"stock_id"`
-	WalletTxID  *string `json:"wallet_tx_id"`
-	OrderStatus string  `json:"order_status"`
-	ParentTxID  *string `json:"parent_stock_tx_id"`
-	IsBuy       bool    `json:"is_buy"`
-	OrderType   string  `json:"order_type"`
-	StockPrice  float64 `json:"stock_price"`
-	Quantity    float64 `json:"quantity"`
-	TimeStamp   string  `json:"time_stamp"`
+	StockTxID     string          `json:"stock_tx_id"`
+	StockID       string          `json:"stock_id"`
+	WalletTxID    *string         `json:"wallet_tx_id"`
+	OrderStatus   string          `json:"order_status"`
+	ParentTxID    *string         `json:"parent_stock_tx_id"`
+	IsBuy         bool            `json:"is_buy"`
+	OrderType     string          `json:"order_type"`
+	StockPrice    decimal.Decimal `json:"stock_price"`
+	Quantity      decimal.Decimal `json:"quantity"`
+	TimeStamp     string          `json:"time_stamp"`
+	ClientOrderID *string         `json:"client_order_id"`
+	Fee           decimal.Decimal `json:"fee"` // trading fees charged to the order so far
 }
 
 type StockTransactionResponse struct {
@@ -114,44 +154,48 @@ type StockTransactionResponse struct {
 	Data    []StockTransactionItem `json:"data"`
 }
 
-func handleError(c *gin.Context, statusCode int, message string, err error) {
-	errorResponse := ErrorResponse{
-		Success: false,
-		Data:    map[string]string{"error": message},
-	}
-	c.IndentedJSON(statusCode, errorResponse)
+type StockCandleItem struct {
+	TimeStamp  string          `json:"time_stamp"`
+	Open       decimal.Decimal `json:"open"`
+	High       decimal.Decimal `json:"high"`
+	Low        decimal.Decimal `json:"low"`
+	Close      decimal.Decimal `json:"close"`
+	Volume     decimal.Decimal `json:"volume"`
+	TradeCount int             `json:"trade_count"`
 }
 
-func addMoneyToWallet(c *gin.Context) {
-	userName, _ := c.Get("user_name")
-
-	if userName == nil {
-		handleError(c, http.StatusBadRequest, "Failed to obtain the user name", nil)
-		return
-	}
+type StockCandleResponse struct {
+	Success bool              `json:"success"`
+	Data    []StockCandleItem `json:"data"`
+}
 
-	var addMoney AddMoney
-	if err := c.ShouldBindJSON(&addMoney); err != nil {
-		handleError(c, http.StatusBadRequest, "Invalid request body", err)
-		return
-	}
+type TradeItem struct {
+	TradeID       string          `json:"trade_id"`
+	StockID       string          `json:"stock_id"`
+	Price         decimal.Decimal `json:"price"`
+	Quantity      decimal.Decimal `json:"quantity"`
+	BuyStockTxID  string          `json:"buy_stock_tx_id"`
+	SellStockTxID string          `json:"sell_stock_tx_id"`
+	Aggressor     string          `json:"aggressor"`
+	TimeStamp     string          `json:"time_stamp"`
+}
 
-	if addMoney.Amount <= 0 {
-		handleError(c, http.StatusOK, "Invalid amount", nil)
-		return
-	}
+type TradePage struct {
+	Trades []TradeItem `json:"trades"`
+	Before *string     `json:"before"` // pass as before to get the next (older) page, null on the last page
+}
 
-	_, err := stmtAddMoney.Exec(addMoney.Amount, userName)
-	if err != nil {
-		handleError(c, http.StatusInternalServerError, "Failed to update wallet", err)
-		return
-	}
+type TradeResponse struct {
+	Success bool      `json:"success"`
+	Data    TradePage `json:"data"`
+}
 
-	response := PostResponse{
-		Success: true,
-		Data:    nil,
+func handleError(c *gin.Context, statusCode int, message string, err error) {
+	errorResponse := ErrorResponse{
+		Success: false,
+		Data:    map[string]string{"error": message},
 	}
-	c.IndentedJSON(http.StatusOK, response)
+	c.IndentedJSON(statusCode, errorResponse)
 }
 
 func getWalletBalance(c *gin.Context) {
@@ -162,8 +206,8 @@ func getWalletBalance(c *gin.Context) {
 		return
 	}
 
-	var balance float64
-	err := stmtWalletBalance.QueryRow(userName).Scan(&balance)
+	var balance, held decimal.Decimal
+	err := stmtWalletBalance.QueryRow(userName).Scan(&balance, &held)
 	if err != nil {
 		handleError(c, http.StatusInternalServerError, "Failed to query wallet balance", err)
 		return
@@ -172,7 +216,9 @@ func getWalletBalance(c *gin.Context) {
 	response := WalletBalanceResponse{
 		Success: true,
 		Data: WalletData{
-			Balance: balance,
+			Balance:   balance,
+			Available: balance.Sub(held),
+			Held:      held,
 		},
 	}
 	c.IndentedJSON(http.StatusOK, response)
@@ -189,7 +235,7 @@ func getStockPrices(c *gin.Context) {
 	var stocks []StockData
 	for rows.Next() {
 		var item StockData
-		if err := rows.Scan(&item.StockID, &item.StockName, &item.CurrentPrice); err != nil {
+		if err := rows.Scan(&item.StockID, &item.StockName, &item.CurrentPrice, &item.IsHalted); err != nil {
 			handleError(c, http.StatusInternalServerError, "Failed to scan row", err)
 			return
 		}
@@ -221,10 +267,11 @@ func getStockPortfolio(c *gin.Context) {
 	var portfolio []StockPortfolioItem
 	for rows.Next() {
 		var item StockPortfolioItem
-		if err := rows.Scan(&item.StockID, &item.StockName, &item.QuantityOwned); err != nil {
+		if err := rows.Scan(&item.StockID, &item.StockName, &item.QuantityOwned, &item.QuantityHeld); err != nil {
 			handleError(c, http.StatusInternalServerError, "Failed to scan row", err)
 			return
 		}
+		item.QuantityAvailable = item.QuantityOwned.Sub(item.QuantityHeld)
 		portfolio = append(portfolio, item)
 	}
 
@@ -258,7 +305,7 @@ func getWalletTransactions(c *gin.Context) {
 	var walletTransactions []WalletTransactionItem
 	for rows.Next() {
 		var item WalletTransactionItem
-		if err := rows.Scan(&item.WalletTxID, &item.StockTxID, &item.IsDebit, &item.Amount, &item.TimeStamp); err != nil {
+		if err := rows.Scan(&item.WalletTxID, &item.StockTxID, &item.Type, &item.IsDebit, &item.Amount, &item.TimeStamp, &item.Status); err != nil {
 			handleError(c, http.StatusInternalServerError, "Failed to scan row", err)
 			return
 		}
@@ -290,7 +337,7 @@ func getStockTransactions(c *gin.Context) {
 	var stockTransactions []StockTransactionItem
 	for rows.Next() {
 		var item StockTransactionItem
-		if err := rows.Scan(&item.StockTxID, &item.StockID, &item.WalletTxID, &item.OrderStatus, &item.ParentTxID, &item.IsBuy, &item.OrderType, &item.StockPrice, &item.Quantity, &item.TimeStamp); err != nil {
+		if err := rows.Scan(&item.StockTxID, &item.StockID, &item.WalletTxID, &item.OrderStatus, &item.ParentTxID, &item.IsBuy, &item.OrderType, &item.StockPrice, &item.Quantity, &item.TimeStamp, &item.ClientOrderID, &item.Fee); err != nil {
 			handleError(c, http.StatusInternalServerError, "Failed to scan row", err)
 			return
 		}
@@ -304,6 +351,121 @@ func getStockTransactions(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, response)
 }
 
+// getStockCandles returns the OHLCV candles of a stock whose bucket starts in [from, to), oldest first
+func getStockCandles(c *gin.Context) {
+	stockID := c.Query("stock_id")
+	if stockID == "" {
+		handleError(c, http.StatusBadRequest, "Missing stock_id", nil)
+		return
+	}
+
+	interval := c.DefaultQuery("interval", "1m")
+	duration, ok := candleIntervals[interval]
+	if !ok {
+		handleError(c, http.StatusBadRequest, "Invalid interval, expected 1m, 5m, 1h or 1d", nil)
+		return
+	}
+
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			handleError(c, http.StatusBadRequest, "Invalid to, expected an RFC 3339 time", err)
+			return
+		}
+		to = parsed.UTC()
+	}
+
+	from := to.Add(-defaultCandleCount * duration)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			handleError(c, http.StatusBadRequest, "Invalid from, expected an RFC 3339 time", err)
+			return
+		}
+		from = parsed.UTC()
+	}
+
+	if !from.Before(to) {
+		handleError(c, http.StatusBadRequest, "from must be before to", nil)
+		return
+	}
+
+	rows, err := stmtStockCandles.Query(stockID, interval, from, to)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to query stock candles", err)
+		return
+	}
+	defer rows.Close()
+
+	candles := []StockCandleItem{}
+	for rows.Next() {
+		var item StockCandleItem
+		var bucketStart time.Time
+		if err := rows.Scan(&bucketStart, &item.Open, &item.High, &item.Low, &item.Close, &item.Volume, &item.TradeCount); err != nil {
+			handleError(c, http.StatusInternalServerError, "Failed to scan row", err)
+			return
+		}
+		item.TimeStamp = bucketStart.UTC().Format(time.RFC3339)
+		candles = append(candles, item)
+	}
+
+	response := StockCandleResponse{
+		Success: true,
+		Data:    candles,
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// getTrades pages through the trade tape of a stock, newest first
+func getTrades(c *gin.Context) {
+	stockID := c.Query("stock_id")
+	if stockID == "" {
+		handleError(c, http.StatusBadRequest, "Missing stock_id", nil)
+		return
+	}
+
+	limit := defaultTradeLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxTradeLimit {
+			handleError(c, http.StatusBadRequest, fmt.Sprintf("Invalid limit, expected 1 to %d", maxTradeLimit), err)
+			return
+		}
+		limit = parsed
+	}
+
+	// fetch one extra trade to know whether there is another page
+	rows, err := stmtTrades.Query(stockID, c.Query("before"), limit+1)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to query trades", err)
+		return
+	}
+	defer rows.Close()
+
+	trades := []TradeItem{}
+	for rows.Next() {
+		var item TradeItem
+		if err := rows.Scan(&item.TradeID, &item.StockID, &item.Price, &item.Quantity, &item.BuyStockTxID, &item.SellStockTxID, &item.Aggressor, &item.TimeStamp); err != nil {
+			handleError(c, http.StatusInternalServerError, "Failed to scan row", err)
+			return
+		}
+		trades = append(trades, item)
+	}
+
+	page := TradePage{Trades: trades}
+	if len(trades) > limit {
+		page.Trades = trades[:limit]
+		page.Before = &trades[limit-1].TradeID
+	}
+
+	response := TradeResponse{
+		Success: true,
+		Data:    page,
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
 func initializeDB() error {
 	var err error
     postgresqlUserDbInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", user_host, user_port, user, password, dbname)
@@ -358,18 +520,13 @@ func initializeDB() error {
 func prepareStatements() error {
 	var err error
 
-	stmtAddMoney, err = user_db.Prepare("UPDATE users SET wallet = wallet + $1 WHERE user_name = $2")
-	if err != nil {
-		return fmt.Errorf("failed to prepare addMoney statement: %v", err)
-	}
-
-	stmtWalletBalance, err = user_db.Prepare("SELECT wallet FROM users WHERE user_name = $1")
+	stmtWalletBalance, err = user_db.Prepare("SELECT wallet, wallet_held FROM users WHERE user_name = $1")
 	if err != nil {
 		return fmt.Errorf("failed to prepare walletBalance statement: %v", err)
 	}
 
 	stmtStockPortfolio, err = stock_db.Prepare(`
-        SELECT s.stock_id, s.stock_name, us.quantity
+        SELECT s.stock_id, s.stock_name, us.quantity, us.quantity_held
         FROM user_stocks us
         JOIN stocks s ON s.stock_id = us.stock_id
         WHERE us.user_name = $1
@@ -379,9 +536,9 @@ func prepareStatements() error {
 	}
 
 	stmtWalletTransactions, err = tx_db.Prepare(`
-        SELECT wt.wallet_tx_id, st.stock_tx_id, wt.is_debit, wt.amount, wt.time_stamp
+        SELECT wt.wallet_tx_id, COALESCE(st.stock_tx_id, wt.stock_tx_id), COALESCE(wt.tx_type, 'TRADE'), wt.is_debit, wt.amount, wt.time_stamp, COALESCE(wt.status, 'COMPLETED')
         FROM wallet_transactions wt
-        JOIN stock_transactions st ON st.wallet_tx_id = wt.wallet_tx_id
+        LEFT JOIN stock_transactions st ON st.wallet_tx_id = wt.wallet_tx_id
         WHERE wt.user_name = $1
 		ORDER BY wt.time_stamp ASC`)
 	if err != nil {
@@ -389,7 +546,7 @@ func prepareStatements() error {
 	}
 
 	stmtStockTransactions, err = tx_db.Prepare(`
-        SELECT stock_tx_id, stock_id, wallet_tx_id, order_status, parent_stock_tx_id, is_buy, order_type, stock_price, quantity, time_stamp
+        SELECT stock_tx_id, stock_id, wallet_tx_id, order_status, parent_stock_tx_id, is_buy, order_type, stock_price, quantity, time_stamp, client_order_id, COALESCE(fee, 0)
         FROM stock_transactions
         WHERE user_name = $1
 		ORDER BY time_stamp ASC`)
@@ -398,13 +555,130 @@ func prepareStatements() error {
 	}
 
 	stmtStockPrices, err = stock_db.Prepare(`
-		SELECT stock_id, stock_name, current_price
+		SELECT stock_id, stock_name, current_price, is_halted
 		FROM stocks
 		ORDER BY time_added ASC`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare stockPrices statement: %v", err)
 	}
 
+	stmtStockCandles, err = stock_db.Prepare(`
+		SELECT bucket_start, open, high, low, close, volume, trade_count
+		FROM stock_candles
+		WHERE stock_id = $1 AND candle_interval = $2 AND bucket_start >= $3 AND bucket_start < $4
+		ORDER BY bucket_start ASC`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare stockCandles statement: %v", err)
+	}
+
+	stmtTrades, err = tx_db.Prepare(`
+		SELECT trade_id, stock_id, price, quantity, buy_stock_tx_id, sell_stock_tx_id, aggressor, time_stamp
+		FROM trades
+		WHERE stock_id = $1
+			AND ($2 = '' OR (time_stamp, trade_id) < (SELECT time_stamp, trade_id FROM trades WHERE trade_id = $2))
+		ORDER BY time_stamp DESC, trade_id DESC
+		LIMIT $3`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare trades statement: %v", err)
+	}
+
+	stmtLockAvailableFunds, err = user_db.Prepare("SELECT wallet - wallet_held FROM users WHERE user_name = $1 FOR UPDATE")
+	if err != nil {
+		return fmt.Errorf("failed to prepare lockAvailableFunds statement: %v", err)
+	}
+
+	stmtUpdateWallet, err = user_db.Prepare("UPDATE users SET wallet = wallet + $1, wallet_held = wallet_held + $2 WHERE user_name = $3")
+	if err != nil {
+		return fmt.Errorf("failed to prepare updateWallet statement: %v", err)
+	}
+
+	stmtPostLedgerLine, err = user_db.Prepare(`
+		INSERT INTO ledger_entries (journal_id, account, sub_account, asset, amount, kind)
+		VALUES ($1, $2, $3, 'CASH', $4, $5)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare postLedgerLine statement: %v", err)
+	}
+
+	stmtJournalPosted, err = user_db.Prepare("SELECT EXISTS (SELECT 1 FROM ledger_entries WHERE journal_id = $1)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare journalPosted statement: %v", err)
+	}
+
+	// Failed withdrawals give the money back, so they do not count against the daily limit
+	stmtWithdrawnToday, err = tx_db.Prepare(`
+		SELECT COALESCE(SUM(amount), 0)
+		FROM withdrawals
+		WHERE user_name = $1 AND status <> 'FAILED' AND time_stamp >= date_trunc('day', CURRENT_TIMESTAMP)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare withdrawnToday statement: %v", err)
+	}
+
+	stmtInsertWithdrawal, err = tx_db.Prepare(`
+		INSERT INTO withdrawals (withdrawal_id, user_name, amount)
+		VALUES (gen_random_uuid()::text, $1, $2)
+		RETURNING withdrawal_id, time_stamp`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insertWithdrawal statement: %v", err)
+	}
+
+	stmtInsertWithdrawalTransaction, err = tx_db.Prepare(`
+		INSERT INTO wallet_transactions (wallet_tx_id, user_name, is_debit, amount, time_stamp, status, tx_type)
+		VALUES ($1, $2, TRUE, $3, $4, 'PENDING', 'WITHDRAWAL')`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insertWithdrawalTransaction statement: %v", err)
+	}
+
+	stmtFinishWithdrawal, err = tx_db.Prepare(`
+		UPDATE withdrawals SET status = $2, failure_reason = NULLIF($3, ''), time_completed = CURRENT_TIMESTAMP
+		WHERE withdrawal_id = $1 AND status = 'PENDING'`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare finishWithdrawal statement: %v", err)
+	}
+
+	// the change is also appended to the status history, wallet_transactions only keeps the latest status
+	stmtSetWalletTransactionStatus, err = tx_db.Prepare(`
+		WITH change AS (INSERT INTO wallet_transaction_status_changes (wallet_tx_id, status) VALUES ($2, $1))
+		UPDATE wallet_transactions SET status = $1 WHERE wallet_tx_id = $2`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare setWalletTransactionStatus statement: %v", err)
+	}
+
+	stmtPendingWithdrawals, err = tx_db.Prepare(`
+		SELECT withdrawal_id, user_name, amount, time_stamp
+		FROM withdrawals
+		WHERE status = 'PENDING'
+		ORDER BY time_stamp ASC`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare pendingWithdrawals statement: %v", err)
+	}
+
+	// A deposit with an idempotency key gets its wallet_tx_id from the user name and key, so a retry hits the primary key
+	stmtInsertDeposit, err = tx_db.Prepare(`
+		INSERT INTO wallet_transactions (wallet_tx_id, user_name, is_debit, amount, status, tx_type, idempotency_key)
+		VALUES (CASE WHEN $3 = '' THEN gen_random_uuid()::text ELSE md5($1 || '/' || $3)::uuid::text END, $1, FALSE, $2, 'PENDING', 'DEPOSIT', NULLIF($3, ''))
+		ON CONFLICT (wallet_tx_id) DO NOTHING
+		RETURNING wallet_tx_id`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insertDeposit statement: %v", err)
+	}
+
+	stmtGetDeposit, err = tx_db.Prepare(`
+		SELECT wallet_tx_id, amount, status
+		FROM wallet_transactions
+		WHERE wallet_tx_id = md5($1 || '/' || $2)::uuid::text AND user_name = $1 AND tx_type = 'DEPOSIT'`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare getDeposit statement: %v", err)
+	}
+
+	stmtPendingDeposits, err = tx_db.Prepare(`
+		SELECT wallet_tx_id, user_name, amount, COALESCE(idempotency_key, '')
+		FROM wallet_transactions
+		WHERE tx_type = 'DEPOSIT' AND status = 'PENDING'
+		ORDER BY time_stamp ASC`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare pendingDeposits statement: %v", err)
+	}
+
 	return nil
 }
 
@@ -424,12 +698,26 @@ func main() {
 		return
 	}
 
-	defer stmtAddMoney.Close()
 	defer stmtWalletBalance.Close()
 	defer stmtStockPortfolio.Close()
 	defer stmtWalletTransactions.Close()
 	defer stmtStockTransactions.Close()
 	defer stmtStockPrices.Close()
+	defer stmtStockCandles.Close()
+	defer stmtTrades.Close()
+	defer stmtLockAvailableFunds.Close()
+	defer stmtUpdateWallet.Close()
+	defer stmtPostLedgerLine.Close()
+	defer stmtJournalPosted.Close()
+	defer stmtWithdrawnToday.Close()
+	defer stmtInsertWithdrawal.Close()
+	defer stmtInsertWithdrawalTransaction.Close()
+	defer stmtFinishWithdrawal.Close()
+	defer stmtSetWalletTransactionStatus.Close()
+	defer stmtPendingWithdrawals.Close()
+	defer stmtInsertDeposit.Close()
+	defer stmtGetDeposit.Close()
+	defer stmtPendingDeposits.Close()
 
     user_db.SetMaxOpenConns(10) // Set maximum number of open connections
     user_db.SetMaxIdleConns(5) // Set maximum number of idle connections
@@ -440,6 +728,9 @@ func main() {
     tx_db.SetMaxOpenConns(10) // Set maximum number of open connections
     tx_db.SetMaxIdleConns(5) // Set maximum number of idle connections
 
+	resumePendingDeposits()
+	resumePendingWithdrawals()
+
 	router := gin.Default()
 
 	config := cors.DefaultConfig()
@@ -451,10 +742,13 @@ func main() {
 
 	identification.Test()
 	router.POST("/addMoneyToWallet", identification.Identification, addMoneyToWallet)
+	router.POST("/withdrawFromWallet", identification.Identification, withdrawFromWallet)
 	router.GET("/getWalletBalance", identification.Identification, getWalletBalance)
 	router.GET("/getStockPortfolio", identification.Identification, getStockPortfolio)
 	router.GET("/getWalletTransactions", identification.Identification, getWalletTransactions)
 	router.GET("/getStockTransactions", identification.Identification, getStockTransactions)
 	router.GET("/getStockPrices", identification.Identification, getStockPrices)
+	router.GET("/getStockCandles", identification.Identification, getStockCandles)
+	router.GET("/getTrades", getTrades)
 	router.Run(":5433")
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// callHandler runs a handler for a GET request of query as an authenticated user and returns the status code
+func callHandler(handler gin.HandlerFunc, query string) int {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+	c.Set("user_name", "user")
+
+	handler(c)
+	return recorder.Code
+}
+
+// postHandler runs a handler for a POST of body as an authenticated user and returns the status code and error message
+func postHandler(handler gin.HandlerFunc, body string) (int, string) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set("user_name", "user")
+
+	handler(c)
+
+	var response ErrorResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response.Data["error"]
+}
+
+func TestGetStockCandlesRejectsInvalidQueries(t *testing.T) {
+	queries := []string{
+		"",
+		"stock_id=s&interval=2m",
+		"stock_id=s&to=yesterday",
+		"stock_id=s&from=2026-03-02",
+		"stock_id=s&from=2026-03-02T10:00:00Z&to=2026-03-02T10:00:00Z",
+		"stock_id=s&from=2026-03-02T11:00:00Z&to=2026-03-02T10:00:00Z",
+	}
+	for _, query := range queries {
+		if code := callHandler(getStockCandles, query); code != http.StatusBadRequest {
+			t.Errorf("%q got %d, want 400", query, code)
+		}
+	}
+}
+
+func TestCandleIntervals(t *testing.T) {
+	for _, interval := range []string{"1m", "5m", "1h", "1d"} {
+		if _, ok := candleIntervals[interval]; !ok {
+			t.Errorf("interval %s is not served", interval)
+		}
+	}
+}
+
+func TestGetTradesRejectsInvalidQueries(t *testing.T) {
+	for _, query := range []string{"", "stock_id=s&limit=0", "stock_id=s&limit=501", "stock_id=s&limit=ten"} {
+		if code := callHandler(getTrades, query); code != http.StatusBadRequest {
+			t.Errorf("%q got %d, want 400", query, code)
+		}
+	}
+}
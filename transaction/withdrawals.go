@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+)
+
+/*
+	Withdrawals: /withdrawFromWallet takes money out of the available part of a wallet. The amount is held right away
+	(AVAILABLE to HELD in the ledger) and the withdrawal stays PENDING until the payout provider reports back. A
+	completed payout takes the held money out of the wallet to EXTERNAL, a failed one releases it again.
+
+	Each step is posted under the journal id <withdrawal_id>-HOLD, -COMPLETED or -FAILED, so a step that is retried
+	after a crash is not applied twice. Withdrawals still PENDING at startup are handed to the provider again.
+*/
+
+// Withdrawal is a request to pay money out of a user's wallet
+type Withdrawal struct {
+	WithdrawalID string          `json:"withdrawal_id"`
+	UserName     string          `json:"-"`
+	Amount       decimal.Decimal `json:"amount"`
+	Status       string          `json:"status"`
+	TimeStamp    string          `json:"time_stamp"`
+}
+
+type WithdrawMoney struct {
+	Amount decimal.Decimal `json:"amount"`
+}
+
+type WithdrawalResponse struct {
+	Success bool       `json:"success"`
+	Data    Withdrawal `json:"data"`
+}
+
+// PayoutProvider pays withdrawals out and calls done once a payout succeeded (nil) or failed. A withdrawal can be sent
+// again after a restart, so a provider must pay each withdrawal id out at most once.
+type PayoutProvider interface {
+	SendPayout(withdrawal Withdrawal, done func(withdrawal Withdrawal, err error))
+}
+
+// fakePayoutProvider stands in for a bank: it pays out after delay, and fails payouts above failAbove when it is set
+type fakePayoutProvider struct {
+	delay     time.Duration
+	failAbove decimal.Decimal
+}
+
+func (provider fakePayoutProvider) SendPayout(withdrawal Withdrawal, done func(withdrawal Withdrawal, err error)) {
+	go func() {
+		time.Sleep(provider.delay)
+		if provider.failAbove.IsPositive() && withdrawal.Amount.GreaterThan(provider.failAbove) {
+			done(withdrawal, fmt.Errorf("payout of %v is above the limit of %v", withdrawal.Amount, provider.failAbove))
+			return
+		}
+		done(withdrawal, nil)
+	}()
+}
+
+var payoutProvider PayoutProvider = fakePayoutProvider{delay: fakePayoutDelay, failAbove: fakePayoutFailAbove}
+
+func withdrawFromWallet(c *gin.Context) {
+	userName, _ := c.Get("user_name")
+
+	if userName == nil {
+		handleError(c, http.StatusBadRequest, "Failed to obtain the user name", nil)
+		return
+	}
+
+	var withdrawMoney WithdrawMoney
+	if err := c.ShouldBindJSON(&withdrawMoney); err != nil {
+		handleError(c, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+
+	if !withdrawMoney.Amount.IsPositive() || !withdrawMoney.Amount.Equal(withdrawMoney.Amount.Round(2)) {
+		handleError(c, http.StatusOK, "Invalid amount", nil)
+		return
+	}
+
+	// The user's row stays locked until the hold is written, so concurrent withdrawals and orders see the hold
+	tx, err := user_db.Begin()
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to withdraw", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var available decimal.Decimal
+	if err := tx.Stmt(stmtLockAvailableFunds).QueryRow(userName).Scan(&available); err != nil {
+		if err == sql.ErrNoRows {
+			handleError(c, http.StatusBadRequest, "User not found", nil)
+			return
+		}
+		handleError(c, http.StatusInternalServerError, "Failed to query wallet balance", err)
+		return
+	}
+	if available.LessThan(withdrawMoney.Amount) {
+		handleError(c, http.StatusOK, "Insufficient available funds", nil)
+		return
+	}
+
+	var withdrawnToday decimal.Decimal
+	if err := stmtWithdrawnToday.QueryRow(userName).Scan(&withdrawnToday); err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to query withdrawals", err)
+		return
+	}
+	if withdrawnToday.Add(withdrawMoney.Amount).GreaterThan(withdrawalDailyLimit) {
+		handleError(c, http.StatusOK, fmt.Sprintf("Daily withdrawal limit of %v exceeded, %v left today", withdrawalDailyLimit, decimal.Max(withdrawalDailyLimit.Sub(withdrawnToday), decimal.Zero)), nil)
+		return
+	}
+
+	withdrawal, err := insertWithdrawal(userName.(string), withdrawMoney.Amount)
+	if err != nil {
+		handleError(c, http.StatusInternalServerError, "Failed to create withdrawal", err)
+		return
+	}
+
+	// the withdrawal row is written first, a hold that fails to commit leaves it to be failed by the next startup
+	err = postWalletChange(tx, withdrawal.WithdrawalID+"-HOLD", "HOLD", withdrawal.UserName, decimal.Zero, withdrawal.Amount)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		markWithdrawal(withdrawal, "FAILED", "Failed to hold the amount")
+		handleError(c, http.StatusInternalServerError, "Failed to hold the amount", err)
+		return
+	}
+
+	payoutProvider.SendPayout(withdrawal, finishWithdrawal)
+
+	response := WithdrawalResponse{
+		Success: true,
+		Data:    withdrawal,
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// insertWithdrawal creates a PENDING withdrawal and the wallet transaction showing it in the wallet history
+func insertWithdrawal(userName string, amount decimal.Decimal) (Withdrawal, error) {
+	withdrawal := Withdrawal{UserName: userName, Amount: amount, Status: "PENDING"}
+
+	tx, err := tx_db.Begin()
+	if err != nil {
+		return withdrawal, err
+	}
+	defer tx.Rollback()
+
+	var timeStamp time.Time
+	if err := tx.Stmt(stmtInsertWithdrawal).QueryRow(userName, amount).Scan(&withdrawal.WithdrawalID, &timeStamp); err != nil {
+		return withdrawal, err
+	}
+	withdrawal.TimeStamp = timeStamp.UTC().Format(time.RFC3339)
+
+	if _, err := tx.Stmt(stmtInsertWithdrawalTransaction).Exec(withdrawal.WithdrawalID, userName, amount, timeStamp); err != nil {
+		return withdrawal, err
+	}
+	return withdrawal, tx.Commit()
+}
+
+// finishWithdrawal is called by the payout provider: the held amount leaves the wallet, or is released when the payout failed
+func finishWithdrawal(withdrawal Withdrawal, payoutErr error) {
+	status, reason := "COMPLETED", ""
+	var err error
+	if payoutErr == nil {
+		err = applyWalletChange(withdrawal.WithdrawalID+"-COMPLETED", "WITHDRAWAL", withdrawal.UserName, withdrawal.Amount.Neg(), withdrawal.Amount.Neg())
+	} else {
+		status, reason = "FAILED", payoutErr.Error()
+		err = applyWalletChange(withdrawal.WithdrawalID+"-FAILED", "RELEASE", withdrawal.UserName, decimal.Zero, withdrawal.Amount.Neg())
+	}
+
+	// the withdrawal stays PENDING and is finished again on the next startup
+	if err != nil {
+		fmt.Printf("Failed to finish withdrawal %s: %v\n", withdrawal.WithdrawalID, err)
+		return
+	}
+	markWithdrawal(withdrawal, status, reason)
+}
+
+// markWithdrawal sets the status of a PENDING withdrawal and of its wallet transaction
+func markWithdrawal(withdrawal Withdrawal, status string, reason string) {
+	tx, err := tx_db.Begin()
+	if err != nil {
+		fmt.Printf("Failed to mark withdrawal %s %s: %v\n", withdrawal.WithdrawalID, status, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(stmtFinishWithdrawal).Exec(withdrawal.WithdrawalID, status, reason); err != nil {
+		fmt.Printf("Failed to mark withdrawal %s %s: %v\n", withdrawal.WithdrawalID, status, err)
+		return
+	}
+	if _, err := tx.Stmt(stmtSetWalletTransactionStatus).Exec(status, withdrawal.WithdrawalID); err != nil {
+		fmt.Printf("Failed to mark withdrawal %s %s: %v\n", withdrawal.WithdrawalID, status, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Printf("Failed to mark withdrawal %s %s: %v\n", withdrawal.WithdrawalID, status, err)
+	}
+}
+
+// applyWalletChange posts a wallet change once, nothing happens when its journal was already posted
+func applyWalletChange(journalID string, kind string, userName string, amount decimal.Decimal, held decimal.Decimal) error {
+	tx, err := user_db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the user's row first, so two attempts at the same journal cannot both see it missing
+	var available decimal.Decimal
+	if err := tx.Stmt(stmtLockAvailableFunds).QueryRow(userName).Scan(&available); err != nil {
+		return err
+	}
+
+	var posted bool
+	if err := tx.Stmt(stmtJournalPosted).QueryRow(journalID).Scan(&posted); err != nil {
+		return err
+	}
+	if posted {
+		return nil
+	}
+
+	if err := postWalletChange(tx, journalID, kind, userName, amount, held); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postWalletChange changes a wallet (amount) and its held part (held), and posts the change against EXTERNAL
+func postWalletChange(tx *sql.Tx, journalID string, kind string, userName string, amount decimal.Decimal, held decimal.Decimal) error {
+	if _, err := tx.Stmt(stmtUpdateWallet).Exec(amount, held, userName); err != nil {
+		return fmt.Errorf("Failed to update wallet: %w", err)
+	}
+
+	lines := []struct {
+		account    string
+		subAccount string
+		amount     decimal.Decimal
+	}{
+		{userName, "AVAILABLE", amount.Sub(held)},
+		{userName, "HELD", held},
+		{"EXTERNAL", "MAIN", amount.Neg()},
+	}
+	for _, line := range lines {
+		if line.amount.IsZero() {
+			continue
+		}
+		if _, err := tx.Stmt(stmtPostLedgerLine).Exec(journalID, line.account, line.subAccount, line.amount, kind); err != nil {
+			return fmt.Errorf("Failed to post ledger entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// resumePendingWithdrawals hands the withdrawals that were still PENDING at shutdown to the payout provider again
+func resumePendingWithdrawals() {
+	rows, err := stmtPendingWithdrawals.Query()
+	if err != nil {
+		fmt.Println("Failed to query pending withdrawals: ", err)
+		return
+	}
+
+	var pending []Withdrawal
+	for rows.Next() {
+		withdrawal := Withdrawal{Status: "PENDING"}
+		var timeStamp time.Time
+		if err := rows.Scan(&withdrawal.WithdrawalID, &withdrawal.UserName, &withdrawal.Amount, &timeStamp); err != nil {
+			fmt.Println("Failed to scan pending withdrawal: ", err)
+			continue
+		}
+		withdrawal.TimeStamp = timeStamp.UTC().Format(time.RFC3339)
+		pending = append(pending, withdrawal)
+	}
+	rows.Close()
+
+	for _, withdrawal := range pending {
+		// a withdrawal whose hold was never committed has nothing to pay out
+		var held bool
+		if err := stmtJournalPosted.QueryRow(withdrawal.WithdrawalID + "-HOLD").Scan(&held); err != nil {
+			fmt.Printf("Failed to check withdrawal %s: %v\n", withdrawal.WithdrawalID, err)
+			continue
+		}
+		if !held {
+			markWithdrawal(withdrawal, "FAILED", "Failed to hold the amount")
+			continue
+		}
+		payoutProvider.SendPayout(withdrawal, finishWithdrawal)
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("Resumed %d pending withdrawals\n", len(pending))
+	}
+}
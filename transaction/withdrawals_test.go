@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestWithdrawFromWalletRejectsInvalidAmounts(t *testing.T) {
+	for _, body := range []string{`{"amount": 0}`, `{"amount": -5}`, `{"amount": 10.001}`} {
+		if _, message := postHandler(withdrawFromWallet, body); message != "Invalid amount" {
+			t.Errorf("%s got %q, want Invalid amount", body, message)
+		}
+	}
+	if code, _ := postHandler(withdrawFromWallet, `{"amount": "ten"}`); code != 400 {
+		t.Errorf("an invalid body got %d, want 400", code)
+	}
+}
+
+func TestFakePayoutProvider(t *testing.T) {
+	provider := fakePayoutProvider{failAbove: decimal.NewFromInt(100)}
+
+	results := make(chan error, 2)
+	done := func(withdrawal Withdrawal, err error) { results <- err }
+	provider.SendPayout(Withdrawal{WithdrawalID: "small", Amount: decimal.NewFromInt(100)}, done)
+	provider.SendPayout(Withdrawal{WithdrawalID: "large", Amount: decimal.NewFromInt(101)}, done)
+
+	failed := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				failed++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("the provider never reported back")
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d payouts failed, want only the one above the limit", failed)
+	}
+}
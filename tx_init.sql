@@ -9,7 +9,16 @@ CREATE TABLE IF NOT EXISTS stock_transactions (
     order_type TEXT,
     stock_price NUMERIC(20,2) NOT NULL,
     quantity NUMERIC(20,2),
-    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    time_in_force TEXT,
+    stop_price NUMERIC(20,2),
+    display_quantity NUMERIC(20,2),
+    client_order_id TEXT,
+    post_only BOOLEAN DEFAULT FALSE,
+    reduce_only BOOLEAN DEFAULT FALSE,
+    self_trade_prevention TEXT,
+    fee NUMERIC(20,2) DEFAULT 0, -- trading fees charged to the order so far
+    fee_held NUMERIC(20,2) DEFAULT 0 -- fee a buy order still holds while it is open
 ) PARTITION BY HASH(stock_tx_id);
 
 CREATE TABLE IF NOT EXISTS stock_transactions_h0 PARTITION OF stock_transactions FOR VALUES WITH (modulus 4, remainder 0);
@@ -19,12 +28,26 @@ CREATE TABLE IF NOT EXISTS stock_transactions_h3 PARTITION OF stock_transactions
 
 CREATE INDEX IF NOT EXISTS stock_tx_idx ON stock_transactions USING HASH (user_name);
 
+-- Client order ids are unique per user. The id stays taken once its order has left the book, so a retry of an order
+-- that was cancelled or left the book without trading still finds it
+CREATE TABLE IF NOT EXISTS client_orders (
+    user_name TEXT NOT NULL,
+    client_order_id TEXT NOT NULL,
+    stock_tx_id TEXT NOT NULL,
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_name, client_order_id)
+);
+
 CREATE TABLE IF NOT EXISTS wallet_transactions (
     wallet_tx_id TEXT UNIQUE PRIMARY KEY,
     user_name TEXT,
     is_debit BOOLEAN,
     amount NUMERIC(20,2),
-    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    status TEXT DEFAULT 'COMPLETED', -- PENDING, COMPLETED or FAILED, only deposits and withdrawals are ever pending
+    tx_type TEXT DEFAULT 'TRADE' CHECK (tx_type IN ('DEPOSIT', 'WITHDRAWAL', 'TRADE', 'REFUND', 'FEE')),
+    idempotency_key TEXT, -- deposits only, the wallet_tx_id of a deposit with a key is derived from the user name and key
+    stock_tx_id TEXT      -- FEE and adjusting entries, the order the entry belongs to
 ) PARTITION BY HASH(wallet_tx_id);
 
 CREATE TABLE IF NOT EXISTS wallet_transactions_h0 PARTITION OF wallet_transactions FOR VALUES WITH (modulus 4, remainder 0);
@@ -34,4 +57,68 @@ CREATE TABLE IF NOT EXISTS wallet_transactions_h3 PARTITION OF wallet_transactio
 
 CREATE INDEX IF NOT EXISTS wallet_tx_idx ON wallet_transactions USING HASH (user_name);
 
+-- Every status a deposit or withdrawal moved to, wallet_transactions.status only holds the latest one
+CREATE TABLE IF NOT EXISTS wallet_transaction_status_changes (
+    wallet_tx_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS wallet_transaction_status_changes_idx ON wallet_transaction_status_changes (wallet_tx_id);
+
+CREATE OR REPLACE FUNCTION wallet_status_changes_append_only() RETURNS TRIGGER AS $$
+    BEGIN
+    RAISE EXCEPTION 'wallet transaction status changes cannot be changed or deleted';
+    END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER wallet_transaction_status_changes_append_only
+BEFORE UPDATE OR DELETE ON wallet_transaction_status_changes
+FOR EACH ROW EXECUTE FUNCTION wallet_status_changes_append_only();
+
+-- Withdrawals waiting for or done by the payout provider, withdrawal_id is also the wallet_tx_id of the withdrawal
+CREATE TABLE IF NOT EXISTS withdrawals (
+    withdrawal_id TEXT PRIMARY KEY,
+    user_name TEXT NOT NULL,
+    amount NUMERIC(20,2) NOT NULL,
+    status TEXT DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'COMPLETED', 'FAILED')),
+    failure_reason TEXT,
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    time_completed TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS withdrawals_user_idx ON withdrawals (user_name, time_stamp);
+CREATE INDEX IF NOT EXISTS withdrawals_status_idx ON withdrawals (status);
+
+-- Trade tape, one row per match linking the buy and sell order of the execution
+CREATE TABLE IF NOT EXISTS trades (
+    trade_id TEXT PRIMARY KEY,
+    stock_id TEXT,
+    price NUMERIC(20,2) NOT NULL,
+    quantity NUMERIC(20,2) NOT NULL,
+    buy_stock_tx_id TEXT,
+    sell_stock_tx_id TEXT,
+    aggressor TEXT CHECK (aggressor IN ('BUY', 'SELL')),
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS trades_stock_idx ON trades (stock_id, time_stamp DESC, trade_id DESC);
+
+-- Balance changes of a fill that live in the user and stock databases, written in the same transaction as the fill
+CREATE TABLE IF NOT EXISTS settlement_outbox (
+    settlement_id TEXT,
+    seq INT,
+    kind TEXT,
+    user_name TEXT,
+    stock_id TEXT,
+    amount NUMERIC(20,2),
+    held NUMERIC(20,2) DEFAULT 0,
+    price NUMERIC(20,2) DEFAULT 0,
+    status TEXT DEFAULT 'PENDING',
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (settlement_id, seq)
+);
+
+CREATE INDEX IF NOT EXISTS settlement_outbox_status_idx ON settlement_outbox (status);
+
 ALTER SYSTEM SET port = 5430;
\ No newline at end of file
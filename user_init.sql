@@ -2,9 +2,44 @@ CREATE TABLE IF NOT EXISTS users (
     user_name TEXT PRIMARY KEY,
     name TEXT,
     user_pass VARCHAR(100) NOT NULL,
-    wallet NUMERIC(20,2) DEFAULT 0
+    wallet NUMERIC(20,2) DEFAULT 0,
+    -- part of wallet reserved by open buy orders, the rest is available
+    wallet_held NUMERIC(20,2) NOT NULL DEFAULT 0
 );
 
+-- Settlement effects already applied to this database, makes retried fills idempotent
+CREATE TABLE IF NOT EXISTS applied_settlements (
+    settlement_id TEXT,
+    seq INT,
+    time_applied TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (settlement_id, seq)
+);
+
+-- General ledger, append only: every wallet change is posted here as a journal entry whose lines sum to zero
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    entry_id BIGSERIAL PRIMARY KEY,
+    journal_id TEXT NOT NULL,
+    account TEXT NOT NULL,      -- user name, or the system account EXTERNAL, CLEARING or FEES
+    sub_account TEXT NOT NULL,  -- AVAILABLE or HELD for users, MAIN for system accounts
+    asset TEXT NOT NULL,        -- CASH
+    amount NUMERIC(20,2) NOT NULL,
+    kind TEXT NOT NULL,         -- DEPOSIT, WITHDRAWAL, HOLD, RELEASE, FILL or FEE
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_idx ON ledger_entries (account, asset);
+CREATE INDEX IF NOT EXISTS ledger_entries_journal_idx ON ledger_entries (journal_id);
+
+CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS TRIGGER AS $$
+    BEGIN
+    RAISE EXCEPTION 'ledger entries cannot be changed or deleted';
+    END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER ledger_entries_append_only
+BEFORE UPDATE OR DELETE ON ledger_entries
+FOR EACH ROW EXECUTE FUNCTION ledger_append_only();
+
 CREATE EXTENSION IF NOT EXISTS pgcrypto;
 
 CREATE OR REPLACE FUNCTION pass_encrypt() RETURNS TRIGGER AS $$